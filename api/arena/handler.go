@@ -0,0 +1,140 @@
+package arena
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"super-llm/api/chat"
+	"super-llm/domain/auth"
+	"super-llm/domain/committee"
+
+	"github.com/cv70/pkgo/llm"
+	"github.com/pkg/errors"
+)
+
+// Handler serves blind member comparisons, votes and the arena leaderboard
+type Handler struct {
+	committee *committee.CommitteeDomain
+}
+
+// NewHandler creates a new arena handler
+func NewHandler(committee *committee.CommitteeDomain) *Handler {
+	return &Handler{
+		committee: committee,
+	}
+}
+
+// voteRequest is the body of a vote
+type voteRequest struct {
+	Battle string `json:"battle" binding:"required"`
+	// Winner is the label of the preferred answer, or "tie"
+	Winner string `json:"winner" binding:"required"`
+}
+
+// Compare handles POST /arena/compare, answering a chat request with every
+// member's answer, shuffled and anonymized. Members and topics are taken from
+// the X-Members and X-Topic headers.
+func (h *Handler) Compare(c *gin.Context) {
+	if h.committee.Arena == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Arena is not enabled"})
+		return
+	}
+	var req llm.ChatCompletionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	budget, err := chat.BudgetHeaders(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	opts := &committee.RunOptions{
+		Members: splitHeader(c.GetHeader("X-Members")),
+		Topics:  splitHeader(c.GetHeader("X-Topic")),
+		Budget:  budget,
+		Caller:  auth.FromContext(c.Request.Context()),
+	}
+
+	battle, err := h.committee.Compare(c, &req, opts)
+	if chat.RetryAfter(c, err) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests, retry later"})
+		return
+	}
+	if errors.Is(err, auth.ErrForbidden) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API key may not use the requested model or members"})
+		return
+	}
+	if errors.Is(err, committee.ErrBudgetTooSmall) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Budget too small for a single opinion"})
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to compare members", slog.Any("err", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	chat.SetUsageHeaders(c.Writer.Header(), battle.Usage)
+	c.JSON(http.StatusOK, battle)
+}
+
+// Vote handles POST /arena/vote, recording the preferred answer of a battle
+// and revealing the members behind the answers
+func (h *Handler) Vote(c *gin.Context) {
+	if h.committee.Arena == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Arena is not enabled"})
+		return
+	}
+	var body voteRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	result, err := h.committee.Arena.Vote(body.Battle, strings.TrimSpace(body.Winner))
+	switch {
+	case errors.Is(err, committee.ErrBattleNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Battle not found or already voted on"})
+	case errors.Is(err, committee.ErrInvalidVote):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case err != nil:
+		slog.Error("Failed to record vote", slog.Any("err", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	default:
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+// Leaderboard handles GET /arena/leaderboard, ranking members within the
+// topic given by the topic query parameter, all topics by default
+func (h *Handler) Leaderboard(c *gin.Context) {
+	if h.committee.Arena == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Arena is not enabled"})
+		return
+	}
+	ratings := h.committee.Arena.Ratings
+	topic := strings.ToLower(strings.TrimSpace(c.Query("topic")))
+	if topic == "" {
+		topic = committee.TopicAll
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"topic":  topic,
+		"topics": ratings.Topics(),
+		"data":   ratings.Leaderboard(topic, nil),
+	})
+}
+
+// splitHeader splits a comma-separated header into its trimmed values
+func splitHeader(header string) []string {
+	var values []string
+	for _, value := range strings.Split(header, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
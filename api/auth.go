@@ -0,0 +1,48 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"super-llm/domain/auth"
+)
+
+// authenticate checks the API key of the request, its rate limit and quota,
+// and passes it on as the caller of the request. The committee checks its
+// access to models and members, keeps runs within its quota and charges it
+// for every backend call.
+func (s *routes) authenticate(c *gin.Context) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok {
+		// Anthropic clients send the key in their own header
+		token = c.GetHeader("X-Api-Key")
+	}
+	key := s.auth.Authenticate(strings.TrimSpace(token))
+	if key == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+		return
+	}
+	if wait, err := s.auth.Allow(key); err != nil {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Request = c.Request.WithContext(auth.NewContext(c.Request.Context(), s.auth.Caller(key)))
+	c.Next()
+}
+
+// Usage handles GET /usage, reporting the usage of the caller's key. Admin
+// keys see every key, or the one named by the key query parameter.
+func (s *routes) Usage(c *gin.Context) {
+	key := auth.FromContext(c.Request.Context()).Key
+	name := key.Name
+	if key.Admin {
+		name = c.Query("key")
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": s.auth.Usage(name)})
+}
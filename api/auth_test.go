@@ -0,0 +1,212 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"super-llm/config"
+	"super-llm/domain/auth"
+	"super-llm/domain/committee"
+	"super-llm/infra/fake"
+)
+
+// newTestServer serves a committee of two members backed by a fake backend,
+// saving deliberations and requiring the keys sk-a, limited to alice,
+// sk-b and the admin key sk-admin
+func newTestServer(t *testing.T, configure func(cfg *config.Config)) *Server {
+	t.Helper()
+	backend, err := fake.NewServer(&fake.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(backend.Handler())
+	t.Cleanup(server.Close)
+
+	cfg := &config.Config{
+		LLMs: []*config.LLMConfig{{BaseURL: server.URL + "/v1", Model: "fake-model", APIKey: "test"}},
+		Members: []*config.MemberConfig{
+			{Name: "alice", LLM: "fake-model"},
+			{Name: "bob", LLM: "fake-model"},
+		},
+		Storage: &config.StorageConfig{Type: "jsonl", Path: filepath.Join(t.TempDir(), "deliberations.jsonl")},
+		Auth: &config.AuthConfig{Keys: []*config.APIKeyConfig{
+			{Key: "sk-a", Name: "team-a", Members: []string{"alice"}},
+			{Key: "sk-b", Name: "team-b"},
+			{Key: "sk-admin", Name: "admin", Admin: true},
+		}},
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+	domain, err := committee.BuildCommitteeDomain(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { domain.Close() })
+	keys, err := auth.New(cfg.Auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(domain, keys, cfg.CORS)
+}
+
+// request sends a request with an API key and extra headers
+func request(t *testing.T, h http.Handler, method, path, key string, headers map[string]string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+key)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func chatBody(model string) map[string]any {
+	return map[string]any{
+		"model":    model,
+		"messages": []map[string]any{{"role": "user", "content": "What is 2+2?"}},
+	}
+}
+
+func TestKeyScopes(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	if w := request(t, s, http.MethodPost, "/v1/chat/completions", "sk-a", nil, chatBody("bob")); w.Code != http.StatusForbidden {
+		t.Errorf("leader outside the key: status %d, want 403", w.Code)
+	}
+	headers := map[string]string{"X-Members": "alice,bob"}
+	if w := request(t, s, http.MethodPost, "/v1/chat/completions", "sk-a", headers, chatBody("alice")); w.Code != http.StatusForbidden {
+		t.Errorf("member outside the key: status %d, want 403", w.Code)
+	}
+
+	w := request(t, s, http.MethodPost, "/v1/chat/completions", "sk-a", nil, chatBody("alice"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	id := w.Header().Get("X-Deliberation-Id")
+
+	w = request(t, s, http.MethodGet, "/v1/deliberations/"+id, "sk-a", nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("own deliberation: status %d", w.Code)
+	}
+	var deliberation committee.Deliberation
+	if err := json.Unmarshal(w.Body.Bytes(), &deliberation); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(deliberation.Members, []string{"alice"}) || deliberation.Owner != "team-a" {
+		t.Errorf("members %v owner %q, want the key's members and owner", deliberation.Members, deliberation.Owner)
+	}
+
+	if w := request(t, s, http.MethodGet, "/v1/deliberations/"+id, "sk-b", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("other key's deliberation: status %d, want 404", w.Code)
+	}
+	if w := request(t, s, http.MethodGet, "/v1/deliberations/"+id, "sk-admin", nil, nil); w.Code != http.StatusOK {
+		t.Errorf("admin: status %d, want 200", w.Code)
+	}
+	if w := request(t, s, http.MethodPost, "/v1/deliberations/"+id+"/rerun", "sk-b", nil, map[string]any{}); w.Code != http.StatusNotFound {
+		t.Errorf("rerun of other key's deliberation: status %d, want 404", w.Code)
+	}
+	rerun := map[string]any{"phase": "review", "reviewers": []string{"bob"}}
+	if w := request(t, s, http.MethodPost, "/v1/deliberations/"+id+"/rerun", "sk-a", nil, rerun); w.Code != http.StatusForbidden {
+		t.Errorf("rerun with reviewers outside the key: status %d, want 403", w.Code)
+	}
+	if w := request(t, s, http.MethodPost, "/v1/deliberations/"+id+"/rerun", "sk-a", nil, map[string]any{}); w.Code != http.StatusOK {
+		t.Errorf("rerun of own deliberation: status %d, want 200: %s", w.Code, w.Body)
+	}
+
+	for key, want := range map[string]int{"sk-a": 2, "sk-b": 0, "sk-admin": 2} {
+		w := request(t, s, http.MethodGet, "/v1/deliberations", key, nil, nil)
+		var list struct {
+			Data []json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Data) != want {
+			t.Errorf("%s lists %d deliberations, want %d", key, len(list.Data), want)
+		}
+	}
+}
+
+func TestKeyUsage(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) {
+		cfg.Arena = &config.ArenaConfig{Path: filepath.Join(t.TempDir(), "arena.json")}
+		for _, name := range []string{"chat", "compare", "completions"} {
+			cfg.Auth.Keys = append(cfg.Auth.Keys, &config.APIKeyConfig{Key: "sk-" + name, Name: name, TokensPerDay: 1})
+		}
+	})
+
+	w := request(t, s, http.MethodPost, "/v1/chat/completions", "sk-b", nil, chatBody("alice"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	prompt, _ := strconv.ParseInt(w.Header().Get("X-Committee-Prompt-Tokens"), 10, 64)
+	completion, _ := strconv.ParseInt(w.Header().Get("X-Committee-Completion-Tokens"), 10, 64)
+	w = request(t, s, http.MethodGet, "/v1/usage", "sk-b", nil, nil)
+	var usage struct {
+		Data []*auth.Usage `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &usage); err != nil {
+		t.Fatal(err)
+	}
+	if len(usage.Data) != 1 || usage.Data[0].TotalTokens == 0 || usage.Data[0].TotalTokens != prompt+completion {
+		t.Errorf("usage %+v, want the %d tokens of the run", usage.Data, prompt+completion)
+	}
+
+	// The quota left caps the budget of every entry point. The summary made
+	// before planning is charged, so each entry point gets its own key.
+	if w := request(t, s, http.MethodPost, "/v1/chat/completions", "sk-chat", nil, chatBody("alice")); w.Code != http.StatusBadRequest {
+		t.Errorf("chat over quota: status %d, want 400", w.Code)
+	}
+	if w := request(t, s, http.MethodPost, "/v1/arena/compare", "sk-compare", nil, chatBody("")); w.Code != http.StatusBadRequest {
+		t.Errorf("compare over quota: status %d, want 400", w.Code)
+	}
+	completions := map[string]any{"model": "alice", "prompt": "2+2=", "n": 2}
+	if w := request(t, s, http.MethodPost, "/v1/completions", "sk-completions", nil, completions); w.Code != http.StatusBadRequest {
+		t.Errorf("completions over quota: status %d, want 400", w.Code)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) {
+		cfg.CORS = &config.CORSConfig{AllowOrigins: []string{"https://chat.example.com"}}
+	})
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, "/v1/messages", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		req.Header.Set("Access-Control-Request-Headers", "x-api-key,content-type")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	w := preflight("https://chat.example.com")
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://chat.example.com" {
+		t.Errorf("allowed origin: headers %v", w.Header())
+	}
+	if !strings.Contains(strings.ToLower(w.Header().Get("Access-Control-Allow-Headers")), "x-api-key") {
+		t.Errorf("x-api-key not allowed: %q", w.Header().Get("Access-Control-Allow-Headers"))
+	}
+	if w := preflight("https://evil.example.com"); w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("other origin allowed: status %d", w.Code)
+	}
+}
@@ -0,0 +1,82 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"super-llm/config"
+	"super-llm/domain/committee"
+	"super-llm/infra/fake"
+)
+
+// newTestHandler serves the chat endpoints with a committee of two members
+// backed by a fake backend. configure may adjust the configuration first.
+func newTestHandler(t *testing.T, fakeCfg *fake.Config, configure func(cfg *config.Config)) http.Handler {
+	t.Helper()
+	if fakeCfg == nil {
+		fakeCfg = &fake.Config{}
+	}
+	backend, err := fake.NewServer(fakeCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(backend.Handler())
+	t.Cleanup(server.Close)
+
+	cfg := &config.Config{
+		LLMs: []*config.LLMConfig{{BaseURL: server.URL + "/v1", Model: "fake-model", APIKey: "test"}},
+		Members: []*config.MemberConfig{
+			{Name: "alice", LLM: "fake-model"},
+			{Name: "bob", LLM: "fake-model"},
+		},
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+	domain, err := committee.BuildCommitteeDomain(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { domain.Close() })
+
+	gin.SetMode(gin.TestMode)
+	h := NewHandler(domain)
+	router := gin.New()
+	router.POST("/v1/chat/completions", h.ChatCompletions)
+	router.POST("/v1/completions", h.Completions)
+	router.POST("/v1/messages", h.Messages)
+	router.POST("/v1/responses", h.Responses)
+	router.POST("/api/chat", h.OllamaChat)
+	router.POST("/api/generate", h.OllamaGenerate)
+	router.GET("/api/tags", h.OllamaTags)
+	return router
+}
+
+// post sends a JSON request to the handler and returns the recorded response
+func post(t *testing.T, h http.Handler, path string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	return postWithHeaders(t, h, path, nil, body)
+}
+
+// postWithHeaders is post with extra request headers
+func postWithHeaders(t *testing.T, h http.Handler, path string, headers map[string]string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
@@ -0,0 +1,423 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"super-llm/domain/auth"
+	"super-llm/domain/committee"
+
+	"github.com/cv70/pkgo/llm"
+	"github.com/pkg/errors"
+)
+
+// maxCompletionRuns bounds the committee runs of one completions request,
+// one per prompt and choice
+const maxCompletionRuns = 8
+
+// completionsRequest is the body of a legacy /completions request
+type completionsRequest struct {
+	Model       string          `json:"model"`
+	Prompt      json.RawMessage `json:"prompt"`
+	Suffix      string          `json:"suffix"`
+	Echo        bool            `json:"echo"`
+	N           int             `json:"n"`
+	MaxTokens   *int32          `json:"max_tokens"`
+	Temperature *float32        `json:"temperature"`
+	TopP        *float32        `json:"top_p"`
+	Stop        json.RawMessage `json:"stop"`
+	Stream      bool            `json:"stream"`
+}
+
+// textCompletion is a legacy completion or streamed chunk
+type textCompletion struct {
+	ID      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []*textChoice  `json:"choices"`
+	Usage   *llm.ChatUsage `json:"usage,omitempty"`
+}
+
+// textChoice is a completion choice carrying the committee run behind it
+type textChoice struct {
+	Text         string               `json:"text"`
+	Index        int                  `json:"index"`
+	Logprobs     any                  `json:"logprobs"`
+	FinishReason *string              `json:"finish_reason"`
+	Committee    *committee.Extension `json:"committee,omitempty"`
+}
+
+// completionRun is the committee run behind one choice
+type completionRun struct {
+	prompt string
+	cc     *committee.CommitteeContext
+	err    error
+	// completion and readErr are the read answer of a blocking run
+	completion *llm.ChatCompletionResponse
+	readErr    error
+}
+
+// Completions handles the legacy /completions endpoint. Every prompt is
+// answered n times, each choice by a committee run of its own.
+func (h *Handler) Completions(c *gin.Context) {
+	var body completionsRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	prompts, err := stringOrList(body.Prompt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "prompt must be a string or an array of strings"})
+		return
+	}
+	stop, err := stringOrList(body.Stop)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "stop must be a string or an array of strings"})
+		return
+	}
+	if len(prompts) == 0 {
+		prompts = []string{""}
+	}
+	if body.N <= 0 {
+		body.N = 1
+	}
+	if len(prompts)*body.N > maxCompletionRuns {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d prompts times n are supported", maxCompletionRuns)})
+		return
+	}
+	opts, err := runOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// The runs share the request budget and what is left of the key's quota
+	opts.Budget = opts.Budget.Merge(committee.QuotaBudget(opts.Caller))
+
+	slog.Info(
+		"Received completions request",
+		slog.Any("members", c.GetHeader("X-Members")),
+		slog.Any("prompts", len(prompts)),
+		slog.Any("n", body.N),
+	)
+
+	// Choices are indexed prompt by prompt, n for each
+	runs := make([]*completionRun, 0, len(prompts)*body.N)
+	for _, prompt := range prompts {
+		for range body.N {
+			runs = append(runs, &completionRun{prompt: prompt})
+		}
+	}
+	// Every run's body is closed, whichever way the request ends
+	defer func() {
+		for _, run := range runs {
+			if run.cc != nil {
+				run.cc.Response.Body.Close()
+			}
+		}
+	}()
+	if body.Stream {
+		h.streamCompletions(c, &body, runs, stop, opts)
+		return
+	}
+
+	// A failed run gives up on the others
+	ctx, cancel := context.WithCancel(c)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i, run := range runs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run.cc, run.err = h.committee.RunCommitteeProcess(ctx, body.chatRequest(run.prompt, stop), body.runOptions(opts, i, len(runs)))
+			if run.err != nil {
+				cancel()
+				return
+			}
+			// Reading the answer right away frees the run's slots for the
+			// runs still waiting on them
+			run.completion, run.readErr = run.cc.ReadResponse()
+		}()
+	}
+	wg.Wait()
+	if run := failedRun(runs); run != nil {
+		completionsError(c, run.err)
+		return
+	}
+
+	setCommitteeHeaders(c, runs[0].cc)
+	resp := newTextCompletion(runs[0].cc)
+	for i, run := range runs {
+		if run.readErr != nil {
+			slog.Error("read final response", slog.Any("err", run.readErr))
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Invalid response from leader model"})
+			return
+		}
+		choice := &textChoice{Index: i}
+		finishReason := "stop"
+		if len(run.completion.Choices) > 0 && run.completion.Choices[0].Message != nil {
+			choice.Text, _ = run.completion.Choices[0].Message.Content.(string)
+			finishReason = legacyFinishReason(run.completion.Choices[0].FinishReason)
+		}
+		if body.Echo {
+			choice.Text = run.prompt + choice.Text
+		}
+		choice.FinishReason = &finishReason
+		choice.Committee = run.cc.Extension()
+		resp.Choices = append(resp.Choices, choice)
+	}
+	report := completionsUsage(runs)
+	resp.Usage = &llm.ChatUsage{
+		PromptTokens:     report.Total.PromptTokens,
+		CompletionTokens: report.Total.CompletionTokens,
+		TotalTokens:      report.Total.TotalTokens,
+	}
+	SetUsageHeaders(c.Writer.Header(), report)
+	c.JSON(http.StatusOK, resp)
+}
+
+// runOptions returns the options of the i-th of n runs
+func (r *completionsRequest) runOptions(opts *committee.RunOptions, i, n int) *committee.RunOptions {
+	runOpts := *opts
+	// The budget is the request's, shared among its runs
+	runOpts.Budget = opts.Budget.Split(n)
+	if i%r.N != 0 {
+		// Repeated choices must not be served from the cache
+		runOpts.Cache = committee.CacheSkip
+	}
+	return &runOpts
+}
+
+// failedRun returns the run whose failure ended the request, nil when all
+// succeeded
+func failedRun(runs []*completionRun) *completionRun {
+	var failed *completionRun
+	for _, run := range runs {
+		if run.err == nil {
+			continue
+		}
+		// Runs canceled after another failed do not tell why
+		if !errors.Is(run.err, context.Canceled) {
+			return run
+		}
+		if failed == nil {
+			failed = run
+		}
+	}
+	return failed
+}
+
+// completionsError answers a request whose run failed
+func completionsError(c *gin.Context, err error) {
+	if RetryAfter(c, err) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests, retry later"})
+		return
+	}
+	if errors.Is(err, auth.ErrForbidden) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API key may not use the requested model or members"})
+		return
+	}
+	if errors.Is(err, committee.ErrBudgetTooSmall) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Budget too small for a single opinion"})
+		return
+	}
+	if errors.Is(err, committee.ErrLeaderStatus) {
+		slog.Error("Failed to process completions", slog.Any("err", err))
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Invalid response from leader model"})
+		return
+	}
+	slog.Error("Failed to process completions", slog.Any("err", err))
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+}
+
+func newTextCompletion(cc *committee.CommitteeContext) *textCompletion {
+	return &textCompletion{
+		ID:      "cmpl-" + cc.ID,
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   cc.Model,
+		Choices: []*textChoice{},
+	}
+}
+
+// chatRequest asks the committee for the completion of one prompt
+func (r *completionsRequest) chatRequest(prompt string, stop []string) *llm.ChatCompletionRequest {
+	if r.Suffix != "" {
+		prompt = fillInMiddlePrompt(prompt, r.Suffix)
+	}
+	return &llm.ChatCompletionRequest{
+		Model:       r.Model,
+		Messages:    []*llm.ChatMessage{{Role: llm.RoleUser, Content: prompt}},
+		MaxTokens:   r.MaxTokens,
+		Temperature: r.Temperature,
+		TopP:        r.TopP,
+		Stop:        stop,
+		Stream:      r.Stream,
+	}
+}
+
+// streamCompletions relays the leaders' streams as legacy chunks, each
+// under its own choice index. Every run streams as soon as it is ready, so
+// that it gives its slots back to the runs still waiting on them; the
+// response is committed with the first ready run. A run failing before that
+// fails the request, one failing later ends its choice with an error chunk.
+func (h *Handler) streamCompletions(c *gin.Context, body *completionsRequest, runs []*completionRun, stop []string, opts *committee.RunOptions) {
+	ctx, cancel := context.WithCancel(c)
+	defer cancel()
+	// started is closed once the response is committed, aborted when the
+	// request failed before that
+	started, aborted := make(chan struct{}), make(chan struct{})
+	ready := make(chan *completionRun, len(runs))
+
+	var resp *textCompletion
+	var mu sync.Mutex
+	write := func(chunk any) {
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			slog.Error("encode completions chunk", slog.Any("err", err))
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(c.Writer, "data: %s\n\n", data)
+		c.Writer.Flush()
+	}
+	writeChoice := func(choice *textChoice, usage *llm.ChatUsage) {
+		chunk := *resp
+		chunk.Choices = []*textChoice{choice}
+		chunk.Usage = usage
+		write(&chunk)
+	}
+
+	var wg sync.WaitGroup
+	for i, run := range runs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run.cc, run.err = h.committee.RunCommitteeProcess(ctx, body.chatRequest(run.prompt, stop), body.runOptions(opts, i, len(runs)))
+			ready <- run
+			select {
+			case <-started:
+			case <-aborted:
+				return
+			}
+			if run.err != nil {
+				slog.Error("Failed to process completions", slog.Any("err", run.err))
+				write(gin.H{"error": gin.H{"message": fmt.Sprintf("Choice %d failed", i), "type": "server_error"}})
+				return
+			}
+			defer run.cc.Response.Body.Close()
+			if body.Echo && run.prompt != "" {
+				writeChoice(&textChoice{Text: run.prompt, Index: i}, nil)
+			}
+			finishReason := ""
+			err := committee.ReadChunks(run.cc.Response.Body, func(chunk *llm.ChatCompletionResponse) error {
+				if chunk.Usage != nil {
+					run.cc.Usage.RecordChat(committee.PhaseFinal, run.cc.Leader, chunk.Usage)
+				}
+				for _, choice := range chunk.Choices {
+					if choice.Index != 0 {
+						continue
+					}
+					if choice.FinishReason != "" {
+						finishReason = choice.FinishReason
+					}
+					if choice.Delta == nil {
+						continue
+					}
+					if text, _ := choice.Delta.Content.(string); text != "" {
+						writeChoice(&textChoice{Text: text, Index: i}, nil)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				slog.Error("read final stream", slog.Any("err", err))
+				write(gin.H{"error": gin.H{"message": fmt.Sprintf("Choice %d was cut off", i), "type": "server_error"}})
+				return
+			}
+			reason := legacyFinishReason(finishReason)
+			writeChoice(&textChoice{Index: i, FinishReason: &reason, Committee: run.cc.Extension()}, nil)
+		}()
+	}
+
+	first := <-ready
+	if first.err != nil {
+		cancel()
+		close(aborted)
+		wg.Wait()
+		completionsError(c, first.err)
+		return
+	}
+	setCommitteeHeaders(c, first.cc)
+	resp = newTextCompletion(first.cc)
+	header := c.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("Trailer", strings.Join(usageHeaders, ", "))
+	c.Status(http.StatusOK)
+	close(started)
+	wg.Wait()
+
+	report := completionsUsage(runs)
+	chunk := *resp
+	chunk.Choices = []*textChoice{}
+	chunk.Usage = &llm.ChatUsage{
+		PromptTokens:     report.Total.PromptTokens,
+		CompletionTokens: report.Total.CompletionTokens,
+		TotalTokens:      report.Total.TotalTokens,
+	}
+	write(&chunk)
+	fmt.Fprint(c.Writer, "data: [DONE]\n\n")
+	c.Writer.Flush()
+	SetUsageHeaders(header, report)
+}
+
+// completionsUsage sums the usage of the runs of a request that got under
+// way
+func completionsUsage(runs []*completionRun) *committee.UsageReport {
+	var report *committee.UsageReport
+	for _, run := range runs {
+		if run.cc == nil {
+			continue
+		}
+		if report == nil {
+			report = run.cc.Usage.Report()
+			continue
+		}
+		report.Add(run.cc.Usage.Report())
+	}
+	return report
+}
+
+// stringOrList decodes a field given as a string or an array of strings
+func stringOrList(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return []string{text}, nil
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, errors.Wrap(err, "decode string list")
+	}
+	return list, nil
+}
+
+func legacyFinishReason(finishReason string) string {
+	if finishReason == "length" {
+		return "length"
+	}
+	return "stop"
+}
@@ -0,0 +1,130 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"super-llm/config"
+	"super-llm/infra/fake"
+
+	"github.com/pkg/errors"
+)
+
+// TestCompletionsSingleSlot answers two choices through one committee slot
+// and one backend slot; runs must give their slots back as they finish
+func TestCompletionsSingleSlot(t *testing.T) {
+	h := newTestHandler(t, nil, func(cfg *config.Config) {
+		cfg.Limits = &config.LimitConfig{MaxConcurrent: 1}
+		cfg.LLMs[0].Limits = &config.LimitConfig{MaxConcurrent: 1}
+	})
+
+	for _, stream := range []bool{false, true} {
+		done := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			done <- post(t, h, "/v1/completions", map[string]any{"model": "alice", "prompt": "天空为什么是蓝色的？", "n": 2, "stream": stream})
+		}()
+		var w *httptest.ResponseRecorder
+		select {
+		case w = <-done:
+		case <-time.After(20 * time.Second):
+			t.Fatalf("stream=%v: request hangs on its own slots", stream)
+		}
+		if w.Code != http.StatusOK {
+			t.Fatalf("stream=%v: status %d: %s", stream, w.Code, w.Body)
+		}
+		if stream {
+			for i := range 2 {
+				if !strings.Contains(w.Body.String(), fmt.Sprintf(`"index":%d,"logprobs":null,"finish_reason":"stop"`, i)) {
+					t.Errorf("choice %d not finished: %s", i, w.Body)
+				}
+			}
+			if !strings.HasSuffix(w.Body.String(), "data: [DONE]\n\n") {
+				t.Errorf("stream not done: %s", w.Body)
+			}
+			continue
+		}
+		var resp textCompletion
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Choices) != 2 {
+			t.Fatalf("%d choices", len(resp.Choices))
+		}
+	}
+}
+
+// TestCompletionsBusy turns the second run away when the committee queue is
+// full and expects a 429 carrying Retry-After
+func TestCompletionsBusy(t *testing.T) {
+	h := newTestHandler(t, &fake.Config{Latency: 50 * time.Millisecond}, func(cfg *config.Config) {
+		cfg.Limits = &config.LimitConfig{MaxConcurrent: 1, MaxWait: time.Millisecond}
+	})
+	w := post(t, h, "/v1/completions", map[string]any{"model": "alice", "prompt": []string{"一", "二", "三"}, "n": 2})
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Errorf("no Retry-After")
+	}
+}
+
+// TestCompletions answers every prompt n times, choices in prompt order
+func TestCompletions(t *testing.T) {
+	h := newTestHandler(t, &fake.Config{Rules: []*fake.Rule{finalRule}}, nil)
+	w := post(t, h, "/v1/completions", map[string]any{"model": "alice", "prompt": []string{"一", "二"}, "n": 2, "echo": true, "stop": "。"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var resp textCompletion
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Object != "text_completion" || !strings.HasPrefix(resp.ID, "cmpl-") || resp.Usage == nil || resp.Usage.TotalTokens == 0 {
+		t.Errorf("completion %+v", resp)
+	}
+	want := []string{"一最终回答：4", "一最终回答：4", "二最终回答：4", "二最终回答：4"}
+	if len(resp.Choices) != len(want) {
+		t.Fatalf("%d choices, want %d", len(resp.Choices), len(want))
+	}
+	for i, choice := range resp.Choices {
+		if choice.Index != i || choice.Text != want[i] || *choice.FinishReason != "stop" || choice.Committee == nil {
+			t.Errorf("choice %d: %+v", i, choice)
+		}
+	}
+
+	for _, body := range []map[string]any{
+		{"model": "alice", "prompt": 3},
+		{"model": "alice", "prompt": "一", "stop": []int{1}},
+		{"model": "alice", "prompt": "一", "n": maxCompletionRuns + 1},
+	} {
+		if w := post(t, h, "/v1/completions", body); w.Code != http.StatusBadRequest {
+			t.Errorf("%v: status %d, want 400", body, w.Code)
+		}
+	}
+}
+
+// TestFailedRun reports the run that failed, not the ones canceled after it
+func TestFailedRun(t *testing.T) {
+	failure := errors.New("backend down")
+	runs := []*completionRun{
+		{},
+		{err: context.Canceled},
+		{err: failure},
+		{err: context.Canceled},
+	}
+	if run := failedRun(runs); run == nil || run.err != failure {
+		t.Errorf("failed run %+v, want the backend failure", run)
+	}
+	if run := failedRun(runs[:2]); run == nil || run.err != context.Canceled {
+		t.Errorf("failed run %+v, want the canceled run", run)
+	}
+	if run := failedRun(runs[:1]); run != nil {
+		t.Errorf("failed run %+v, want none", run)
+	}
+}
@@ -1,16 +1,18 @@
 package chat
 
 import (
-	"io"
 	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 
+	"super-llm/domain/auth"
 	"super-llm/domain/committee"
 
 	"github.com/cv70/pkgo/llm"
+	"github.com/pkg/errors"
 )
 
 // Handler holds dependencies for the chat handler
@@ -34,60 +36,82 @@ func (h *Handler) ChatCompletions(c *gin.Context) {
 		return
 	}
 
-	// Parse headers
-	membersHeader := c.GetHeader("X-Members")
-	viewsHeader := c.GetHeader("X-Views")
-
-	// Process models from header
-	members := parseModels(membersHeader)
-
-	// Process stage from header
-	// opinion, review
-	var opinion, review bool
-	if viewsHeader != "" {
-		opinion, review = parseViews(viewsHeader)
+	opts, err := runOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
 	// Log the request
 	slog.Info(
 		"Received chat completions request",
-		slog.Any("members", membersHeader),
-		slog.Any("views", viewsHeader),
+		slog.Any("members", c.GetHeader("X-Members")),
+		slog.Any("views", c.GetHeader("X-Views")),
 		slog.Any("messages_count", len(req.Messages)),
 	)
 
 	// Process the request using committee and LLM service
-	response, err := h.processRequest(c, &req, members, opinion, review)
+	result, err := h.processRequest(c, &req, opts)
+	if RetryAfter(c, err) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests, retry later"})
+		return
+	}
+	if errors.Is(err, auth.ErrForbidden) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API key may not use the requested model or members"})
+		return
+	}
+	if errors.Is(err, committee.ErrBudgetTooSmall) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Budget too small for a single opinion"})
+		return
+	}
+	if errors.Is(err, committee.ErrLeaderStatus) {
+		slog.Error("Failed to process chat completions", slog.Any("err", err))
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Invalid response from leader model"})
+		return
+	}
 	if err != nil {
 		slog.Error("Failed to process chat completions", slog.Any("err", err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 		return
 	}
-	defer response.Body.Close()
 
 	// Return response
-	if req.Stream {
-		c.Writer.Header().Set("Content-Type", "text/event-stream")
-		c.Writer.Header().Set("Cache-Control", "no-cache")
-		c.Writer.Header().Set("Connection", "keep-alive")
-		c.Writer.Header().Set("Transfer-Encoding", "chunked")
-	} else {
-		c.Writer.Header().Set("Content-Type", "application/json")
-	}
-	_, err = io.Copy(c.Writer, response.Body)
-	if err != nil {
-		slog.Error("copy response", slog.Any("err", err))
-	}
+	writeResponse(c, result)
 }
 
 // processRequest processes the chat completion request
-func (h *Handler) processRequest(c *gin.Context, req *llm.ChatCompletionRequest, members []string, opinion, review bool) (*http.Response, error) {
+func (h *Handler) processRequest(c *gin.Context, req *llm.ChatCompletionRequest, opts *committee.RunOptions) (*committee.CommitteeContext, error) {
 	// For simplicity, we'll use the RunCommitteeProcess method directly
 	// Since our interface requires a single question, we'll just use the first user message
-	result, err := h.committee.RunCommitteeProcess(c, req, members, opinion, review)
+	result, err := h.committee.RunCommitteeProcess(c, req, opts)
 	return result, err
 }
 
+// runOptions reads the committee options of a request from its headers
+func runOptions(c *gin.Context) (*committee.RunOptions, error) {
+	opts := &committee.RunOptions{
+		Members:  parseModels(c.GetHeader("X-Members")),
+		Strategy: strings.ToLower(strings.TrimSpace(c.GetHeader("X-Strategy"))),
+		Topics:   parseModels(c.GetHeader("X-Topic")),
+		Cache:    parseCacheControl(c.GetHeader("Cache-Control")),
+		Caller:   auth.FromContext(c.Request.Context()),
+	}
+
+	// Process stage from header
+	// opinion, review
+	if viewsHeader := c.GetHeader("X-Views"); viewsHeader != "" {
+		opts.Opinion, opts.Review = parseViews(viewsHeader)
+	}
+
+	// Process budget from headers
+	budget, err := BudgetHeaders(c)
+	if err != nil {
+		return nil, err
+	}
+	opts.Budget = budget
+	return opts, nil
+}
+
 // parseModels parses comma-separated model names from header
 func parseModels(header string) []string {
 	// Simple split by comma, trim spaces
@@ -116,3 +140,43 @@ func parseViews(header string) (bool, bool) {
 	}
 	return opinion, review
 }
+
+// parseCacheControl maps the Cache-Control request header to a cache mode
+func parseCacheControl(header string) string {
+	mode := committee.CacheDefault
+	for _, directive := range strings.Split(header, ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "no-store":
+			return committee.CacheSkip
+		case "no-cache":
+			mode = committee.CacheRefresh
+		}
+	}
+	return mode
+}
+
+// BudgetHeaders reads the budget of a request from its X-Budget-Tokens and
+// X-Budget-Cost headers
+func BudgetHeaders(c *gin.Context) (*committee.Budget, error) {
+	return parseBudget(c.GetHeader("X-Budget-Tokens"), c.GetHeader("X-Budget-Cost"))
+}
+
+// parseBudget parses the token and cost budget headers
+func parseBudget(tokensHeader, costHeader string) (*committee.Budget, error) {
+	budget := &committee.Budget{}
+	if tokensHeader != "" {
+		tokens, err := strconv.ParseInt(strings.TrimSpace(tokensHeader), 10, 32)
+		if err != nil || tokens < 0 {
+			return nil, errors.New("invalid X-Budget-Tokens header")
+		}
+		budget.MaxTokens = int32(tokens)
+	}
+	if costHeader != "" {
+		cost, err := strconv.ParseFloat(strings.TrimSpace(costHeader), 64)
+		if err != nil || cost < 0 {
+			return nil, errors.New("invalid X-Budget-Cost header")
+		}
+		budget.MaxCost = cost
+	}
+	return budget, nil
+}
@@ -0,0 +1,122 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"super-llm/config"
+	"super-llm/infra/fake"
+
+	"github.com/cv70/pkgo/llm"
+)
+
+// TestChatCompletionsBusyMember turns a member's opinion away at its backend
+// limit and expects the run to fail with a 429 carrying Retry-After
+func TestChatCompletionsBusyMember(t *testing.T) {
+	h := newTestHandler(t, &fake.Config{Latency: 100 * time.Millisecond}, func(cfg *config.Config) {
+		cfg.LLMs[0].Limits = &config.LimitConfig{MaxConcurrent: 1, MaxWait: time.Millisecond}
+	})
+	w := post(t, h, "/v1/chat/completions", map[string]any{
+		"model":    "alice",
+		"messages": []map[string]string{{"role": "user", "content": "天空为什么是蓝色的？"}},
+	})
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Errorf("no Retry-After")
+	}
+}
+
+// TestOpinionChoicesCacheHit expects a cached answer to carry the opinions
+// of the run that produced it
+func TestOpinionChoicesCacheHit(t *testing.T) {
+	h := newTestHandler(t, nil, func(cfg *config.Config) {
+		cfg.Cache = &config.CacheConfig{TTL: time.Minute}
+	})
+	body := map[string]any{
+		"model":    "alice",
+		"messages": []map[string]string{{"role": "user", "content": "天空为什么是蓝色的？"}},
+	}
+	for _, status := range []string{"MISS", "HIT"} {
+		w := postWithHeaders(t, h, "/v1/chat/completions", map[string]string{headerOpinionChoices: "named"}, body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		if got := w.Header().Get(headerCache); got != status {
+			t.Fatalf("cache status %s, want %s", got, status)
+		}
+		var resp llm.ChatCompletionResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Choices) != 3 {
+			t.Errorf("%s: %d choices, want the answer and two opinions", status, len(resp.Choices))
+		}
+	}
+}
+
+// TestChatCompletionEndToEnd drives a chat completion through every phase
+// against the fake backend and expects the synthesized answer
+func TestChatCompletionEndToEnd(t *testing.T) {
+	h := newTestHandler(t, &fake.Config{Rules: []*fake.Rule{
+		{Match: "生成最终回答", Reply: "最终回答：4"},
+		{Match: "2\\+2", Reply: "{{.Model}} 认为是 4"},
+	}}, nil)
+	w := postWithHeaders(t, h, "/v1/chat/completions", map[string]string{headerOpinionChoices: "named"}, map[string]any{
+		"model":    "alice",
+		"messages": []map[string]string{{"role": "user", "content": "2+2 等于几？"}},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var resp llm.ChatCompletionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Choices) != 3 {
+		t.Fatalf("%d choices, want the answer and two opinions", len(resp.Choices))
+	}
+	if got, _ := resp.Choices[0].Message.Content.(string); got != "最终回答：4" {
+		t.Errorf("answer %q", got)
+	}
+	for _, choice := range resp.Choices[1:] {
+		if got, _ := choice.Message.Content.(string); got == "" {
+			t.Errorf("choice %d: empty opinion", choice.Index)
+		}
+	}
+	if w.Header().Get(headerPromptTokens) == "" || w.Header().Get(headerPromptTokens) == "0" {
+		t.Errorf("no committee usage: %v", w.Header())
+	}
+}
+
+// TestLeaderErrorStatus answers every endpoint with a 502 when the leader
+// fails the final phase, giving the committee slot back each time
+func TestLeaderErrorStatus(t *testing.T) {
+	h := newTestHandler(t, &fake.Config{Rules: []*fake.Rule{
+		{Match: "请基于以下信息生成最终回答", Status: http.StatusInternalServerError},
+	}}, func(cfg *config.Config) {
+		cfg.Limits = &config.LimitConfig{MaxConcurrent: 1, MaxWait: 10 * time.Millisecond}
+	})
+	messages := []map[string]string{{"role": "user", "content": "2+2 等于几？"}}
+	for _, endpoint := range []struct {
+		path string
+		body map[string]any
+	}{
+		{"/v1/chat/completions", map[string]any{"model": "alice", "messages": messages}},
+		{"/v1/messages", map[string]any{"model": "alice", "max_tokens": 1024, "messages": messages}},
+		{"/v1/responses", map[string]any{"model": "alice", "input": "2+2 等于几？"}},
+		{"/api/chat", map[string]any{"model": "alice", "messages": messages}},
+		{"/api/generate", map[string]any{"model": "alice", "prompt": "2+2 等于几？"}},
+		{"/v1/completions", map[string]any{"model": "alice", "prompt": "2+2=", "n": 2}},
+	} {
+		for _, stream := range []bool{false, true} {
+			endpoint.body["stream"] = stream
+			if w := post(t, h, endpoint.path, endpoint.body); w.Code != http.StatusBadGateway {
+				t.Errorf("%s stream=%v: status %d, want 502: %s", endpoint.path, stream, w.Code, w.Body)
+			}
+		}
+	}
+}
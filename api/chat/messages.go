@@ -0,0 +1,375 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"super-llm/domain/auth"
+	"super-llm/domain/committee"
+
+	"github.com/cv70/pkgo/llm"
+	"github.com/pkg/errors"
+)
+
+// messagesRequest is the body of an Anthropic Messages API request
+type messagesRequest struct {
+	Model         string             `json:"model"`
+	System        json.RawMessage    `json:"system"`
+	Messages      []*messagesMessage `json:"messages"`
+	MaxTokens     *int32             `json:"max_tokens"`
+	Temperature   *float32           `json:"temperature"`
+	TopP          *float32           `json:"top_p"`
+	StopSequences []string           `json:"stop_sequences"`
+	Stream        bool               `json:"stream"`
+	Tools         []*messagesTool    `json:"tools"`
+}
+
+type messagesMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+// contentBlock is a content block of a message, request or response
+type contentBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   json.RawMessage `json:"content,omitempty"`
+}
+
+type messagesTool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	InputSchema map[string]any `json:"input_schema"`
+}
+
+// messagesResponse is an Anthropic message carrying the committee extension
+type messagesResponse struct {
+	ID           string               `json:"id"`
+	Type         string               `json:"type"`
+	Role         string               `json:"role"`
+	Model        string               `json:"model"`
+	Content      []*contentBlock      `json:"content"`
+	StopReason   *string              `json:"stop_reason"`
+	StopSequence *string              `json:"stop_sequence"`
+	Usage        *messagesUsage       `json:"usage"`
+	Committee    *committee.Extension `json:"committee,omitempty"`
+}
+
+type messagesUsage struct {
+	InputTokens  int32 `json:"input_tokens"`
+	OutputTokens int32 `json:"output_tokens"`
+}
+
+// Messages handles the Anthropic compatible /messages endpoint
+func (h *Handler) Messages(c *gin.Context) {
+	var body messagesRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		messagesError(c, http.StatusBadRequest, "invalid_request_error", "Invalid request body")
+		return
+	}
+	req, err := body.chatRequest()
+	if err != nil {
+		messagesError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	opts, err := runOptions(c)
+	if err != nil {
+		messagesError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	slog.Info(
+		"Received messages request",
+		slog.Any("members", c.GetHeader("X-Members")),
+		slog.Any("messages_count", len(req.Messages)),
+	)
+
+	result, err := h.committee.RunCommitteeProcess(c, req, opts)
+	if RetryAfter(c, err) {
+		messagesError(c, http.StatusTooManyRequests, "rate_limit_error", "Too many requests, retry later")
+		return
+	}
+	if errors.Is(err, auth.ErrForbidden) {
+		messagesError(c, http.StatusForbidden, "permission_error", "API key may not use the requested model or members")
+		return
+	}
+	if errors.Is(err, committee.ErrBudgetTooSmall) {
+		messagesError(c, http.StatusBadRequest, "invalid_request_error", "Budget too small for a single opinion")
+		return
+	}
+	if errors.Is(err, committee.ErrLeaderStatus) {
+		slog.Error("Failed to process messages", slog.Any("err", err))
+		messagesError(c, http.StatusBadGateway, "api_error", "Invalid response from leader model")
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to process messages", slog.Any("err", err))
+		messagesError(c, http.StatusInternalServerError, "api_error", "Internal server error")
+		return
+	}
+	setCommitteeHeaders(c, result)
+	if req.Stream {
+		writeMessagesStream(c, result)
+		return
+	}
+
+	completion, err := result.ReadResponse()
+	if err != nil {
+		slog.Error("read final response", slog.Any("err", err))
+		messagesError(c, http.StatusBadGateway, "api_error", "Invalid response from leader model")
+		return
+	}
+	resp := &messagesResponse{
+		ID:        messageID(completion.ID),
+		Type:      "message",
+		Role:      "assistant",
+		Model:     body.Model,
+		Content:   []*contentBlock{},
+		Committee: result.Extension(),
+	}
+	if len(completion.Choices) > 0 && completion.Choices[0].Message != nil {
+		choice := completion.Choices[0]
+		if text, _ := choice.Message.Content.(string); text != "" {
+			resp.Content = append(resp.Content, &contentBlock{Type: "text", Text: text})
+		}
+		for _, call := range choice.Message.ToolCalls {
+			resp.Content = append(resp.Content, &contentBlock{Type: "tool_use", ID: call.ID, Name: call.Function.Name, Input: toolInput(call.Function.Arguments)})
+		}
+		reason := stopReason(choice.FinishReason)
+		resp.StopReason = &reason
+	}
+	resp.Usage = committeeMessagesUsage(result)
+	SetUsageHeaders(c.Writer.Header(), resp.Committee.Usage)
+	c.JSON(http.StatusOK, resp)
+}
+
+// chatRequest translates the request into the committee's chat format
+func (r *messagesRequest) chatRequest() (*llm.ChatCompletionRequest, error) {
+	req := &llm.ChatCompletionRequest{
+		Model:       r.Model,
+		MaxTokens:   r.MaxTokens,
+		Temperature: r.Temperature,
+		TopP:        r.TopP,
+		Stop:        r.StopSequences,
+		Stream:      r.Stream,
+	}
+	if len(r.System) > 0 {
+		system, err := blocksText(r.System)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid system")
+		}
+		if system != "" {
+			req.Messages = append(req.Messages, &llm.ChatMessage{Role: llm.RoleSystem, Content: system})
+		}
+	}
+	for _, message := range r.Messages {
+		blocks, err := contentBlocks(message.Content)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid message content")
+		}
+		converted := &llm.ChatMessage{Role: message.Role}
+		var text []string
+		for _, block := range blocks {
+			switch block.Type {
+			case "text":
+				text = append(text, block.Text)
+			case "tool_use":
+				converted.ToolCalls = append(converted.ToolCalls, llm.ChatToolCall{
+					ID:       block.ID,
+					Type:     "function",
+					Function: llm.ChatFunctionCall{Name: block.Name, Arguments: string(block.Input)},
+				})
+			case "tool_result":
+				result, err := blocksText(block.Content)
+				if err != nil {
+					return nil, errors.Wrap(err, "invalid tool result")
+				}
+				req.Messages = append(req.Messages, &llm.ChatMessage{Role: "tool", ToolCallID: block.ToolUseID, Content: result})
+			}
+		}
+		if len(text) == 0 && len(converted.ToolCalls) == 0 {
+			continue
+		}
+		converted.Content = strings.Join(text, "\n")
+		req.Messages = append(req.Messages, converted)
+	}
+	for _, tool := range r.Tools {
+		req.Tools = append(req.Tools, &llm.ChatTool{
+			Type:     "function",
+			Function: llm.ChatFunction{Name: tool.Name, Description: tool.Description, Parameters: tool.InputSchema},
+		})
+	}
+	return req, nil
+}
+
+// contentBlocks decodes content given as a string or as content blocks
+func contentBlocks(raw json.RawMessage) ([]*contentBlock, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return []*contentBlock{{Type: "text", Text: text}}, nil
+	}
+	var blocks []*contentBlock
+	err := json.Unmarshal(raw, &blocks)
+	return blocks, err
+}
+
+// blocksText joins the text of content given as a string or blocks
+func blocksText(raw json.RawMessage) (string, error) {
+	blocks, err := contentBlocks(raw)
+	if err != nil {
+		return "", err
+	}
+	var text []string
+	for _, block := range blocks {
+		if block.Type == "text" {
+			text = append(text, block.Text)
+		}
+	}
+	return strings.Join(text, "\n"), nil
+}
+
+// writeMessagesStream relays the leader's stream as Anthropic events
+func writeMessagesStream(c *gin.Context, cc *committee.CommitteeContext) {
+	defer cc.Response.Body.Close()
+	header := c.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("Trailer", strings.Join(usageHeaders, ", "))
+	c.Status(http.StatusOK)
+
+	event := func(name string, data any) {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			slog.Error("encode messages event", slog.Any("err", err))
+			return
+		}
+		fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", name, payload)
+		c.Writer.Flush()
+	}
+
+	id := messageID("")
+	event("message_start", gin.H{"type": "message_start", "message": &messagesResponse{
+		ID:      id,
+		Type:    "message",
+		Role:    "assistant",
+		Model:   cc.Model,
+		Content: []*contentBlock{},
+		Usage:   committeeMessagesUsage(cc),
+	}})
+
+	// Text goes to one block, each tool call to a block of its own
+	index, open := -1, ""
+	tools := map[int]int{}
+	start := func(kind string, block any) {
+		if open != "" {
+			event("content_block_stop", gin.H{"type": "content_block_stop", "index": index})
+		}
+		index++
+		open = kind
+		event("content_block_start", gin.H{"type": "content_block_start", "index": index, "content_block": block})
+	}
+	finishReason := ""
+	err := committee.ReadChunks(cc.Response.Body, func(chunk *llm.ChatCompletionResponse) error {
+		if chunk.Usage != nil {
+			cc.Usage.RecordChat(committee.PhaseFinal, cc.Leader, chunk.Usage)
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Index != 0 {
+				continue
+			}
+			if choice.FinishReason != "" {
+				finishReason = choice.FinishReason
+			}
+			if choice.Delta == nil {
+				continue
+			}
+			if text, _ := choice.Delta.Content.(string); text != "" {
+				if open != "text" {
+					start("text", gin.H{"type": "text", "text": ""})
+				}
+				event("content_block_delta", gin.H{"type": "content_block_delta", "index": index, "delta": gin.H{"type": "text_delta", "text": text}})
+			}
+			for i, call := range choice.Delta.ToolCalls {
+				position := i
+				if call.Index != nil {
+					position = *call.Index
+				}
+				if _, ok := tools[position]; !ok {
+					start("tool_use", &contentBlock{Type: "tool_use", ID: call.ID, Name: call.Function.Name, Input: json.RawMessage("{}")})
+					tools[position] = index
+				}
+				if call.Function.Arguments != "" {
+					event("content_block_delta", gin.H{"type": "content_block_delta", "index": tools[position], "delta": gin.H{"type": "input_json_delta", "partial_json": call.Function.Arguments}})
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("read final stream", slog.Any("err", err))
+		event("error", gin.H{"type": "error", "error": gin.H{"type": "api_error", "message": "Leader stream interrupted"}})
+		return
+	}
+	if open != "" {
+		event("content_block_stop", gin.H{"type": "content_block_stop", "index": index})
+	}
+	event("message_delta", gin.H{
+		"type":      "message_delta",
+		"delta":     gin.H{"stop_reason": stopReason(finishReason), "stop_sequence": nil},
+		"usage":     committeeMessagesUsage(cc),
+		"committee": cc.Extension(),
+	})
+	event("message_stop", gin.H{"type": "message_stop"})
+
+	SetUsageHeaders(header, cc.Usage.Report())
+}
+
+// committeeMessagesUsage reports the committee totals as Anthropic usage
+func committeeMessagesUsage(cc *committee.CommitteeContext) *messagesUsage {
+	usage := cc.Usage.ChatUsage()
+	return &messagesUsage{InputTokens: usage.PromptTokens, OutputTokens: usage.CompletionTokens}
+}
+
+func messagesError(c *gin.Context, status int, kind, message string) {
+	c.JSON(status, gin.H{"type": "error", "error": gin.H{"type": kind, "message": message}})
+}
+
+func messageID(id string) string {
+	if id == "" {
+		id = uuid.NewString()
+	}
+	return "msg_" + strings.TrimPrefix(id, "chatcmpl-")
+}
+
+// toolInput returns tool call arguments as a JSON object
+func toolInput(arguments string) json.RawMessage {
+	if !json.Valid([]byte(arguments)) {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(arguments)
+}
+
+func stopReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "max_tokens"
+	case "tool_calls":
+		return "tool_use"
+	default:
+		return "end_turn"
+	}
+}
@@ -0,0 +1,129 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"super-llm/infra/fake"
+
+	"github.com/cv70/pkgo/llm"
+)
+
+// finalRule answers the leader's synthesis prompt with a fixed answer
+var finalRule = &fake.Rule{Match: "生成最终回答", Reply: "最终回答：4"}
+
+func TestMessagesChatRequest(t *testing.T) {
+	var body messagesRequest
+	err := json.Unmarshal([]byte(`{
+		"model": "alice",
+		"system": [{"type": "text", "text": "be brief"}, {"type": "text", "text": "answer in French"}],
+		"max_tokens": 64,
+		"messages": [
+			{"role": "user", "content": "weather in Paris?"},
+			{"role": "assistant", "content": [
+				{"type": "text", "text": "Let me check."},
+				{"type": "tool_use", "id": "tu_1", "name": "weather", "input": {"city": "Paris"}}
+			]},
+			{"role": "user", "content": [{"type": "tool_result", "tool_use_id": "tu_1", "content": [{"type": "text", "text": "clear"}]}]}
+		],
+		"tools": [{"name": "weather", "input_schema": {"type": "object"}}]
+	}`), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := body.chatRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roles := []string{}
+	for _, message := range req.Messages {
+		roles = append(roles, message.Role)
+	}
+	if !slices.Equal(roles, []string{llm.RoleSystem, llm.RoleUser, llm.RoleAssistant, "tool"}) {
+		t.Fatalf("roles %v", roles)
+	}
+	if req.Messages[0].Content != "be brief\nanswer in French" {
+		t.Errorf("system %q", req.Messages[0].Content)
+	}
+	assistant := req.Messages[2]
+	if assistant.Content != "Let me check." || len(assistant.ToolCalls) != 1 || assistant.ToolCalls[0].Function.Arguments != `{"city": "Paris"}` {
+		t.Errorf("assistant %+v", assistant)
+	}
+	if tool := req.Messages[3]; tool.ToolCallID != "tu_1" || tool.Content != "clear" {
+		t.Errorf("tool result %+v", tool)
+	}
+	if *req.MaxTokens != 64 || len(req.Tools) != 1 || req.Tools[0].Function.Name != "weather" {
+		t.Errorf("max tokens %d tools %+v", *req.MaxTokens, req.Tools)
+	}
+}
+
+func TestMessages(t *testing.T) {
+	h := newTestHandler(t, &fake.Config{Rules: []*fake.Rule{finalRule}}, nil)
+	body := map[string]any{
+		"model":      "alice",
+		"system":     "be brief",
+		"max_tokens": 1024,
+		"messages":   []map[string]any{{"role": "user", "content": "2+2 等于几？"}},
+	}
+
+	w := post(t, h, "/v1/messages", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var resp messagesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Type != "message" || !strings.HasPrefix(resp.ID, "msg_") || resp.Model != "alice" {
+		t.Errorf("message %+v", resp)
+	}
+	if len(resp.Content) != 1 || resp.Content[0].Text != "最终回答：4" || *resp.StopReason != "end_turn" {
+		t.Errorf("content %+v stop %v", resp.Content, resp.StopReason)
+	}
+	if resp.Usage.InputTokens == 0 || resp.Usage.OutputTokens == 0 || resp.Committee == nil {
+		t.Errorf("usage %+v committee %v", resp.Usage, resp.Committee)
+	}
+
+	body["stream"] = true
+	w = post(t, h, "/v1/messages", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("stream: status %d: %s", w.Code, w.Body)
+	}
+	var events []string
+	var text strings.Builder
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			events = append(events, name)
+			continue
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var event struct {
+			Delta struct {
+				Text string `json:"text"`
+			} `json:"delta"`
+		}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("decode %s: %v", data, err)
+		}
+		text.WriteString(event.Delta.Text)
+	}
+	events = slices.Compact(events)
+	want := []string{"message_start", "content_block_start", "content_block_delta", "content_block_stop", "message_delta", "message_stop"}
+	if !slices.Equal(events, want) {
+		t.Errorf("events %v, want %v", events, want)
+	}
+	if text.String() != "最终回答：4" {
+		t.Errorf("streamed %q", text.String())
+	}
+
+	if w := post(t, h, "/v1/messages", map[string]any{"model": "alice", "system": 3, "messages": []any{}}); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_request_error") {
+		t.Errorf("invalid system: status %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,320 @@
+package chat
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"super-llm/domain/auth"
+	"super-llm/domain/committee"
+
+	"github.com/cv70/pkgo/llm"
+	"github.com/pkg/errors"
+)
+
+// ollamaVersion is reported to clients probing /api/version
+const ollamaVersion = "0.6.0"
+
+// ollamaOptions are the model options of an Ollama request the committee
+// understands
+type ollamaOptions struct {
+	Temperature *float32 `json:"temperature"`
+	TopP        *float32 `json:"top_p"`
+	NumPredict  *int32   `json:"num_predict"`
+	Stop        []string `json:"stop"`
+}
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+}
+
+type ollamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+// ollamaChatRequest is the body of an /api/chat request
+type ollamaChatRequest struct {
+	Model    string           `json:"model"`
+	Messages []*ollamaMessage `json:"messages"`
+	Tools    []*llm.ChatTool  `json:"tools"`
+	Format   json.RawMessage  `json:"format"`
+	Options  *ollamaOptions   `json:"options"`
+	// Stream defaults to true in the Ollama API
+	Stream *bool `json:"stream"`
+}
+
+// ollamaGenerateRequest is the body of an /api/generate request
+type ollamaGenerateRequest struct {
+	Model   string          `json:"model"`
+	Prompt  string          `json:"prompt"`
+	Suffix  string          `json:"suffix"`
+	System  string          `json:"system"`
+	Format  json.RawMessage `json:"format"`
+	Options *ollamaOptions  `json:"options"`
+	Stream  *bool           `json:"stream"`
+}
+
+// ollamaResponse is a response or streamed line of /api/chat and /api/generate
+type ollamaResponse struct {
+	Model           string               `json:"model"`
+	CreatedAt       time.Time            `json:"created_at"`
+	Message         *ollamaMessage       `json:"message,omitempty"`
+	Response        *string              `json:"response,omitempty"`
+	Done            bool                 `json:"done"`
+	DoneReason      string               `json:"done_reason,omitempty"`
+	TotalDuration   int64                `json:"total_duration,omitempty"`
+	PromptEvalCount int32                `json:"prompt_eval_count,omitempty"`
+	EvalCount       int32                `json:"eval_count,omitempty"`
+	Committee       *committee.Extension `json:"committee,omitempty"`
+}
+
+// OllamaChat handles the Ollama compatible /api/chat endpoint
+func (h *Handler) OllamaChat(c *gin.Context) {
+	var body ollamaChatRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	req := newOllamaChatRequest(body.Model, body.Options, body.Format, body.Stream)
+	for _, message := range body.Messages {
+		converted := &llm.ChatMessage{Role: message.Role, Content: message.Content}
+		for _, call := range message.ToolCalls {
+			converted.ToolCalls = append(converted.ToolCalls, llm.ChatToolCall{
+				Type:     "function",
+				Function: llm.ChatFunctionCall{Name: call.Function.Name, Arguments: string(call.Function.Arguments)},
+			})
+		}
+		req.Messages = append(req.Messages, converted)
+	}
+	req.Tools = body.Tools
+	h.ollama(c, req, true)
+}
+
+// OllamaGenerate handles the Ollama compatible /api/generate endpoint
+func (h *Handler) OllamaGenerate(c *gin.Context) {
+	var body ollamaGenerateRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	req := newOllamaChatRequest(body.Model, body.Options, body.Format, body.Stream)
+	if body.System != "" {
+		req.Messages = append(req.Messages, &llm.ChatMessage{Role: llm.RoleSystem, Content: body.System})
+	}
+	prompt := body.Prompt
+	if body.Suffix != "" {
+		prompt = fillInMiddlePrompt(prompt, body.Suffix)
+	}
+	req.Messages = append(req.Messages, &llm.ChatMessage{Role: llm.RoleUser, Content: prompt})
+	h.ollama(c, req, false)
+}
+
+// OllamaTags handles /api/tags, listing presets and members as local models
+func (h *Handler) OllamaTags(c *gin.Context) {
+	models := []gin.H{}
+	for _, name := range h.committee.ModelNames() {
+		models = append(models, gin.H{
+			"name":        name,
+			"model":       name,
+			"modified_at": time.Now().Format(time.RFC3339),
+			"size":        0,
+			"digest":      "",
+			"details": gin.H{
+				"format":             "committee",
+				"family":             "committee",
+				"families":           []string{"committee"},
+				"parameter_size":     "",
+				"quantization_level": "",
+			},
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"models": models})
+}
+
+// OllamaVersion handles /api/version, which clients use to detect a server
+func (h *Handler) OllamaVersion(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"version": ollamaVersion})
+}
+
+func newOllamaChatRequest(model string, options *ollamaOptions, format json.RawMessage, stream *bool) *llm.ChatCompletionRequest {
+	req := &llm.ChatCompletionRequest{
+		// Ollama clients may add the default tag to listed names
+		Model:  strings.TrimSuffix(model, ":latest"),
+		Stream: stream == nil || *stream,
+	}
+	if options != nil {
+		req.Temperature = options.Temperature
+		req.TopP = options.TopP
+		req.MaxTokens = options.NumPredict
+		req.Stop = options.Stop
+	}
+	if len(format) > 0 && string(format) != "null" && string(format) != `""` {
+		req.ResponseFormat = &llm.ChatResponseFormat{Type: "json_object"}
+	}
+	return req
+}
+
+// ollama runs the committee and answers in the Ollama format, as chat
+// messages or as generated text
+func (h *Handler) ollama(c *gin.Context, req *llm.ChatCompletionRequest, chat bool) {
+	start := time.Now()
+	opts, err := runOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	slog.Info(
+		"Received ollama request",
+		slog.Any("model", req.Model),
+		slog.Any("chat", chat),
+		slog.Any("messages_count", len(req.Messages)),
+	)
+
+	result, err := h.committee.RunCommitteeProcess(c, req, opts)
+	if RetryAfter(c, err) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests, retry later"})
+		return
+	}
+	if errors.Is(err, auth.ErrForbidden) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API key may not use the requested model or members"})
+		return
+	}
+	if errors.Is(err, committee.ErrBudgetTooSmall) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Budget too small for a single opinion"})
+		return
+	}
+	if errors.Is(err, committee.ErrLeaderStatus) {
+		slog.Error("Failed to process ollama request", slog.Any("err", err))
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Invalid response from leader model"})
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to process ollama request", slog.Any("err", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	setCommitteeHeaders(c, result)
+
+	// line builds a response line carrying text and tool calls
+	line := func(text string, calls []llm.ChatToolCall) *ollamaResponse {
+		resp := &ollamaResponse{Model: result.Model, CreatedAt: time.Now().UTC()}
+		if chat {
+			resp.Message = &ollamaMessage{Role: llm.RoleAssistant, Content: text}
+			for _, call := range calls {
+				var converted ollamaToolCall
+				converted.Function.Name = call.Function.Name
+				converted.Function.Arguments = toolInput(call.Function.Arguments)
+				resp.Message.ToolCalls = append(resp.Message.ToolCalls, converted)
+			}
+		} else {
+			resp.Response = &text
+		}
+		return resp
+	}
+	finish := func(resp *ollamaResponse, finishReason string) *ollamaResponse {
+		usage := result.Usage.ChatUsage()
+		resp.Done = true
+		resp.DoneReason = finishReason
+		if finishReason == "" || finishReason == "tool_calls" {
+			resp.DoneReason = "stop"
+		}
+		resp.TotalDuration = time.Since(start).Nanoseconds()
+		resp.PromptEvalCount = usage.PromptTokens
+		resp.EvalCount = usage.CompletionTokens
+		resp.Committee = result.Extension()
+		return resp
+	}
+
+	if !req.Stream {
+		completion, err := result.ReadResponse()
+		if err != nil {
+			slog.Error("read final response", slog.Any("err", err))
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Invalid response from leader model"})
+			return
+		}
+		var resp *ollamaResponse
+		if len(completion.Choices) > 0 && completion.Choices[0].Message != nil {
+			choice := completion.Choices[0]
+			text, _ := choice.Message.Content.(string)
+			resp = finish(line(text, choice.Message.ToolCalls), choice.FinishReason)
+		} else {
+			resp = finish(line("", nil), "")
+		}
+		SetUsageHeaders(c.Writer.Header(), resp.Committee.Usage)
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	defer result.Response.Body.Close()
+	c.Writer.Header().Set("Content-Type", "application/x-ndjson")
+	c.Writer.Header().Set("Trailer", strings.Join(usageHeaders, ", "))
+	c.Status(http.StatusOK)
+	encoder := json.NewEncoder(c.Writer)
+	write := func(resp *ollamaResponse) {
+		if err := encoder.Encode(resp); err != nil {
+			slog.Error("write ollama line", slog.Any("err", err))
+		}
+		c.Writer.Flush()
+	}
+
+	// Tool calls arrive in pieces and are sent whole at the end
+	var calls []llm.ChatToolCall
+	finishReason := ""
+	err = committee.ReadChunks(result.Response.Body, func(chunk *llm.ChatCompletionResponse) error {
+		if chunk.Usage != nil {
+			result.Usage.RecordChat(committee.PhaseFinal, result.Leader, chunk.Usage)
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Index != 0 {
+				continue
+			}
+			if choice.FinishReason != "" {
+				finishReason = choice.FinishReason
+			}
+			if choice.Delta == nil {
+				continue
+			}
+			if text, _ := choice.Delta.Content.(string); text != "" {
+				write(line(text, nil))
+			}
+			for i, call := range choice.Delta.ToolCalls {
+				position := i
+				if call.Index != nil {
+					position = *call.Index
+				}
+				for len(calls) <= position {
+					calls = append(calls, llm.ChatToolCall{Type: "function"})
+				}
+				calls[position].ID += call.ID
+				calls[position].Function.Name += call.Function.Name
+				calls[position].Function.Arguments += call.Function.Arguments
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("read final stream", slog.Any("err", err))
+		write(&ollamaResponse{Model: result.Model, CreatedAt: time.Now().UTC(), Done: true, DoneReason: "error"})
+		return
+	}
+	if len(calls) > 0 {
+		write(line("", calls))
+	}
+	write(finish(line("", nil), finishReason))
+	SetUsageHeaders(c.Writer.Header(), result.Usage.Report())
+}
+
+// fillInMiddlePrompt asks for the text between a prefix and a suffix
+func fillInMiddlePrompt(prefix, suffix string) string {
+	return "请补全以下内容中 <FILL> 处缺失的部分，只输出需要插入的文本：\n\n" + prefix + "<FILL>" + suffix
+}
@@ -0,0 +1,110 @@
+package chat
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"super-llm/infra/fake"
+)
+
+// TestOllamaChat streams by default, as Ollama does, and accepts the model
+// names with the tag clients add to listed models
+func TestOllamaChat(t *testing.T) {
+	h := newTestHandler(t, &fake.Config{Rules: []*fake.Rule{finalRule}}, nil)
+	body := map[string]any{
+		"model":    "alice:latest",
+		"messages": []map[string]any{{"role": "user", "content": "2+2 等于几？"}},
+		"options":  map[string]any{"temperature": 0.2},
+	}
+
+	w := post(t, h, "/api/chat", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("content type %s", w.Header().Get("Content-Type"))
+	}
+	var lines []*ollamaResponse
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var line ollamaResponse
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("decode %s: %v", scanner.Text(), err)
+		}
+		lines = append(lines, &line)
+	}
+	var text strings.Builder
+	for _, line := range lines[:len(lines)-1] {
+		if line.Done || line.Message == nil {
+			t.Fatalf("line %+v before the last", line)
+		}
+		text.WriteString(line.Message.Content)
+	}
+	last := lines[len(lines)-1]
+	if text.String() != "最终回答：4" {
+		t.Errorf("streamed %q", text.String())
+	}
+	if !last.Done || last.DoneReason != "stop" || last.EvalCount == 0 || last.Committee == nil {
+		t.Errorf("last line %+v", last)
+	}
+
+	body["stream"] = false
+	w = post(t, h, "/api/chat", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var resp ollamaResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Done || resp.Message == nil || resp.Message.Content != "最终回答：4" || resp.Message.Role != "assistant" {
+		t.Errorf("response %+v", resp)
+	}
+}
+
+// TestOllamaGenerate answers a fill-in-the-middle request as generated text.
+// The members only fill in the middle when they see prefix and suffix, and
+// the leader only repeats the filling when the members gave it.
+func TestOllamaGenerate(t *testing.T) {
+	h := newTestHandler(t, &fake.Config{Rules: []*fake.Rule{
+		{Match: `(?s)生成最终回答.*: b := 2`, Reply: "b := 2"},
+		{Match: `a := 1\n<FILL>\nreturn a \+ b`, Reply: "b := 2"},
+	}}, nil)
+	w := post(t, h, "/api/generate", map[string]any{"model": "alice", "prompt": "a := 1\n", "suffix": "\nreturn a + b", "stream": false})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var resp ollamaResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Message != nil || resp.Response == nil || *resp.Response != "b := 2" || !resp.Done {
+		t.Errorf("response %+v", resp)
+	}
+}
+
+func TestOllamaTags(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/tags", nil))
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &tags); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, model := range tags.Models {
+		names = append(names, model.Name)
+	}
+	if !slices.Contains(names, "alice") || !slices.Contains(names, "bob") {
+		t.Errorf("tags %v, want the members", names)
+	}
+}
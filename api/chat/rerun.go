@@ -0,0 +1,84 @@
+package chat
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"super-llm/domain/auth"
+	"super-llm/domain/committee"
+
+	"github.com/pkg/errors"
+)
+
+// rerunRequest is the body of a rerun request
+type rerunRequest struct {
+	Phase       string   `json:"phase"`
+	Leader      string   `json:"leader"`
+	Reviewers   []string `json:"reviewers"`
+	Template    string   `json:"template"`
+	Stream      bool     `json:"stream"`
+	Temperature *float32 `json:"temperature"`
+	TopP        *float32 `json:"top_p"`
+	MaxTokens   *int32   `json:"max_tokens"`
+}
+
+// Rerun handles /deliberations/:id/rerun, answering a stored deliberation
+// again without collecting new opinions
+func (h *Handler) Rerun(c *gin.Context) {
+	var req rerunRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	budget, err := BudgetHeaders(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	slog.Info(
+		"Received rerun request",
+		slog.Any("deliberation", c.Param("id")),
+		slog.Any("phase", req.Phase),
+		slog.Any("leader", req.Leader),
+	)
+
+	result, err := h.committee.Rerun(c, c.Param("id"), &committee.RerunOptions{
+		Phase:       req.Phase,
+		Leader:      req.Leader,
+		Reviewers:   req.Reviewers,
+		Template:    req.Template,
+		Stream:      req.Stream,
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+		MaxTokens:   req.MaxTokens,
+		Budget:      budget,
+		Caller:      auth.FromContext(c.Request.Context()),
+	})
+	switch {
+	case errors.Is(err, committee.ErrDeliberationNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Deliberation not found"})
+		return
+	case errors.Is(err, auth.ErrForbidden):
+		c.JSON(http.StatusForbidden, gin.H{"error": "API key may not use the requested model or members"})
+		return
+	case errors.Is(err, committee.ErrInvalidRerun):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case RetryAfter(c, err):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests, retry later"})
+		return
+	case errors.Is(err, committee.ErrLeaderStatus):
+		slog.Error("Failed to rerun deliberation", slog.Any("err", err))
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Invalid response from leader model"})
+		return
+	case err != nil:
+		slog.Error("Failed to rerun deliberation", slog.Any("err", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	writeResponse(c, result)
+}
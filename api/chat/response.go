@@ -0,0 +1,234 @@
+package chat
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"super-llm/domain/committee"
+	"super-llm/infra"
+
+	"github.com/cv70/pkgo/llm"
+	"github.com/pkg/errors"
+)
+
+// Usage headers reporting the aggregated usage of a committee run
+const (
+	headerPromptTokens     = "X-Committee-Prompt-Tokens"
+	headerCompletionTokens = "X-Committee-Completion-Tokens"
+	headerTotalTokens      = "X-Committee-Total-Tokens"
+	headerCost             = "X-Committee-Cost"
+	headerCutShort         = "X-Committee-Cut-Short"
+	headerEscalated        = "X-Committee-Escalated"
+	headerAgreement        = "X-Committee-Agreement"
+	headerCache            = "X-Cache"
+	headerDeliberation     = "X-Deliberation-Id"
+	// headerOpinionChoices asks for the member opinions as extra choices,
+	// "named" or "anonymous"
+	headerOpinionChoices = "X-Opinion-Choices"
+)
+
+var usageHeaders = []string{headerPromptTokens, headerCompletionTokens, headerTotalTokens, headerCost}
+
+// completionResponse is a chat completion carrying the committee extension
+type completionResponse struct {
+	llm.ChatCompletionResponse
+	Committee *committee.Extension `json:"committee,omitempty"`
+}
+
+// writeResponse relays the leader's final response to the client, replacing
+// its usage with the totals of the whole committee run
+func writeResponse(c *gin.Context, cc *committee.CommitteeContext) {
+	if cc.Response == nil {
+		slog.Error("run finished without a final response", slog.Any("deliberation", cc.ID))
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Invalid response from leader model"})
+		return
+	}
+	defer cc.Response.Body.Close()
+	setCommitteeHeaders(c, cc)
+	if cc.Request.Stream {
+		writeStream(c, cc)
+		return
+	}
+
+	var resp completionResponse
+	if err := json.NewDecoder(cc.Response.Body).Decode(&resp.ChatCompletionResponse); err != nil {
+		slog.Error("decode final response", slog.Any("err", err))
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Invalid response from leader model"})
+		return
+	}
+	cc.Usage.RecordChat(committee.PhaseFinal, cc.Leader, resp.Usage)
+	resp.Usage = cc.Usage.ChatUsage()
+	resp.Committee = cc.Extension()
+	for i, opinion := range opinionChoices(c, cc) {
+		resp.Choices = append(resp.Choices, llm.ChatChoice{
+			Index:        i + 1,
+			Message:      &llm.ChatMessage{Role: llm.RoleAssistant, Content: opinion.Text},
+			FinishReason: "stop",
+		})
+		resp.Committee.Choices = append(resp.Committee.Choices, opinion.Member)
+	}
+
+	SetUsageHeaders(c.Writer.Header(), resp.Committee.Usage)
+	c.JSON(http.StatusOK, resp)
+}
+
+// setCommitteeHeaders reports the outcome of the run in response headers
+func setCommitteeHeaders(c *gin.Context, cc *committee.CommitteeContext) {
+	c.Writer.Header().Set(headerDeliberation, cc.ID)
+	if report := cc.Budget.Report(); report != nil && report.CutShort {
+		c.Writer.Header().Set(headerCutShort, "true")
+	}
+	if cc.Cascade != nil {
+		c.Writer.Header().Set(headerEscalated, strconv.FormatBool(cc.Cascade.Escalated))
+	}
+	if cc.Consensus != nil {
+		c.Writer.Header().Set(headerAgreement, strconv.FormatFloat(cc.Consensus.Score, 'f', 4, 64))
+	}
+	if cc.CacheStatus != "" {
+		c.Writer.Header().Set(headerCache, cc.CacheStatus)
+	}
+}
+
+// opinionChoices returns the member opinions the client asked to receive as
+// choices after the leader's answer
+func opinionChoices(c *gin.Context, cc *committee.CommitteeContext) []*committee.OpinionChoice {
+	switch strings.ToLower(strings.TrimSpace(c.GetHeader(headerOpinionChoices))) {
+	case "named":
+		return cc.OpinionChoices(true)
+	case "anonymous", "true":
+		return cc.OpinionChoices(false)
+	}
+	return nil
+}
+
+// writeStream relays the leader's SSE stream. The chunk carrying usage is
+// rewritten with the committee totals; if the leader reports none, a usage
+// chunk is appended before [DONE]. Totals are also sent as trailers. Opinions
+// requested as choices are sent whole, one chunk each, before the usage.
+func writeStream(c *gin.Context, cc *committee.CommitteeContext) {
+	header := c.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("Trailer", strings.Join(usageHeaders, ", "))
+	c.Status(http.StatusOK)
+
+	var last llm.ChatCompletionResponse
+	opinions := opinionChoices(c, cc)
+	usageSent := false
+	writeOpinions := func(id string, created int64, model string) {
+		for i, opinion := range opinions {
+			data, err := json.Marshal(&llm.ChatCompletionResponse{
+				ID:      id,
+				Object:  "chat.completion.chunk",
+				Created: created,
+				Model:   model,
+				Choices: []llm.ChatChoice{{
+					Index:        i + 1,
+					Delta:        &llm.ChatMessage{Role: llm.RoleAssistant, Content: opinion.Text},
+					FinishReason: "stop",
+				}},
+			})
+			if err != nil {
+				slog.Error("encode opinion chunk", slog.Any("err", err))
+				continue
+			}
+			fmt.Fprintf(c.Writer, "data: %s\n\n", data)
+		}
+	}
+	writeUsage := func(chunk *completionResponse) {
+		writeOpinions(chunk.ID, chunk.Created, chunk.Model)
+		cc.Usage.RecordChat(committee.PhaseFinal, cc.Leader, chunk.Usage)
+		chunk.Usage = cc.Usage.ChatUsage()
+		chunk.Committee = cc.Extension()
+		for _, opinion := range opinions {
+			chunk.Committee.Choices = append(chunk.Committee.Choices, opinion.Member)
+		}
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			slog.Error("encode usage chunk", slog.Any("err", err))
+			return
+		}
+		fmt.Fprintf(c.Writer, "data: %s\n", data)
+		usageSent = true
+	}
+	finish := func() {
+		if usageSent {
+			return
+		}
+		chunk := &completionResponse{ChatCompletionResponse: llm.ChatCompletionResponse{
+			ID:      last.ID,
+			Object:  "chat.completion.chunk",
+			Created: last.Created,
+			Model:   last.Model,
+			Choices: []llm.ChatChoice{},
+		}}
+		writeUsage(chunk)
+		fmt.Fprint(c.Writer, "\n")
+	}
+
+	scanner := bufio.NewScanner(cc.Response.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		data, ok := strings.CutPrefix(line, "data: ")
+		switch {
+		case !ok:
+			fmt.Fprintf(c.Writer, "%s\n", line)
+			if line == "" {
+				c.Writer.Flush()
+			}
+			continue
+		case data == "[DONE]":
+			finish()
+			fmt.Fprintf(c.Writer, "%s\n", line)
+			continue
+		}
+
+		var chunk completionResponse
+		if json.Unmarshal([]byte(data), &chunk.ChatCompletionResponse) != nil {
+			fmt.Fprintf(c.Writer, "%s\n", line)
+			continue
+		}
+		last = chunk.ChatCompletionResponse
+		if chunk.Usage == nil || usageSent {
+			fmt.Fprintf(c.Writer, "%s\n", line)
+			continue
+		}
+		writeUsage(&chunk)
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Error("read final stream", slog.Any("err", err))
+	}
+	finish()
+	c.Writer.Flush()
+
+	SetUsageHeaders(header, cc.Usage.Report())
+}
+
+// RetryAfter sets the Retry-After header and reports true when err comes
+// from a committee or backend limiter that turned the request away
+func RetryAfter(c *gin.Context, err error) bool {
+	var busy *infra.BusyError
+	if !errors.As(err, &busy) {
+		return false
+	}
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(busy.RetryAfter.Seconds()))))
+	return true
+}
+
+// SetUsageHeaders writes the aggregated usage into response headers
+func SetUsageHeaders(header http.Header, report *committee.UsageReport) {
+	header.Set(headerPromptTokens, strconv.Itoa(int(report.Total.PromptTokens)))
+	header.Set(headerCompletionTokens, strconv.Itoa(int(report.Total.CompletionTokens)))
+	header.Set(headerTotalTokens, strconv.Itoa(int(report.Total.TotalTokens)))
+	header.Set(headerCost, strconv.FormatFloat(report.Total.Cost, 'f', -1, 64))
+}
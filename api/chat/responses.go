@@ -0,0 +1,484 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"super-llm/domain/auth"
+	"super-llm/domain/committee"
+
+	"github.com/cv70/pkgo/llm"
+	"github.com/pkg/errors"
+)
+
+// responsePrefix turns deliberation IDs into response IDs
+const responsePrefix = "resp_"
+
+// errPreviousResponse is returned for unknown previous_response_id values
+var errPreviousResponse = errors.New("previous response not found")
+
+// responsesRequest is the body of an OpenAI Responses API request
+type responsesRequest struct {
+	Model              string          `json:"model"`
+	Input              json.RawMessage `json:"input"`
+	Instructions       string          `json:"instructions"`
+	PreviousResponseID string          `json:"previous_response_id"`
+	Stream             bool            `json:"stream"`
+	Temperature        *float32        `json:"temperature"`
+	TopP               *float32        `json:"top_p"`
+	MaxOutputTokens    *int32          `json:"max_output_tokens"`
+	Tools              []*responseTool `json:"tools"`
+}
+
+// inputItem is an item of the input array: a message, a function call or
+// the output of a function call
+type inputItem struct {
+	Type      string          `json:"type"`
+	Role      string          `json:"role"`
+	Content   json.RawMessage `json:"content"`
+	CallID    string          `json:"call_id"`
+	Name      string          `json:"name"`
+	Arguments string          `json:"arguments"`
+	Output    string          `json:"output"`
+}
+
+type responseTool struct {
+	Type        string         `json:"type"`
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Parameters  map[string]any `json:"parameters"`
+}
+
+// responseObject is a response of the Responses API
+type responseObject struct {
+	ID                 string               `json:"id"`
+	Object             string               `json:"object"`
+	CreatedAt          int64                `json:"created_at"`
+	Status             string               `json:"status"`
+	Model              string               `json:"model"`
+	Output             []any                `json:"output"`
+	PreviousResponseID *string              `json:"previous_response_id"`
+	Usage              *responseUsage       `json:"usage"`
+	Committee          *committee.Extension `json:"committee,omitempty"`
+}
+
+type responseUsage struct {
+	InputTokens         int32          `json:"input_tokens"`
+	InputTokensDetails  map[string]int `json:"input_tokens_details"`
+	OutputTokens        int32          `json:"output_tokens"`
+	OutputTokensDetails map[string]int `json:"output_tokens_details"`
+	TotalTokens         int32          `json:"total_tokens"`
+}
+
+// messageItem is an assistant message of the output
+type messageItem struct {
+	Type    string        `json:"type"`
+	ID      string        `json:"id"`
+	Status  string        `json:"status"`
+	Role    string        `json:"role"`
+	Content []*outputText `json:"content"`
+}
+
+type outputText struct {
+	Type        string `json:"type"`
+	Text        string `json:"text"`
+	Annotations []any  `json:"annotations"`
+}
+
+// functionCallItem is a tool call of the output
+type functionCallItem struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	CallID    string `json:"call_id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+	Status    string `json:"status"`
+}
+
+// committeeItem is the output item carrying the deliberation behind the
+// answer. It comes first, as the deliberation precedes the answer.
+type committeeItem struct {
+	Type     string              `json:"type"`
+	ID       string              `json:"id"`
+	Leader   string              `json:"leader"`
+	Summary  string              `json:"summary,omitempty"`
+	Opinions map[string]string   `json:"opinions,omitempty"`
+	Reviews  map[string][]string `json:"reviews,omitempty"`
+	Ranking  []string            `json:"ranking,omitempty"`
+}
+
+// Responses handles the OpenAI compatible /responses endpoint
+func (h *Handler) Responses(c *gin.Context) {
+	var body responsesRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		responsesError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	opts, err := runOptions(c)
+	if err != nil {
+		responsesError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	req, err := h.responsesChatRequest(c, &body, opts)
+	switch {
+	case errors.Is(err, errPreviousResponse):
+		responsesError(c, http.StatusNotFound, err.Error())
+		return
+	case err != nil:
+		responsesError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	slog.Info(
+		"Received responses request",
+		slog.Any("members", c.GetHeader("X-Members")),
+		slog.Any("previous_response_id", body.PreviousResponseID),
+		slog.Any("messages_count", len(req.Messages)),
+	)
+
+	result, err := h.committee.RunCommitteeProcess(c, req, opts)
+	if RetryAfter(c, err) {
+		responsesError(c, http.StatusTooManyRequests, "Too many requests, retry later")
+		return
+	}
+	if errors.Is(err, auth.ErrForbidden) {
+		responsesError(c, http.StatusForbidden, "API key may not use the requested model or members")
+		return
+	}
+	if errors.Is(err, committee.ErrBudgetTooSmall) {
+		responsesError(c, http.StatusBadRequest, "Budget too small for a single opinion")
+		return
+	}
+	if errors.Is(err, committee.ErrLeaderStatus) {
+		slog.Error("Failed to process responses", slog.Any("err", err))
+		responsesError(c, http.StatusBadGateway, "Invalid response from leader model")
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to process responses", slog.Any("err", err))
+		responsesError(c, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	setCommitteeHeaders(c, result)
+	if req.Stream {
+		writeResponsesStream(c, result, &body)
+		return
+	}
+
+	completion, err := result.ReadResponse()
+	if err != nil {
+		slog.Error("read final response", slog.Any("err", err))
+		responsesError(c, http.StatusBadGateway, "Invalid response from leader model")
+		return
+	}
+	resp := newResponseObject(result, &body, "completed")
+	if len(completion.Choices) > 0 && completion.Choices[0].Message != nil {
+		choice := completion.Choices[0]
+		if choice.FinishReason == "length" {
+			resp.Status = "incomplete"
+		}
+		if text, _ := choice.Message.Content.(string); text != "" {
+			resp.Output = append(resp.Output, &messageItem{
+				Type:    "message",
+				ID:      "msg_" + uuid.NewString(),
+				Status:  "completed",
+				Role:    llm.RoleAssistant,
+				Content: []*outputText{{Type: "output_text", Text: text, Annotations: []any{}}},
+			})
+		}
+		for _, call := range choice.Message.ToolCalls {
+			resp.Output = append(resp.Output, &functionCallItem{
+				Type:      "function_call",
+				ID:        "fc_" + uuid.NewString(),
+				CallID:    call.ID,
+				Name:      call.Function.Name,
+				Arguments: call.Function.Arguments,
+				Status:    "completed",
+			})
+		}
+	}
+	resp.Usage = committeeResponseUsage(result)
+	resp.Committee = result.Extension()
+	SetUsageHeaders(c.Writer.Header(), resp.Committee.Usage)
+	c.JSON(http.StatusOK, resp)
+}
+
+// responsesChatRequest translates the request into the committee's chat
+// format, prepending the conversation of the previous response
+func (h *Handler) responsesChatRequest(c *gin.Context, body *responsesRequest, opts *committee.RunOptions) (*llm.ChatCompletionRequest, error) {
+	req := &llm.ChatCompletionRequest{
+		Model:       body.Model,
+		Temperature: body.Temperature,
+		TopP:        body.TopP,
+		MaxTokens:   body.MaxOutputTokens,
+		Stream:      body.Stream,
+	}
+	if body.Instructions != "" {
+		req.Messages = append(req.Messages, &llm.ChatMessage{Role: llm.RoleSystem, Content: body.Instructions})
+	}
+
+	if body.PreviousResponseID != "" {
+		id := strings.TrimPrefix(body.PreviousResponseID, responsePrefix)
+		previous, err := h.committee.GetDeliberationFor(c, auth.FromContext(c.Request.Context()), id)
+		if errors.Is(err, committee.ErrDeliberationNotFound) {
+			return nil, errPreviousResponse
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Instructions are not carried over from earlier responses
+		for _, message := range previous.Request.Messages {
+			if message.Role != llm.RoleSystem {
+				req.Messages = append(req.Messages, message)
+			}
+		}
+		req.Messages = append(req.Messages, &llm.ChatMessage{Role: llm.RoleAssistant, Content: previous.Answer})
+		opts.Parent = previous.ID
+	}
+
+	items, err := inputItems(body.Input)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid input")
+	}
+	for _, item := range items {
+		switch item.Type {
+		case "", "message":
+			text, err := inputText(item.Content)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid input content")
+			}
+			role := item.Role
+			if role == "developer" {
+				role = llm.RoleSystem
+			}
+			req.Messages = append(req.Messages, &llm.ChatMessage{Role: role, Content: text})
+		case "function_call":
+			req.Messages = append(req.Messages, &llm.ChatMessage{Role: llm.RoleAssistant, ToolCalls: []llm.ChatToolCall{{
+				ID:       item.CallID,
+				Type:     "function",
+				Function: llm.ChatFunctionCall{Name: item.Name, Arguments: item.Arguments},
+			}}})
+		case "function_call_output":
+			req.Messages = append(req.Messages, &llm.ChatMessage{Role: "tool", ToolCallID: item.CallID, Content: item.Output})
+		}
+	}
+
+	for _, tool := range body.Tools {
+		if tool.Type != "function" {
+			return nil, errors.Errorf("unsupported tool type %s", tool.Type)
+		}
+		req.Tools = append(req.Tools, &llm.ChatTool{
+			Type:     "function",
+			Function: llm.ChatFunction{Name: tool.Name, Description: tool.Description, Parameters: tool.Parameters},
+		})
+	}
+	return req, nil
+}
+
+// inputItems decodes input given as a string or as an array of items
+func inputItems(raw json.RawMessage) ([]*inputItem, error) {
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return []*inputItem{{Type: "message", Role: llm.RoleUser, Content: raw}}, nil
+	}
+	var items []*inputItem
+	err := json.Unmarshal(raw, &items)
+	return items, err
+}
+
+// inputText joins the text of message content given as a string or parts
+func inputText(raw json.RawMessage) (string, error) {
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return text, nil
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return "", err
+	}
+	var texts []string
+	for _, part := range parts {
+		if part.Type == "input_text" || part.Type == "output_text" || part.Type == "text" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+// newResponseObject starts the response of a run with its committee item
+func newResponseObject(cc *committee.CommitteeContext, body *responsesRequest, status string) *responseObject {
+	resp := &responseObject{
+		ID:        responsePrefix + cc.ID,
+		Object:    "response",
+		CreatedAt: cc.CreatedAt.Unix(),
+		Status:    status,
+		Model:     body.Model,
+		Output:    []any{},
+	}
+	if body.PreviousResponseID != "" {
+		resp.PreviousResponseID = &body.PreviousResponseID
+	}
+	if len(cc.Opinions) > 0 {
+		resp.Output = append(resp.Output, newCommitteeItem(cc))
+	}
+	return resp
+}
+
+func newCommitteeItem(cc *committee.CommitteeContext) *committeeItem {
+	return &committeeItem{
+		Type:     "committee",
+		ID:       "cmt_" + cc.ID,
+		Leader:   cc.Leader.Name(),
+		Summary:  cc.MessageSummary,
+		Opinions: cc.Opinions,
+		Reviews:  cc.Reviews,
+		Ranking:  cc.Ranking,
+	}
+}
+
+// writeResponsesStream relays the leader's stream as Responses API events
+func writeResponsesStream(c *gin.Context, cc *committee.CommitteeContext, body *responsesRequest) {
+	defer cc.Response.Body.Close()
+	header := c.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("Trailer", strings.Join(usageHeaders, ", "))
+	c.Status(http.StatusOK)
+
+	sequence := 0
+	event := func(data gin.H) {
+		data["sequence_number"] = sequence
+		sequence++
+		payload, err := json.Marshal(data)
+		if err != nil {
+			slog.Error("encode responses event", slog.Any("err", err))
+			return
+		}
+		fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", data["type"], payload)
+		c.Writer.Flush()
+	}
+
+	resp := newResponseObject(cc, body, "in_progress")
+	started := *resp
+	started.Output = []any{}
+	event(gin.H{"type": "response.created", "response": &started})
+	event(gin.H{"type": "response.in_progress", "response": &started})
+	for i, item := range resp.Output {
+		event(gin.H{"type": "response.output_item.added", "output_index": i, "item": item})
+		event(gin.H{"type": "response.output_item.done", "output_index": i, "item": item})
+	}
+
+	var message *messageItem
+	var text strings.Builder
+	messageIndex := 0
+	// Tool calls by their index in the leader's deltas, in order of arrival
+	calls := map[int]*functionCallItem{}
+	callIndexes := map[int]int{}
+	var callOrder []int
+	finishReason := ""
+	err := committee.ReadChunks(cc.Response.Body, func(chunk *llm.ChatCompletionResponse) error {
+		if chunk.Usage != nil {
+			cc.Usage.RecordChat(committee.PhaseFinal, cc.Leader, chunk.Usage)
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Index != 0 {
+				continue
+			}
+			if choice.FinishReason != "" {
+				finishReason = choice.FinishReason
+			}
+			if choice.Delta == nil {
+				continue
+			}
+			if delta, _ := choice.Delta.Content.(string); delta != "" {
+				if message == nil {
+					message = &messageItem{Type: "message", ID: "msg_" + uuid.NewString(), Status: "in_progress", Role: llm.RoleAssistant, Content: []*outputText{}}
+					messageIndex = len(resp.Output)
+					resp.Output = append(resp.Output, message)
+					event(gin.H{"type": "response.output_item.added", "output_index": messageIndex, "item": message})
+					event(gin.H{"type": "response.content_part.added", "item_id": message.ID, "output_index": messageIndex, "content_index": 0,
+						"part": &outputText{Type: "output_text", Annotations: []any{}}})
+				}
+				text.WriteString(delta)
+				event(gin.H{"type": "response.output_text.delta", "item_id": message.ID, "output_index": messageIndex, "content_index": 0, "delta": delta})
+			}
+			for i, call := range choice.Delta.ToolCalls {
+				position := i
+				if call.Index != nil {
+					position = *call.Index
+				}
+				item := calls[position]
+				if item == nil {
+					item = &functionCallItem{Type: "function_call", ID: "fc_" + uuid.NewString(), CallID: call.ID, Name: call.Function.Name, Status: "in_progress"}
+					calls[position] = item
+					callIndexes[position] = len(resp.Output)
+					callOrder = append(callOrder, position)
+					resp.Output = append(resp.Output, item)
+					event(gin.H{"type": "response.output_item.added", "output_index": callIndexes[position], "item": item})
+				}
+				if call.Function.Arguments != "" {
+					item.Arguments += call.Function.Arguments
+					event(gin.H{"type": "response.function_call_arguments.delta", "item_id": item.ID, "output_index": callIndexes[position], "delta": call.Function.Arguments})
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("read final stream", slog.Any("err", err))
+		resp.Status = "failed"
+		event(gin.H{"type": "response.failed", "response": resp})
+		return
+	}
+
+	if message != nil {
+		part := &outputText{Type: "output_text", Text: text.String(), Annotations: []any{}}
+		message.Content = []*outputText{part}
+		message.Status = "completed"
+		event(gin.H{"type": "response.output_text.done", "item_id": message.ID, "output_index": messageIndex, "content_index": 0, "text": part.Text})
+		event(gin.H{"type": "response.content_part.done", "item_id": message.ID, "output_index": messageIndex, "content_index": 0, "part": part})
+		event(gin.H{"type": "response.output_item.done", "output_index": messageIndex, "item": message})
+	}
+	for _, position := range callOrder {
+		item := calls[position]
+		item.Status = "completed"
+		event(gin.H{"type": "response.function_call_arguments.done", "item_id": item.ID, "output_index": callIndexes[position], "arguments": item.Arguments})
+		event(gin.H{"type": "response.output_item.done", "output_index": callIndexes[position], "item": item})
+	}
+
+	resp.Status = "completed"
+	if finishReason == "length" {
+		resp.Status = "incomplete"
+	}
+	resp.Usage = committeeResponseUsage(cc)
+	resp.Committee = cc.Extension()
+	event(gin.H{"type": "response." + resp.Status, "response": resp})
+
+	SetUsageHeaders(header, cc.Usage.Report())
+}
+
+// committeeResponseUsage reports the committee totals as Responses usage
+func committeeResponseUsage(cc *committee.CommitteeContext) *responseUsage {
+	usage := cc.Usage.ChatUsage()
+	return &responseUsage{
+		InputTokens:         usage.PromptTokens,
+		InputTokensDetails:  map[string]int{"cached_tokens": 0},
+		OutputTokens:        usage.CompletionTokens,
+		OutputTokensDetails: map[string]int{"reasoning_tokens": 0},
+		TotalTokens:         usage.TotalTokens,
+	}
+}
+
+func responsesError(c *gin.Context, status int, message string) {
+	c.JSON(status, gin.H{"error": gin.H{"type": "invalid_request_error", "message": message, "code": nil}})
+}
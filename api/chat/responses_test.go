@@ -0,0 +1,135 @@
+package chat
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"super-llm/config"
+	"super-llm/infra/fake"
+)
+
+// decodeResponse decodes a response object with its output items kept raw
+func decodeResponse(t *testing.T, data []byte) (*responseObject, []map[string]any) {
+	t.Helper()
+	var resp responseObject
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatal(err)
+	}
+	var items []map[string]any
+	for _, item := range resp.Output {
+		items = append(items, item.(map[string]any))
+	}
+	return &resp, items
+}
+
+// TestResponses answers a response and chains a second one to it through
+// previous_response_id, whose members must see the earlier answer
+func TestResponses(t *testing.T) {
+	h := newTestHandler(t, &fake.Config{Rules: []*fake.Rule{
+		finalRule,
+		{Match: "最终回答：4", Reply: "记得上一轮"},
+	}}, func(cfg *config.Config) {
+		cfg.Storage = &config.StorageConfig{Type: "jsonl", Path: filepath.Join(t.TempDir(), "deliberations.jsonl")}
+	})
+
+	w := post(t, h, "/v1/responses", map[string]any{
+		"model":        "alice",
+		"instructions": "be brief",
+		"input":        "2+2 等于几？",
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	resp, items := decodeResponse(t, w.Body.Bytes())
+	if resp.Object != "response" || resp.Status != "completed" || !strings.HasPrefix(resp.ID, responsePrefix) {
+		t.Errorf("response %+v", resp)
+	}
+	if len(items) != 2 || items[0]["type"] != "committee" || items[1]["type"] != "message" {
+		t.Fatalf("output %v, want the committee item and the message", items)
+	}
+	if opinions, _ := items[0]["opinions"].(map[string]any); len(opinions) != 2 {
+		t.Errorf("committee opinions %v", items[0]["opinions"])
+	}
+	text := items[1]["content"].([]any)[0].(map[string]any)["text"]
+	if text != "最终回答：4" {
+		t.Errorf("answer %v", text)
+	}
+	if resp.Usage == nil || resp.Usage.TotalTokens == 0 {
+		t.Errorf("usage %+v", resp.Usage)
+	}
+
+	w = post(t, h, "/v1/responses", map[string]any{
+		"model":                "alice",
+		"previous_response_id": resp.ID,
+		"input":                []map[string]any{{"role": "user", "content": []map[string]any{{"type": "input_text", "text": "再加一呢？"}}}},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("chained: status %d: %s", w.Code, w.Body)
+	}
+	chained, items := decodeResponse(t, w.Body.Bytes())
+	if chained.PreviousResponseID == nil || *chained.PreviousResponseID != resp.ID {
+		t.Errorf("previous_response_id %v", chained.PreviousResponseID)
+	}
+	opinions, _ := items[0]["opinions"].(map[string]any)
+	if values := slices.Collect(maps.Values(opinions)); len(values) != 2 || values[0] != "记得上一轮" || values[1] != "记得上一轮" {
+		t.Errorf("opinions %v, want the members to see the previous answer", opinions)
+	}
+
+	if w := post(t, h, "/v1/responses", map[string]any{"model": "alice", "previous_response_id": "resp_missing", "input": "hi"}); w.Code != http.StatusNotFound {
+		t.Errorf("unknown previous response: status %d", w.Code)
+	}
+	if w := post(t, h, "/v1/responses", map[string]any{"model": "alice", "input": "hi", "tools": []map[string]any{{"type": "web_search"}}}); w.Code != http.StatusBadRequest {
+		t.Errorf("unsupported tool: status %d", w.Code)
+	}
+}
+
+func TestResponsesStream(t *testing.T) {
+	h := newTestHandler(t, &fake.Config{Rules: []*fake.Rule{finalRule}}, nil)
+	w := post(t, h, "/v1/responses", map[string]any{"model": "alice", "input": "2+2 等于几？", "stream": true})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	var types []string
+	var text strings.Builder
+	var done string
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var event struct {
+			Type           string `json:"type"`
+			SequenceNumber int    `json:"sequence_number"`
+			Delta          string `json:"delta"`
+			Text           string `json:"text"`
+		}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("decode %s: %v", data, err)
+		}
+		if event.SequenceNumber != len(types) {
+			t.Errorf("event %s numbered %d, want %d", event.Type, event.SequenceNumber, len(types))
+		}
+		types = append(types, event.Type)
+		switch event.Type {
+		case "response.output_text.delta":
+			text.WriteString(event.Delta)
+		case "response.output_text.done":
+			done = event.Text
+		}
+	}
+	if len(types) < 2 || types[0] != "response.created" || types[len(types)-1] != "response.completed" {
+		t.Errorf("events %v", types)
+	}
+	if !slices.Contains(types, "response.output_item.added") || !slices.Contains(types, "response.content_part.done") {
+		t.Errorf("events %v, want output items and content parts", types)
+	}
+	if text.String() != "最终回答：4" || done != text.String() {
+		t.Errorf("streamed %q, done %q", text.String(), done)
+	}
+}
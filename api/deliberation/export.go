@@ -0,0 +1,72 @@
+package deliberation
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"super-llm/domain/auth"
+	"super-llm/domain/committee"
+
+	"github.com/pkg/errors"
+)
+
+// Export handles GET /deliberations/export, streaming stored deliberations
+// as JSONL preference pairs or SFT examples
+func (h *Handler) Export(c *gin.Context) {
+	opts, err := parseExportOptions(c)
+	if err == nil {
+		err = opts.Validate()
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if h.committee.Store == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Storage is not enabled"})
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", "attachment; filename=\""+opts.Format+".jsonl\"")
+	c.Status(http.StatusOK)
+	count, err := h.committee.ExportDeliberations(c, c.Writer, opts)
+	if err != nil {
+		slog.Error("Failed to export deliberations", slog.Any("err", err))
+		return
+	}
+	slog.Info("Exported deliberations", slog.Any("format", opts.Format), slog.Any("count", count))
+}
+
+// parseExportOptions parses the format, chosen, model, since, until,
+// min_agreement and feedback query parameters, keeping keys other than
+// admin keys to their own deliberations
+func parseExportOptions(c *gin.Context) (*committee.ExportOptions, error) {
+	opts := &committee.ExportOptions{
+		Owner:    auth.FromContext(c.Request.Context()).Scope(),
+		Format:   c.Query("format"),
+		Chosen:   c.Query("chosen"),
+		Model:    c.Query("model"),
+		Feedback: c.Query("feedback"),
+	}
+	var err error
+	if since := c.Query("since"); since != "" {
+		if opts.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return nil, errors.New("invalid since, expected RFC 3339 time")
+		}
+	}
+	if until := c.Query("until"); until != "" {
+		if opts.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return nil, errors.New("invalid until, expected RFC 3339 time")
+		}
+	}
+	if agreement := c.Query("min_agreement"); agreement != "" {
+		if opts.MinAgreement, err = strconv.ParseFloat(agreement, 64); err != nil {
+			return nil, errors.New("invalid min_agreement")
+		}
+	}
+	return opts, nil
+}
@@ -0,0 +1,67 @@
+package deliberation
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"super-llm/domain/auth"
+	"super-llm/domain/committee"
+
+	"github.com/pkg/errors"
+)
+
+// feedbackRequest is the body of a feedback request
+type feedbackRequest struct {
+	DeliberationID string   `json:"deliberation_id"`
+	CompletionID   string   `json:"completion_id"`
+	Rating         string   `json:"rating"`
+	Score          *float64 `json:"score"`
+	Preferred      string   `json:"preferred"`
+	Comment        string   `json:"comment"`
+}
+
+// Feedback handles POST /feedback, recording a user's judgment of a
+// deliberation identified by its own ID or its completion ID
+func (h *Handler) Feedback(c *gin.Context) {
+	var req feedbackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	id := req.DeliberationID
+	if id == "" {
+		id = req.CompletionID
+	}
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "deliberation_id or completion_id is required"})
+		return
+	}
+
+	feedback := &committee.Feedback{
+		Rating:    req.Rating,
+		Score:     req.Score,
+		Preferred: req.Preferred,
+		Comment:   req.Comment,
+	}
+	deliberation, err := h.committee.AddFeedback(c, auth.FromContext(c.Request.Context()), id, feedback)
+	switch {
+	case errors.Is(err, committee.ErrDeliberationNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Deliberation not found"})
+		return
+	case errors.Is(err, committee.ErrInvalidFeedback):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		slog.Error("Failed to record feedback", slog.Any("err", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"object":       "feedback",
+		"deliberation": deliberation.ID,
+		"feedback":     feedback,
+	})
+}
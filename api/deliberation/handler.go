@@ -0,0 +1,122 @@
+package deliberation
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"super-llm/domain/auth"
+	"super-llm/domain/committee"
+
+	"github.com/pkg/errors"
+)
+
+const maxListLimit = 100
+
+// Handler serves saved deliberation transcripts
+type Handler struct {
+	committee *committee.CommitteeDomain
+}
+
+// NewHandler creates a new deliberation handler
+func NewHandler(committee *committee.CommitteeDomain) *Handler {
+	return &Handler{
+		committee: committee,
+	}
+}
+
+// summary is a deliberation as shown in listings
+type summary struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Model     string    `json:"model"`
+	Leader    string    `json:"leader"`
+	Members   []string  `json:"members"`
+	Strategy  string    `json:"strategy"`
+	Question  string    `json:"question"`
+	Answer    string    `json:"answer"`
+	Completed bool      `json:"completed"`
+}
+
+// Get handles GET /deliberations/:id
+func (h *Handler) Get(c *gin.Context) {
+	deliberation, err := h.committee.GetDeliberationFor(c, auth.FromContext(c.Request.Context()), c.Param("id"))
+	if errors.Is(err, committee.ErrDeliberationNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Deliberation not found"})
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to get deliberation", slog.Any("err", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	c.JSON(http.StatusOK, deliberation)
+}
+
+// List handles GET /deliberations, filtered by the q, model, since and
+// until query parameters and paged by limit and offset. Keys other than
+// admin keys only list their own deliberations.
+func (h *Handler) List(c *gin.Context) {
+	query, err := parseQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	deliberations, err := h.committee.ListDeliberations(c, query)
+	if err != nil {
+		slog.Error("Failed to list deliberations", slog.Any("err", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	data := make([]*summary, 0, len(deliberations))
+	for _, deliberation := range deliberations {
+		data = append(data, &summary{
+			ID:        deliberation.ID,
+			CreatedAt: deliberation.CreatedAt,
+			Model:     deliberation.Model,
+			Leader:    deliberation.Leader,
+			Members:   deliberation.Members,
+			Strategy:  deliberation.Strategy,
+			Question:  deliberation.Question(),
+			Answer:    deliberation.Answer,
+			Completed: deliberation.Completed,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": data})
+}
+
+// parseQuery parses the listing query parameters
+func parseQuery(c *gin.Context) (*committee.DeliberationQuery, error) {
+	query := &committee.DeliberationQuery{
+		Owner: auth.FromContext(c.Request.Context()).Scope(),
+		Model: c.Query("model"),
+		Query: c.Query("q"),
+	}
+	var err error
+	if since := c.Query("since"); since != "" {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return nil, errors.New("invalid since, expected RFC 3339 time")
+		}
+	}
+	if until := c.Query("until"); until != "" {
+		if query.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return nil, errors.New("invalid until, expected RFC 3339 time")
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 0 {
+			return nil, errors.New("invalid limit")
+		}
+		query.Limit = min(query.Limit, maxListLimit)
+	}
+	if offset := c.Query("offset"); offset != "" {
+		if query.Offset, err = strconv.Atoi(offset); err != nil || query.Offset < 0 {
+			return nil, errors.New("invalid offset")
+		}
+	}
+	return query, nil
+}
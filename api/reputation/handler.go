@@ -0,0 +1,54 @@
+package reputation
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"super-llm/domain/committee"
+)
+
+// Handler serves member reputation
+type Handler struct {
+	committee *committee.CommitteeDomain
+}
+
+// NewHandler creates a new reputation handler
+func NewHandler(committee *committee.CommitteeDomain) *Handler {
+	return &Handler{
+		committee: committee,
+	}
+}
+
+// Leaderboard handles GET /reputation, ranking members within the topic
+// given by the topic query parameter, all topics by default
+func (h *Handler) Leaderboard(c *gin.Context) {
+	reputation := h.committee.Reputation
+	if reputation == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reputation is not enabled"})
+		return
+	}
+
+	topic := strings.ToLower(strings.TrimSpace(c.Query("topic")))
+	if topic == "" {
+		topic = committee.TopicAll
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"topic":  topic,
+		"topics": reputation.Topics(),
+		"data":   reputation.Leaderboard(topic, nil),
+	})
+}
+
+// Reviewers handles GET /reputation/reviewers, reporting the calibration
+// of every reviewer
+func (h *Handler) Reviewers(c *gin.Context) {
+	calibration := h.committee.Calibration
+	if calibration == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Calibration is not enabled"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": calibration.Stats()})
+}
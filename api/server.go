@@ -4,54 +4,199 @@ import (
 	"context"
 	"log/slog"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-    "github.com/gin-contrib/cors"
 
+	"super-llm/api/arena"
 	"super-llm/api/chat"
+	"super-llm/api/deliberation"
+	"super-llm/api/reputation"
+	"super-llm/config"
+	"super-llm/domain/auth"
 	"super-llm/domain/committee"
+
+	"github.com/pkg/errors"
 )
 
 // Server holds the API server configuration
 type Server struct {
-	router     *gin.Engine
-	committee  *committee.CommitteeDomain
+	// routes serve the requests with the current committee, replaced on
+	// reload while requests in flight finish on the previous ones
+	routes atomic.Pointer[routes]
+	// reloadMu serializes reloads
+	reloadMu sync.Mutex
 }
 
-// NewServer creates a new API server
-func NewServer(committee *committee.CommitteeDomain) *Server {
+// routes is the router of one configuration with the committee it serves
+type routes struct {
+	router    *gin.Engine
+	committee *committee.CommitteeDomain
+	// auth checks API keys, nil when the API is open
+	auth *auth.Auth
+	// cors selects the browser origins allowed to call the API
+	cors *config.CORSConfig
+
+	mu sync.Mutex
+	// inflight counts the requests served by these routes
+	inflight int
+	// next are the routes of the configuration these were reloaded into,
+	// set once they serve no new requests
+	next *routes
+}
+
+// NewServer creates a new API server, requiring API keys when auth is set
+func NewServer(committee *committee.CommitteeDomain, auth *auth.Auth, cors *config.CORSConfig) *Server {
 	// Set gin to release mode for production
 	gin.SetMode(gin.ReleaseMode)
-	
+
+	server := &Server{}
+	server.routes.Store(newRoutes(committee, auth, cors))
+
+	return server
+}
+
+// Reload switches the server to a new configuration. The committee is
+// rebuilt and the keys reloaded first, so a configuration that fails to
+// load leaves the server as it was.
+func (s *Server) Reload(ctx context.Context, cfg *config.Config) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	current := s.routes.Load()
+	domain, err := current.committee.Reload(ctx, cfg)
+	if err != nil {
+		return errors.Wrap(err, "build committee")
+	}
+
+	keys := current.auth
+	switch {
+	case cfg.Auth == nil:
+		keys = nil
+	case keys == nil:
+		keys, err = auth.New(cfg.Auth)
+	default:
+		err = keys.Reload(cfg.Auth)
+	}
+	if err != nil {
+		// The new committee is dropped, closing what it does not share with
+		// the current one
+		if err := domain.Retire(current.committee); err != nil {
+			slog.Error("close rejected committee", slog.Any("err", err))
+		}
+		return errors.Wrap(err, "load API keys")
+	}
+
+	next := newRoutes(domain, keys, cfg.CORS)
+	s.routes.Store(next)
+	current.retire(next)
+	return nil
+}
+
+// ServeHTTP routes a request with the current configuration
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r := s.routes.Load()
+	// Routes retired meanwhile have handed over to the current ones
+	for !r.enter() {
+		r = s.routes.Load()
+	}
+	defer r.leave()
+	r.router.ServeHTTP(w, req)
+}
+
+// enter counts a request served by the routes, false once they are retired
+func (r *routes) enter() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.next != nil {
+		return false
+	}
+	r.inflight++
+	return true
+}
+
+// leave ends a request, closing the retired routes after their last one
+func (r *routes) leave() {
+	r.mu.Lock()
+	r.inflight--
+	done := r.next != nil && r.inflight == 0
+	r.mu.Unlock()
+	if done {
+		r.close()
+	}
+}
+
+// retire hands the routes over to next, closing them once their requests
+// finished
+func (r *routes) retire(next *routes) {
+	r.mu.Lock()
+	r.next = next
+	done := r.inflight == 0
+	r.mu.Unlock()
+	if done {
+		r.close()
+	}
+}
+
+// close releases what the routes hold that their successor does not share
+func (r *routes) close() {
+	if err := r.committee.Retire(r.next.committee); err != nil {
+		slog.Error("Failed to close the previous committee", slog.Any("err", err))
+	}
+	if r.auth != nil && r.auth != r.next.auth {
+		if err := r.auth.Flush(); err != nil {
+			slog.Error("Failed to save key usage", slog.Any("err", err))
+		}
+	}
+}
+
+// newRoutes creates the router of a committee
+func newRoutes(committee *committee.CommitteeDomain, auth *auth.Auth, cors *config.CORSConfig) *routes {
 	router := gin.New()
-	
+
 	// Add middleware
 	router.Use(gin.Logger())
 	router.Use(gin.Recovery())
-	
-	server := &Server{
-		router:     router,
-		committee:  committee,
+
+	r := &routes{
+		router:    router,
+		committee: committee,
+		auth:      auth,
+		cors:      cors,
 	}
-	
+
 	// Register routes
-	server.registerRoutes()
-	
-	return server
+	r.registerRoutes()
+
+	return r
 }
 
 // registerRoutes registers all API routes
-func (s *Server) registerRoutes() {
+func (s *routes) registerRoutes() {
 	// Create chat handler
 	chatHandler := chat.NewHandler(s.committee)
+	deliberationHandler := deliberation.NewHandler(s.committee)
+	reputationHandler := reputation.NewHandler(s.committee)
+	arenaHandler := arena.NewHandler(s.committee)
+	origins := []string{"*"}
+	if s.cors != nil && len(s.cors.AllowOrigins) > 0 {
+		origins = s.cors.AllowOrigins
+	}
 	s.router.Use(cors.New(cors.Config{
-        AllowOrigins:     []string{"*"},
-        AllowMethods:     []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions},
-        AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "X-Requested-With"},
-        AllowCredentials: true,
-        MaxAge:           24 * time.Hour, // 缓存预检结果的时间
-    }))
+		AllowOrigins:     origins,
+		AllowMethods:     []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "X-Requested-With", "X-Api-Key"},
+		AllowCredentials: true,
+		MaxAge:           24 * time.Hour, // 缓存预检结果的时间
+	}))
+
+	// Every route below requires an API key when auth is enabled
+	if s.auth != nil {
+		s.router.Use(s.authenticate)
+	}
 
 	// API routes
 	api := s.router.Group("/v1")
@@ -60,7 +205,45 @@ func (s *Server) registerRoutes() {
 		api.POST("/chat/completions", chatHandler.ChatCompletions)
 
 		// completions endpoint
-		api.POST("/completions", chatHandler.ChatCompletions)
+		api.POST("/completions", chatHandler.Completions)
+
+		// Anthropic compatible messages endpoint
+		api.POST("/messages", chatHandler.Messages)
+
+		// OpenAI Responses API endpoint
+		api.POST("/responses", chatHandler.Responses)
+
+		// Saved deliberation transcripts
+		api.GET("/deliberations", deliberationHandler.List)
+		api.GET("/deliberations/export", deliberationHandler.Export)
+		api.GET("/deliberations/:id", deliberationHandler.Get)
+		api.POST("/deliberations/:id/rerun", chatHandler.Rerun)
+
+		// User feedback on deliberations
+		api.POST("/feedback", deliberationHandler.Feedback)
+
+		// Member reputation
+		api.GET("/reputation", reputationHandler.Leaderboard)
+		api.GET("/reputation/reviewers", reputationHandler.Reviewers)
+
+		// Blind comparisons voted on by humans
+		api.POST("/arena/compare", arenaHandler.Compare)
+		api.POST("/arena/vote", arenaHandler.Vote)
+		api.GET("/arena/leaderboard", arenaHandler.Leaderboard)
+
+		// Usage of API keys
+		if s.auth != nil {
+			api.GET("/usage", s.Usage)
+		}
+	}
+
+	// Ollama compatible routes, committees are listed as local models
+	ollama := s.router.Group("/api")
+	{
+		ollama.POST("/chat", chatHandler.OllamaChat)
+		ollama.POST("/generate", chatHandler.OllamaGenerate)
+		ollama.GET("/tags", chatHandler.OllamaTags)
+		ollama.GET("/version", chatHandler.OllamaVersion)
 	}
 }
 
@@ -68,35 +251,47 @@ func (s *Server) registerRoutes() {
 func (s *Server) Start(ctx context.Context, port string) error {
 	server := &http.Server{
 		Addr:    ":" + port,
-		Handler: s.router,
+		Handler: s,
 	}
-	
+
 	// Start server in a goroutine
 	go func() {
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			slog.Error("Failed to start server", slog.Any("err", err))
 		}
 	}()
-	
+
 	slog.Info("Server started", slog.Any("port", port))
-	
+
 	// Wait for context cancellation
 	<-ctx.Done()
-	
+
 	// Shutdown server gracefully
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	
+
 	if err := server.Shutdown(shutdownCtx); err != nil {
 		slog.Error("Server shutdown error", slog.Any("err", err))
 		return err
 	}
-	
+
+	// Save what the committee and the keys hold in memory
+	current := s.routes.Load()
+	if err := current.committee.Close(); err != nil {
+		slog.Error("Failed to close committee", slog.Any("err", err))
+	}
+	if current.auth != nil {
+		if err := current.auth.Flush(); err != nil {
+			slog.Error("Failed to save key usage", slog.Any("err", err))
+		}
+	}
+
 	slog.Info("Server stopped")
 	return nil
 }
 
-// GetRouter returns the gin router for testing or other purposes
+// GetRouter returns the gin router of the current configuration for testing
+// or other purposes
 func (s *Server) GetRouter() *gin.Engine {
-	return s.router
-}
\ No newline at end of file
+	return s.routes.Load().router
+}
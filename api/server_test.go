@@ -0,0 +1,72 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"super-llm/config"
+	"super-llm/infra"
+)
+
+func TestReloadClosesAfterRequests(t *testing.T) {
+	var cfg *config.Config
+	s := newTestServer(t, func(c *config.Config) { cfg = c })
+	old := s.routes.Load()
+	if !old.enter() {
+		t.Fatal("current routes refused a request")
+	}
+
+	next := *cfg
+	next.Storage = &config.StorageConfig{Type: infra.StorageJSONL, Path: filepath.Join(t.TempDir(), "moved.jsonl")}
+	if err := s.Reload(context.Background(), &next); err != nil {
+		t.Fatal(err)
+	}
+	if old.enter() {
+		t.Error("retired routes took a new request")
+	}
+
+	record := &infra.Record{ID: "x", CreatedAt: time.Now(), Data: []byte("{}")}
+	if err := old.committee.Store.Put(context.Background(), record); err != nil {
+		t.Fatalf("storage closed under a request in flight: %v", err)
+	}
+	old.leave()
+	if err := old.committee.Store.Put(context.Background(), record); err == nil {
+		t.Error("replaced storage still open after the last request")
+	}
+}
+
+// TestReloadRejectedKeys keeps the current configuration when the keys of a
+// new one fail to load, and closes the committee built for it
+func TestReloadRejectedKeys(t *testing.T) {
+	var cfg *config.Config
+	s := newTestServer(t, func(c *config.Config) { cfg = c })
+	current := s.routes.Load()
+
+	path := filepath.Join(t.TempDir(), "moved.jsonl")
+	next := *cfg
+	next.Storage = &config.StorageConfig{Type: infra.StorageJSONL, Path: path}
+	next.Auth = &config.AuthConfig{KeyFile: filepath.Join(t.TempDir(), "missing.yaml")}
+	if err := s.Reload(context.Background(), &next); err == nil {
+		t.Fatal("reload with a missing key file succeeded")
+	}
+	if s.routes.Load() != current {
+		t.Error("rejected configuration replaced the routes")
+	}
+	if w := request(t, s, http.MethodPost, "/v1/chat/completions", "sk-b", nil, chatBody("alice")); w.Code != http.StatusOK {
+		t.Errorf("status %d after the rejected reload: %s", w.Code, w.Body)
+	}
+
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("open files not listed:", err)
+	}
+	for _, fd := range fds {
+		if target, _ := os.Readlink(filepath.Join("/proc/self/fd", fd.Name())); target == path {
+			t.Errorf("storage of the rejected committee still open")
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package cmd
+
+import (
+	"context"
+
+	"super-llm/config"
+
+	"github.com/pkg/errors"
+)
+
+// Run executes the named subcommand with its arguments
+func Run(ctx context.Context, name string, args []string) error {
+	switch name {
+	case "export":
+		return Export(ctx, config.GetConfig(), args)
+	case "eval":
+		return Eval(ctx, config.GetConfig(), args)
+	case "fake":
+		return Fake(ctx, args)
+	default:
+		return errors.Errorf("unknown command %s", name)
+	}
+}
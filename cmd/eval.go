@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"super-llm/config"
+	"super-llm/domain/committee"
+	"super-llm/domain/eval"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// evalRuns is the file listing the configurations to compare
+type evalRuns struct {
+	Runs []*eval.RunConfig `yaml:"runs"`
+}
+
+// Eval runs a JSONL dataset through several committee configurations and
+// reports their accuracy, latency and cost
+func Eval(ctx context.Context, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("eval", flag.ContinueOnError)
+	dataset := flags.String("dataset", "", "JSONL dataset of questions and reference answers")
+	runsPath := flags.String("runs", "", "YAML file of configurations, every member, strategy and preset by default")
+	scorer := flags.String("scorer", eval.ScorerExact, "default scorer: exact, numeric, regex or judge")
+	judge := flags.String("judge", "", "member grading answers for the judge scorer")
+	concurrency := flags.Int("concurrency", 4, "items evaluated in parallel")
+	output := flags.String("o", "", "write the full JSON report to this file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *dataset == "" {
+		return errors.New("-dataset is required")
+	}
+
+	file, err := os.Open(*dataset)
+	if err != nil {
+		return errors.Wrap(err, "open dataset")
+	}
+	items, err := eval.ReadDataset(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	domain, err := committee.BuildCommitteeDomain(ctx, cfg)
+	if err != nil {
+		return errors.Wrap(err, "build committee domain")
+	}
+	defer domain.Close()
+	// Evaluation runs leave no trace in caches, transcripts or ratings
+	domain.Cache = nil
+	if domain.Store != nil {
+		domain.Store.Close()
+		domain.Store = nil
+	}
+	domain.Reputation = nil
+	domain.Calibration = nil
+
+	runs := eval.DefaultRuns(domain, cfg.LeaderName)
+	if *runsPath != "" {
+		data, err := os.ReadFile(*runsPath)
+		if err != nil {
+			return errors.Wrap(err, "read runs")
+		}
+		var parsed evalRuns
+		if err := yaml.Unmarshal(data, &parsed); err != nil {
+			return errors.Wrap(err, "parse runs")
+		}
+		runs = parsed.Runs
+	}
+
+	runner := &eval.Runner{
+		Domain:      domain,
+		Scorer:      *scorer,
+		Judge:       *judge,
+		Concurrency: *concurrency,
+	}
+	report, err := runner.Run(ctx, items, runs)
+	if err != nil {
+		return err
+	}
+
+	if *output != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "encode report")
+		}
+		if err := os.WriteFile(*output, data, 0o644); err != nil {
+			return errors.Wrap(err, "write report")
+		}
+	}
+	printReport(report)
+	return nil
+}
+
+// printReport writes the comparison table to stdout
+func printReport(report *eval.Report) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "run\taccuracy\tcorrect\terrors\tmean ms\tp95 ms\ttokens\tcost\t")
+	for _, run := range report.Runs {
+		fmt.Fprintf(w, "%s\t%.1f%%\t%d/%d\t%d\t%d\t%d\t%d\t%.4f\t\n",
+			run.Name, run.Accuracy*100, run.Correct, run.Total, run.Errors,
+			run.MeanLatencyMS, run.P95LatencyMS, run.Usage.TotalTokens, run.Usage.Cost)
+	}
+	w.Flush()
+	if report.JudgeUsage.Calls > 0 {
+		fmt.Printf("judge: %d calls, %d tokens, cost %.4f\n",
+			report.JudgeUsage.Calls, report.JudgeUsage.TotalTokens, report.JudgeUsage.Cost)
+	}
+}
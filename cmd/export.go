@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"super-llm/config"
+	"super-llm/domain/committee"
+
+	"github.com/pkg/errors"
+)
+
+// Export writes stored deliberations as JSONL preference pairs or SFT examples
+func Export(ctx context.Context, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", committee.ExportDPO, "dpo or sft")
+	chosen := flags.String("chosen", committee.ChosenFinal, "chosen answer of dpo pairs: final or top")
+	model := flags.String("model", "", "only deliberations of this preset or leader")
+	since := flags.String("since", "", "only deliberations since this RFC 3339 time")
+	until := flags.String("until", "", "only deliberations before this RFC 3339 time")
+	minAgreement := flags.Float64("min-agreement", 0, "only deliberations whose opinions agreed at least this much")
+	feedback := flags.String("feedback", "", "any, positive, negative or none")
+	output := flags.String("o", "", "output file, stdout by default")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	opts := &committee.ExportOptions{
+		Format:       *format,
+		Chosen:       *chosen,
+		Model:        *model,
+		MinAgreement: *minAgreement,
+		Feedback:     *feedback,
+	}
+	var err error
+	if *since != "" {
+		if opts.Since, err = time.Parse(time.RFC3339, *since); err != nil {
+			return errors.Wrap(err, "parse since")
+		}
+	}
+	if *until != "" {
+		if opts.Until, err = time.Parse(time.RFC3339, *until); err != nil {
+			return errors.Wrap(err, "parse until")
+		}
+	}
+
+	domain, err := committee.BuildCommitteeDomain(ctx, cfg)
+	if err != nil {
+		return errors.Wrap(err, "build committee domain")
+	}
+	defer domain.Close()
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return errors.Wrap(err, "create output")
+		}
+		defer file.Close()
+		w = file
+	}
+	buf := bufio.NewWriter(w)
+	count, err := domain.ExportDeliberations(ctx, buf, opts)
+	if err != nil {
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		return errors.Wrap(err, "write output")
+	}
+	slog.Info("Exported deliberations", slog.Any("format", opts.Format), slog.Any("count", count))
+	return nil
+}
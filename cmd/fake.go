@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"os/signal"
+	"syscall"
+
+	"super-llm/infra/fake"
+)
+
+// Fake serves the scripted OpenAI-compatible backend
+func Fake(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("fake", flag.ContinueOnError)
+	addr := flags.String("addr", ":9101", "listen address")
+	script := flags.String("config", "", "YAML script of rules, replies, latency and errors")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	c := &fake.Config{}
+	if *script != "" {
+		var err error
+		if c, err = fake.LoadConfig(*script); err != nil {
+			return err
+		}
+	}
+	server, err := fake.NewServer(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	return server.Start(ctx, *addr)
+}
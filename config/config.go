@@ -4,24 +4,288 @@ import (
 	"fmt"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	LLMs []*LLMConfig `yaml:"llms"`
-	LeaderName string `yaml:"leader_name"`
+	LLMs       []*LLMConfig    `yaml:"llms"`
+	Members    []*MemberConfig `yaml:"members"`
+	LeaderName string          `yaml:"leader_name"`
+	// Prices maps a member or backend model name to its token prices
+	Prices map[string]*PriceConfig `yaml:"prices"`
+	// Presets are named committees that clients address as a model
+	Presets     []*PresetConfig    `yaml:"presets"`
+	Cascade     *CascadeConfig     `yaml:"cascade"`
+	Consensus   *ConsensusConfig   `yaml:"consensus"`
+	Cache       *CacheConfig       `yaml:"cache"`
+	Storage     *StorageConfig     `yaml:"storage"`
+	Reputation  *ReputationConfig  `yaml:"reputation"`
+	Calibration *CalibrationConfig `yaml:"calibration"`
+	Recorder    *RecorderConfig    `yaml:"recorder"`
+	Arena       *ArenaConfig       `yaml:"arena"`
+	Auth        *AuthConfig        `yaml:"auth"`
+	CORS        *CORSConfig        `yaml:"cors"`
+	// Limits bounds the committee runs in flight; tpm does not apply
+	Limits *LimitConfig `yaml:"limits"`
+}
+
+// LimitConfig bounds the load put on a backend. Requests over the limits
+// wait in a queue; 0 leaves a limit off.
+type LimitConfig struct {
+	MaxConcurrent int `yaml:"max_concurrent,omitempty"`
+	RPM           int `yaml:"rpm,omitempty"`
+	// TPM limits the estimated tokens of the requests started per minute
+	TPM int `yaml:"tpm,omitempty"`
+	// MaxQueue turns requests away once this many wait, unbounded when 0
+	MaxQueue int `yaml:"max_queue,omitempty"`
+	// MaxWait turns requests away that waited this long, unbounded when 0
+	MaxWait time.Duration `yaml:"max_wait,omitempty"`
+}
+
+// CORSConfig controls which browser origins may call the API
+type CORSConfig struct {
+	// AllowOrigins lists the allowed origins, every origin when empty
+	AllowOrigins []string `yaml:"allow_origins,omitempty"`
+}
+
+// AuthConfig requires an API key on every API request
+type AuthConfig struct {
+	// Keys are the accepted API keys
+	Keys []*APIKeyConfig `yaml:"keys"`
+	// KeyFile is a YAML list of further keys
+	KeyFile string `yaml:"key_file,omitempty"`
+	// UsagePath is the JSON file keeping the usage of every key, usage is
+	// only kept in memory when empty
+	UsagePath string `yaml:"usage_path,omitempty"`
+}
+
+// APIKeyConfig is an API key with its permissions and quotas
+type APIKeyConfig struct {
+	Key string `yaml:"key"`
+	// Name identifies the key in logs and usage reports
+	Name string `yaml:"name"`
+	// Presets and Members the key may address; a key listing neither may
+	// use the whole committee
+	Presets []string `yaml:"presets,omitempty"`
+	Members []string `yaml:"members,omitempty"`
+	// RPM limits the requests per minute, unlimited when 0
+	RPM int `yaml:"rpm,omitempty"`
+	// TokensPerDay limits the tokens spent per UTC day, unlimited when 0
+	TokensPerDay int64 `yaml:"tokens_per_day,omitempty"`
+	// Admin may read the usage of every key
+	Admin bool `yaml:"admin,omitempty"`
+}
+
+// ArenaConfig enables blind comparisons of members judged by human votes
+type ArenaConfig struct {
+	// Path is the JSON file holding the arena ratings
+	Path string `yaml:"path,omitempty"`
+	// K is the Elo K-factor, 16 by default
+	K float64 `yaml:"k,omitempty"`
+	// PeerReview has members rank each comparison too, feeding the ratings
+	// along with the votes
+	PeerReview bool `yaml:"peer_review,omitempty"`
+	// TTL is how long a comparison stays open for a vote, 24h by default
+	TTL time.Duration `yaml:"ttl,omitempty"`
+	// MaxOpen bounds the comparisons open for a vote, 10000 by default;
+	// the oldest is dropped to make room
+	MaxOpen int `yaml:"max_open,omitempty"`
+}
+
+// RecorderConfig records the backend traffic of every member to cassette
+// files, or replays a run from them
+type RecorderConfig struct {
+	// Mode is "record" or "replay"
+	Mode string `yaml:"mode"`
+	// Dir holds one cassette per member, "cassettes" by default
+	Dir string `yaml:"dir,omitempty"`
+}
+
+// CalibrationConfig enables tracking of reviewer biases
+type CalibrationConfig struct {
+	// Path is the JSON file holding the reviewer statistics
+	Path string `yaml:"path,omitempty"`
+	// DownWeight scales each reviewer's ranking by its calibration
+	DownWeight bool `yaml:"down_weight,omitempty"`
+	// MinReviews a reviewer needs before it is down-weighted, 5 by default
+	MinReviews int `yaml:"min_reviews,omitempty"`
+	// ExcludeSelf hides each reviewer's own opinion in the review phase
+	ExcludeSelf bool `yaml:"exclude_self,omitempty"`
+}
+
+// ReputationConfig enables long-term member ratings
+type ReputationConfig struct {
+	// Path is the JSON file holding the ratings
+	Path string `yaml:"path,omitempty"`
+	// K is the Elo K-factor, 16 by default
+	K float64 `yaml:"k,omitempty"`
+	// Select seats the highest rated members when a request names none
+	Select int `yaml:"select,omitempty"`
+	// Weights shows member weights to the leader
+	Weights bool `yaml:"weights,omitempty"`
+}
+
+// StorageConfig enables saving deliberation transcripts
+type StorageConfig struct {
+	// Type is "sqlite" (default) or "jsonl"
+	Type string `yaml:"type,omitempty"`
+	// Path is the database or JSONL file
+	Path string `yaml:"path,omitempty"`
+}
+
+// CacheConfig enables caching of committee answers
+type CacheConfig struct {
+	// Type is "memory" (LRU, default) or "disk"
+	Type string        `yaml:"type,omitempty"`
+	TTL  time.Duration `yaml:"ttl,omitempty"`
+	// MaxEntries bounds the memory cache
+	MaxEntries int `yaml:"max_entries,omitempty"`
+	// Dir is the directory of the disk cache
+	Dir string `yaml:"dir,omitempty"`
+}
+
+// ConsensusConfig tunes consensus detection across initial opinions
+type ConsensusConfig struct {
+	// ReviewThreshold is the agreement at which the review phase is skipped,
+	// 0 disables the shortcut
+	ReviewThreshold float64 `yaml:"review_threshold,omitempty"`
+	// FinalThreshold is the agreement at which the consensus opinion is
+	// returned directly without a final synthesis, 0 disables the shortcut
+	FinalThreshold float64 `yaml:"final_threshold,omitempty"`
+	// ClusterThreshold is the similarity for two opinions to share a position
+	ClusterThreshold float64 `yaml:"cluster_threshold,omitempty"`
+	// Embedding switches similarity from lexical to embedding cosine
+	Embedding *EmbeddingConfig `yaml:"embedding,omitempty"`
+}
+
+// EmbeddingConfig points to an OpenAI-compatible embeddings endpoint
+type EmbeddingConfig struct {
+	BaseURL string `yaml:"base_url"`
+	Model   string `yaml:"model"`
+	APIKey  string `yaml:"api_key"`
+}
+
+// CascadeConfig tunes the cascade strategy, which answers with a single
+// cheap member and escalates to the full committee on low confidence
+type CascadeConfig struct {
+	// Check is "agreement" with a second member or "self" assessment
+	Check string `yaml:"check,omitempty"`
+	// Threshold is the minimum agreement or confidence, in [0, 1]
+	Threshold float64 `yaml:"threshold,omitempty"`
+}
+
+// PresetConfig defines a named committee with its leader, members and budget
+type PresetConfig struct {
+	Name    string   `yaml:"name"`
+	Leader  string   `yaml:"leader"`
+	Members []string `yaml:"members,omitempty"`
+	// Strategy is "committee" (default) or "cascade"
+	Strategy string        `yaml:"strategy,omitempty"`
+	Budget   *BudgetConfig `yaml:"budget,omitempty"`
+}
+
+// BudgetConfig limits what a single committee run may spend
+type BudgetConfig struct {
+	MaxTokens int     `yaml:"max_tokens,omitempty"`
+	MaxCost   float64 `yaml:"max_cost,omitempty"`
+}
+
+// PriceConfig holds token prices per million tokens
+type PriceConfig struct {
+	Prompt     float64 `yaml:"prompt"`
+	Completion float64 `yaml:"completion"`
+}
+
+// Cost returns the price of a call with the given token counts
+func (p *PriceConfig) Cost(promptTokens, completionTokens int32) float64 {
+	return (float64(promptTokens)*p.Prompt + float64(completionTokens)*p.Completion) / 1e6
 }
 
 type LLMConfig struct {
-	BaseURL          string        `yaml:"base_url"`
-	Model            string        `yaml:"model"`
-	APIKey           string        `yaml:"api_key"`
-	MaxTokens        *int          `yaml:"max_tokens,omitempty"`
-	Temperature      *float32      `yaml:"temperature,omitempty"`
-	TopP             *float32      `yaml:"top_p,omitempty"`
-	PresencePenalty  *float32      `yaml:"presence_penalty,omitempty"`
-	FrequencyPenalty *float32      `yaml:"frequency_penalty,omitempty"`
+	// Provider is "openai" (default, any compatible endpoint), "anthropic",
+	// "gemini", "ollama" or "azure"
+	Provider string `yaml:"provider,omitempty"`
+	BaseURL  string `yaml:"base_url"`
+	Model    string `yaml:"model"`
+	APIKey   string `yaml:"api_key"`
+	// Deployment is the Azure OpenAI deployment, the model name by default
+	Deployment string `yaml:"deployment,omitempty"`
+	// APIVersion is the Azure api-version or the anthropic-version header
+	APIVersion string `yaml:"api_version,omitempty"`
+	// Headers are added to every backend request, e.g. for custom auth
+	Headers          map[string]string `yaml:"headers,omitempty"`
+	MaxTokens        *int              `yaml:"max_tokens,omitempty"`
+	Temperature      *float32          `yaml:"temperature,omitempty"`
+	TopP             *float32          `yaml:"top_p,omitempty"`
+	PresencePenalty  *float32          `yaml:"presence_penalty,omitempty"`
+	FrequencyPenalty *float32          `yaml:"frequency_penalty,omitempty"`
+	Seed             *int              `yaml:"seed,omitempty"`
+	// Limits are shared by every member using this backend
+	Limits *LimitConfig `yaml:"limits,omitempty"`
+}
+
+// MemberConfig defines a virtual committee member backed by one of the
+// configured LLMs. Several members may share one backend and differ only in
+// sampling parameters, persona and prompt variant.
+type MemberConfig struct {
+	Name             string   `yaml:"name"`
+	LLM              string   `yaml:"llm"`
+	MaxTokens        *int     `yaml:"max_tokens,omitempty"`
+	Temperature      *float32 `yaml:"temperature,omitempty"`
+	TopP             *float32 `yaml:"top_p,omitempty"`
+	PresencePenalty  *float32 `yaml:"presence_penalty,omitempty"`
+	FrequencyPenalty *float32 `yaml:"frequency_penalty,omitempty"`
+	Seed             *int     `yaml:"seed,omitempty"`
+	// Persona is sent as the system instruction of every call the member makes
+	Persona string `yaml:"persona,omitempty"`
+	// Prompt is a prompt variant appended to the question in the opinion phase
+	Prompt string `yaml:"prompt,omitempty"`
+}
+
+// FindLLM returns the LLM configuration with the given model name
+func (c *Config) FindLLM(name string) *LLMConfig {
+	for _, llmCfg := range c.LLMs {
+		if llmCfg.Model == name {
+			return llmCfg
+		}
+	}
+	return nil
+}
+
+// ResolveLLM returns the backend configuration of the member with its own
+// sampling parameters layered over the backend defaults
+func (m *MemberConfig) ResolveLLM(base *LLMConfig) *LLMConfig {
+	resolved := *base
+	if m.MaxTokens != nil {
+		resolved.MaxTokens = m.MaxTokens
+	}
+	if m.Temperature != nil {
+		resolved.Temperature = m.Temperature
+	}
+	if m.TopP != nil {
+		resolved.TopP = m.TopP
+	}
+	if m.PresencePenalty != nil {
+		resolved.PresencePenalty = m.PresencePenalty
+	}
+	if m.FrequencyPenalty != nil {
+		resolved.FrequencyPenalty = m.FrequencyPenalty
+	}
+	if m.Seed != nil {
+		resolved.Seed = m.Seed
+	}
+	return &resolved
+}
+
+// Path returns the path of the configuration file, taken from CONFIG_PATH
+func Path() string {
+	if configPath := os.Getenv("CONFIG_PATH"); configPath != "" {
+		return configPath
+	}
+	return "config/config.yaml"
 }
 
 func LoadConfig() (*Config, error) {
@@ -30,12 +294,7 @@ func LoadConfig() (*Config, error) {
 	var err error
 
 	once.Do(func() {
-		configPath := os.Getenv("CONFIG_PATH")
-		if configPath == "" {
-			configPath = "config/config.yaml"
-		}
-
-		data, readErr := os.ReadFile(configPath)
+		data, readErr := os.ReadFile(Path())
 		if readErr != nil {
 			err = fmt.Errorf("failed to read config file: %w", readErr)
 			return
@@ -51,19 +310,62 @@ func LoadConfig() (*Config, error) {
 	return cfg, err
 }
 
+// Validate checks what can be checked of a configuration without reaching
+// any backend, so that a broken file is rejected before it replaces a
+// working one
+func (c *Config) Validate() error {
+	if c == nil || len(c.LLMs) == 0 {
+		return fmt.Errorf("no llms configured")
+	}
+	models := map[string]bool{}
+	for _, llmCfg := range c.LLMs {
+		if llmCfg.Model == "" {
+			return fmt.Errorf("llm without model")
+		}
+		if models[llmCfg.Model] {
+			return fmt.Errorf("duplicate llm %s", llmCfg.Model)
+		}
+		models[llmCfg.Model] = true
+	}
+	for _, member := range c.Members {
+		if c.FindLLM(member.LLM) == nil {
+			return fmt.Errorf("member %s: llm %s not found", member.Name, member.LLM)
+		}
+	}
+	if c.Cascade != nil {
+		switch c.Cascade.Check {
+		case "", "agreement", "self":
+		default:
+			return fmt.Errorf("cascade: unknown check %q, want agreement or self", c.Cascade.Check)
+		}
+		if c.Cascade.Threshold < 0 || c.Cascade.Threshold > 1 {
+			return fmt.Errorf("cascade: threshold %v outside [0, 1]", c.Cascade.Threshold)
+		}
+	}
+	return nil
+}
+
 var (
-	globalConfig *Config
+	globalConfig atomic.Pointer[Config]
 	configOnce   sync.Once
 )
 
-// GetConfig returns the global config instance
+// GetConfig returns the global config instance, the latest one after a
+// reload
 func GetConfig() *Config {
 	configOnce.Do(func() {
 		cfg, err := LoadConfig()
 		if err != nil {
 			panic(fmt.Sprintf("failed to load config: %v", err))
 		}
-		globalConfig = cfg
+		globalConfig.Store(cfg)
 	})
-	return globalConfig
+	return globalConfig.Load()
+}
+
+// SetConfig replaces the global config instance once a reloaded
+// configuration is in use
+func SetConfig(cfg *Config) {
+	configOnce.Do(func() {})
+	globalConfig.Store(cfg)
 }
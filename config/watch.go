@@ -0,0 +1,70 @@
+package config
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// watchInterval is how often Watch looks at the configuration file
+const watchInterval = 2 * time.Second
+
+// Watch reports on the returned channel whenever the configuration file or
+// the key file of the configuration in use is modified, until ctx is done.
+// The files are polled, so that it also notices editors and deployments
+// that replace a file instead of writing it.
+func Watch(ctx context.Context) <-chan struct{} {
+	return watch(ctx, watchInterval, watchedFiles)
+}
+
+// watchedFiles lists the configuration file and the files it refers to
+func watchedFiles() []string {
+	files := []string{Path()}
+	if cfg := globalConfig.Load(); cfg != nil && cfg.Auth != nil && cfg.Auth.KeyFile != "" {
+		files = append(files, cfg.Auth.KeyFile)
+	}
+	return files
+}
+
+// watch polls the files listed by files every interval. A file joining the
+// list is taken as it is, only its later changes are reported.
+func watch(ctx context.Context, interval time.Duration, files func() []string) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	go func() {
+		last := map[string]os.FileInfo{}
+		for _, file := range files() {
+			last[file], _ = os.Stat(file)
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			changed := false
+			for _, file := range files() {
+				before, seen := last[file]
+				info, err := os.Stat(file)
+				if err != nil {
+					// The file may be missing while it is being replaced
+					continue
+				}
+				last[file] = info
+				if !seen || before != nil && info.ModTime().Equal(before.ModTime()) && info.Size() == before.Size() {
+					continue
+				}
+				changed = true
+			}
+			if !changed {
+				continue
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes
+}
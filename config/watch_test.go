@@ -0,0 +1,37 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	keyFile := filepath.Join(dir, "keys.yaml")
+	for _, file := range []string{configFile, keyFile} {
+		if err := os.WriteFile(file, []byte("a"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := watch(ctx, 10*time.Millisecond, func() []string { return []string{configFile, keyFile} })
+
+	select {
+	case <-changes:
+		t.Fatal("change reported for untouched files")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := os.WriteFile(keyFile, []byte("ab"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changes:
+	case <-time.After(2 * time.Second):
+		t.Fatal("key file change not reported")
+	}
+}
@@ -0,0 +1,287 @@
+package auth
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"encoding/json"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"super-llm/config"
+	"super-llm/infra"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// ErrForbidden is returned when a key may not use a preset or member
+	ErrForbidden = errors.New("forbidden")
+	// ErrRateLimited is returned when a key exceeds its requests per minute
+	ErrRateLimited = errors.New("rate limited")
+	// ErrQuotaExceeded is returned when a key spent its tokens of the day
+	ErrQuotaExceeded = errors.New("token quota exceeded")
+)
+
+// Usage is the usage of one API key
+type Usage struct {
+	Key              string  `json:"key"`
+	Requests         int64   `json:"requests"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	Cost             float64 `json:"cost"`
+	// Day is the UTC day TokensToday were spent on
+	Day         string `json:"day"`
+	TokensToday int64  `json:"tokens_today"`
+	// TokensPerDay is the daily quota of the key, 0 when unlimited
+	TokensPerDay int64 `json:"tokens_per_day,omitempty"`
+}
+
+// Auth checks API keys and keeps their rate limits, quotas and usage
+type Auth struct {
+	mu        sync.Mutex
+	keys      []*config.APIKeyConfig
+	usagePath string
+	// usage maps key names to their usage
+	usage map[string]*Usage
+	// requests holds the request times of every key within the last minute
+	requests map[string][]time.Time
+	// flusher writes the usage to usagePath, nil when usage is only kept in
+	// memory
+	flusher *infra.Flusher
+}
+
+// New loads the API keys of the configuration and the saved usage
+func New(c *config.AuthConfig) (*Auth, error) {
+	keys, err := LoadKeys(c)
+	if err != nil {
+		return nil, err
+	}
+	a := &Auth{
+		keys:      keys,
+		usagePath: c.UsagePath,
+		usage:     map[string]*Usage{},
+		requests:  map[string][]time.Time{},
+	}
+	if a.usagePath == "" {
+		return a, nil
+	}
+	a.flusher = infra.NewFlusher(a.usagePath, a.snapshot)
+	data, err := os.ReadFile(a.usagePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read key usage")
+	}
+	if err := json.Unmarshal(data, &a.usage); err != nil {
+		return nil, errors.Wrap(err, "decode key usage")
+	}
+	return a, nil
+}
+
+// LoadKeys reads the keys of the configuration and its key file, checking
+// that keys and names are set and unique
+func LoadKeys(c *config.AuthConfig) ([]*config.APIKeyConfig, error) {
+	keys := slices.Clone(c.Keys)
+	if c.KeyFile != "" {
+		data, err := os.ReadFile(c.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read key file")
+		}
+		var fileKeys []*config.APIKeyConfig
+		if err := yaml.Unmarshal(data, &fileKeys); err != nil {
+			return nil, errors.Wrap(err, "decode key file")
+		}
+		keys = append(keys, fileKeys...)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("auth enabled without keys")
+	}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if key.Key == "" || key.Name == "" {
+			return nil, errors.New("every key needs a key and a name")
+		}
+		if seen[key.Key] || seen["name:"+key.Name] {
+			return nil, errors.Errorf("duplicate key %s", key.Name)
+		}
+		seen[key.Key], seen["name:"+key.Name] = true, true
+	}
+	return keys, nil
+}
+
+// Reload replaces the keys with those of a new configuration. The usage and
+// rate windows of the keys are kept.
+func (a *Auth) Reload(c *config.AuthConfig) error {
+	keys, err := LoadKeys(c)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.keys = keys
+	var previous *infra.Flusher
+	if c.UsagePath != a.usagePath {
+		// The usage moves to the new file, the old one gets its last changes
+		previous = a.flusher
+		a.usagePath = c.UsagePath
+		a.flusher = nil
+		if a.usagePath != "" {
+			a.flusher = infra.NewFlusher(a.usagePath, a.snapshot)
+			a.flusher.Mark()
+		}
+	}
+	a.mu.Unlock()
+	if previous != nil {
+		return previous.Flush()
+	}
+	return nil
+}
+
+// Authenticate returns the key matching token, nil if there is none
+func (a *Auth) Authenticate(token string) *config.APIKeyConfig {
+	if token == "" {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, key := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(key.Key), []byte(token)) == 1 {
+			return key
+		}
+	}
+	return nil
+}
+
+// CheckAccess verifies that the key may address model, a preset when preset
+// is set and a member otherwise, and seat the given members
+func CheckAccess(key *config.APIKeyConfig, model string, preset bool, members []string) error {
+	if len(key.Presets) == 0 && len(key.Members) == 0 {
+		return nil
+	}
+	if model != "" {
+		allowed := key.Members
+		if preset {
+			allowed = key.Presets
+		}
+		if !slices.Contains(allowed, model) {
+			return errors.Wrapf(ErrForbidden, "model %s", model)
+		}
+	}
+	for _, member := range members {
+		if !slices.Contains(key.Members, member) {
+			return errors.Wrapf(ErrForbidden, "member %s", member)
+		}
+	}
+	return nil
+}
+
+// Allow counts a request of the key against its rate limit and quota. When
+// it is refused, the returned duration tells when to retry.
+func (a *Auth) Allow(key *config.APIKeyConfig) (time.Duration, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	usage := a.get(key, now)
+	if key.TokensPerDay > 0 && usage.TokensToday >= key.TokensPerDay {
+		tomorrow := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		return tomorrow.Sub(now), ErrQuotaExceeded
+	}
+	if key.RPM > 0 {
+		recent := slices.DeleteFunc(a.requests[key.Name], func(t time.Time) bool {
+			return now.Sub(t) >= time.Minute
+		})
+		a.requests[key.Name] = recent
+		if len(recent) >= key.RPM {
+			return recent[0].Add(time.Minute).Sub(now), ErrRateLimited
+		}
+		a.requests[key.Name] = append(recent, now)
+	}
+	usage.Requests++
+	a.changed()
+	return 0, nil
+}
+
+// RemainingTokens returns the tokens the key may still spend today, -1 when
+// it has no quota
+func (a *Auth) RemainingTokens(key *config.APIKeyConfig) int64 {
+	if key.TokensPerDay <= 0 {
+		return -1
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return max(key.TokensPerDay-a.get(key, time.Now()).TokensToday, 0)
+}
+
+// Record adds the usage of a backend call to the key
+func (a *Auth) Record(key *config.APIKeyConfig, prompt, completion int64, cost float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	usage := a.get(key, time.Now())
+	usage.PromptTokens += prompt
+	usage.CompletionTokens += completion
+	usage.TotalTokens += prompt + completion
+	usage.TokensToday += prompt + completion
+	usage.Cost += cost
+	a.changed()
+}
+
+// Usage reports the usage of the named key, or of every key when name is
+// empty
+func (a *Auth) Usage(name string) []*Usage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	var report []*Usage
+	for _, key := range a.keys {
+		if name != "" && key.Name != name {
+			continue
+		}
+		usage := *a.get(key, now)
+		usage.TokensPerDay = key.TokensPerDay
+		report = append(report, &usage)
+	}
+	slices.SortFunc(report, func(a, b *Usage) int { return cmp.Compare(a.Key, b.Key) })
+	return report
+}
+
+// get returns the usage of the key, starting a new day when it changed
+func (a *Auth) get(key *config.APIKeyConfig, now time.Time) *Usage {
+	usage := a.usage[key.Name]
+	if usage == nil {
+		usage = &Usage{Key: key.Name}
+		a.usage[key.Name] = usage
+	}
+	if day := now.UTC().Format(time.DateOnly); usage.Day != day {
+		usage.Day = day
+		usage.TokensToday = 0
+	}
+	return usage
+}
+
+// changed schedules saving the usage, with a.mu held
+func (a *Auth) changed() {
+	if a.flusher != nil {
+		a.flusher.Mark()
+	}
+}
+
+func (a *Auth) snapshot() ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return json.MarshalIndent(a.usage, "", "  ")
+}
+
+// Flush saves the usage not yet written
+func (a *Auth) Flush() error {
+	a.mu.Lock()
+	flusher := a.flusher
+	a.mu.Unlock()
+	if flusher == nil {
+		return nil
+	}
+	return flusher.Flush()
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"context"
+
+	"super-llm/config"
+)
+
+// Caller is the API key a request is made with. A nil Caller stands for an
+// open API, which may use and see everything.
+type Caller struct {
+	Key  *config.APIKeyConfig
+	auth *Auth
+}
+
+type callerKey struct{}
+
+// NewContext returns ctx carrying the caller of a request
+func NewContext(ctx context.Context, caller *Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// FromContext returns the caller of a request, nil when the API is open
+func FromContext(ctx context.Context) *Caller {
+	caller, _ := ctx.Value(callerKey{}).(*Caller)
+	return caller
+}
+
+// Caller returns the caller of a request made with key
+func (a *Auth) Caller(key *config.APIKeyConfig) *Caller {
+	return &Caller{Key: key, auth: a}
+}
+
+// Owner returns the key name deliberations of the caller are tagged with
+func (c *Caller) Owner() string {
+	if c == nil {
+		return ""
+	}
+	return c.Key.Name
+}
+
+// Scope returns the owner whose deliberations the caller may see, empty when
+// it may see all of them
+func (c *Caller) Scope() string {
+	if c == nil || c.Key.Admin {
+		return ""
+	}
+	return c.Key.Name
+}
+
+// Sees reports whether the caller may see a deliberation tagged with owner
+func (c *Caller) Sees(owner string) bool {
+	scope := c.Scope()
+	return scope == "" || scope == owner
+}
+
+// CheckAccess verifies that the caller may address model, a preset when
+// preset is set, and seat the given members
+func (c *Caller) CheckAccess(model string, preset bool, members []string) error {
+	if c == nil {
+		return nil
+	}
+	return CheckAccess(c.Key, model, preset, members)
+}
+
+// Members returns the members seated for the caller when a request names
+// none, nil when it may seat the whole committee
+func (c *Caller) Members() []string {
+	if c == nil {
+		return nil
+	}
+	return c.Key.Members
+}
+
+// Models lists the presets, then the members the caller may address, nil
+// when it may address any
+func (c *Caller) Models() []string {
+	if c == nil {
+		return nil
+	}
+	return append(append([]string(nil), c.Key.Presets...), c.Key.Members...)
+}
+
+// RemainingTokens returns the tokens the caller may still spend today, -1
+// when it has no quota
+func (c *Caller) RemainingTokens() int64 {
+	if c == nil {
+		return -1
+	}
+	return c.auth.RemainingTokens(c.Key)
+}
+
+// Charge adds the usage of a backend call to the caller's key
+func (c *Caller) Charge(prompt, completion int64, cost float64) {
+	if c == nil {
+		return
+	}
+	c.auth.Record(c.Key, prompt, completion, cost)
+}
@@ -0,0 +1,284 @@
+package committee
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"sync"
+	"time"
+
+	"super-llm/config"
+
+	"github.com/cv70/pkgo/llm"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// VoteTie is the winner of a vote that prefers no answer
+const VoteTie = "tie"
+
+const (
+	defaultArenaTTL     = 24 * time.Hour
+	defaultArenaMaxOpen = 10000
+	// arenaPruneInterval is how often expired battles are dropped
+	arenaPruneInterval = time.Minute
+)
+
+var (
+	// ErrBattleNotFound is returned for unknown or expired comparisons
+	ErrBattleNotFound = errors.New("battle not found")
+	// ErrInvalidVote is returned for votes that cannot be recorded
+	ErrInvalidVote = errors.New("invalid vote")
+)
+
+// Arena runs blind comparisons of members and rates them from human votes
+// and, optionally, from the members' own rankings of each comparison
+type Arena struct {
+	// Ratings are the arena Elo ratings, kept apart from the reputation
+	Ratings    *Reputation
+	peerReview bool
+	ttl        time.Duration
+	maxOpen    int
+
+	mu sync.Mutex
+	// battles are the comparisons still open for a vote
+	battles map[string]*Battle
+
+	// stop ends the pruning of expired battles
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// Battle is a blind comparison of member answers to one request
+type Battle struct {
+	ID      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Answers []*ArenaAnswer `json:"answers"`
+	Usage   *UsageReport   `json:"usage,omitempty"`
+
+	// members maps answer labels to the members behind them
+	members map[string]string
+	topics  []string
+	// ranking is the members' own ranking, once peer review finished
+	ranking []string
+}
+
+// ArenaAnswer is an anonymized answer of a battle
+type ArenaAnswer struct {
+	Label   string `json:"label"`
+	Content string `json:"content"`
+}
+
+// VoteResult reveals the members of a battle once voted on
+type VoteResult struct {
+	Battle string `json:"battle"`
+	// Winner is the winning member, or VoteTie
+	Winner string `json:"winner"`
+	// Members maps answer labels to member names
+	Members map[string]string `json:"members"`
+	// PeerRanking is the members' ranking of the battle, best first
+	PeerRanking []string        `json:"peer_ranking,omitempty"`
+	Leaderboard []*MemberRating `json:"leaderboard"`
+}
+
+// NewArena loads the arena ratings, starting empty if there are none
+func NewArena(c *config.ArenaConfig) (*Arena, error) {
+	return newArena(c, nil)
+}
+
+// newArena builds the arena of a configuration. The ratings of prev are
+// shared when they are kept in the same file, and its open battles are
+// carried over.
+func newArena(c *config.ArenaConfig, prev *Arena) (*Arena, error) {
+	path := c.Path
+	if path == "" {
+		path = "arena.json"
+	}
+	ratingsCfg := &config.ReputationConfig{Path: path, K: c.K}
+	var ratings *Reputation
+	if prev != nil {
+		ratings = prev.Ratings.reload(ratingsCfg)
+	}
+	if ratings == nil {
+		var err error
+		if ratings, err = NewReputation(ratingsCfg); err != nil {
+			return nil, err
+		}
+	}
+	a := &Arena{
+		Ratings:    ratings,
+		peerReview: c.PeerReview,
+		ttl:        c.TTL,
+		maxOpen:    c.MaxOpen,
+		battles:    map[string]*Battle{},
+		stop:       make(chan struct{}),
+	}
+	if a.ttl <= 0 {
+		a.ttl = defaultArenaTTL
+	}
+	if a.maxOpen <= 0 {
+		a.maxOpen = defaultArenaMaxOpen
+	}
+	if prev != nil {
+		prev.mu.Lock()
+		maps.Copy(a.battles, prev.battles)
+		prev.mu.Unlock()
+	}
+	go a.pruneLoop()
+	return a, nil
+}
+
+// Close stops pruning and saves the ratings
+func (a *Arena) Close() error {
+	a.closeOnce.Do(func() { close(a.stop) })
+	return a.Ratings.Flush()
+}
+
+// Compare collects the members' answers to the request through the opinion
+// phase and returns them shuffled and anonymized, without synthesis. With
+// peer review enabled the members rank the answers in the background.
+func (d *CommitteeDomain) Compare(ctx context.Context, req *llm.ChatCompletionRequest, opts *RunOptions) (*Battle, error) {
+	if req.Model == "" {
+		// The leader only summarizes the conversation for the members
+		req.Model = memberNames(d.Members)[0]
+		if models := opts.Caller.Models(); len(models) > 0 {
+			req.Model = models[0]
+		}
+	}
+	release, err := d.Runs.Acquire(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	c, err := d.BuildCommitteeContext(ctx, req, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "build committee context")
+	}
+	if err := d.GenerateConversationSummary(c); err != nil {
+		return nil, errors.Wrap(err, "generate summary")
+	}
+	if err := d.PlanBudget(c); err != nil {
+		return nil, err
+	}
+	if err := d.Phase1InitialOpinions(c); err != nil {
+		return nil, errors.Wrap(err, "phase 1")
+	}
+
+	battle := &Battle{
+		ID:      "battle_" + uuid.NewString(),
+		Object:  "arena.battle",
+		Created: time.Now().Unix(),
+		members: map[string]string{},
+		topics:  c.Topics,
+	}
+	for _, choice := range c.OpinionChoices(false) {
+		battle.Answers = append(battle.Answers, &ArenaAnswer{Label: choice.Member, Content: choice.Text})
+		battle.members[choice.Member] = choice.name
+	}
+	if len(battle.Answers) < 2 {
+		return nil, errors.New("fewer than two members answered")
+	}
+	battle.Usage = c.Usage.Report()
+	d.Arena.add(battle)
+
+	if d.Arena.peerReview {
+		c.Context = context.WithoutCancel(c.Context)
+		go d.peerReview(c, battle)
+	}
+	return battle, nil
+}
+
+// peerReview has the members rank the answers of a battle and rates them by
+// the resulting ranking
+func (d *CommitteeDomain) peerReview(c *CommitteeContext, battle *Battle) {
+	d.TrimOpinions(c)
+	if c.SkipReview {
+		return
+	}
+	if err := d.Phase2Review(c); err != nil {
+		slog.Error("arena peer review", slog.Any("battle", battle.ID), slog.Any("err", err))
+		return
+	}
+	d.rankOpinions(c)
+	d.Arena.Ratings.RecordRanking(c.Topics, c.Ranking)
+
+	d.Arena.mu.Lock()
+	battle.ranking = c.Ranking
+	d.Arena.mu.Unlock()
+}
+
+// add opens a battle for votes, dropping the oldest one when too many are
+// open
+func (a *Arena) add(battle *Battle) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for len(a.battles) >= a.maxOpen {
+		var oldest *Battle
+		for _, open := range a.battles {
+			if oldest == nil || open.Created < oldest.Created {
+				oldest = open
+			}
+		}
+		slog.Warn("too many open arena battles, dropping the oldest", slog.Any("battle", oldest.ID))
+		delete(a.battles, oldest.ID)
+	}
+	a.battles[battle.ID] = battle
+}
+
+// pruneLoop drops expired battles until the arena is closed
+func (a *Arena) pruneLoop() {
+	ticker := time.NewTicker(arenaPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.prune()
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// prune drops the battles whose time for a vote is over
+func (a *Arena) prune() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for id, open := range a.battles {
+		if time.Since(time.Unix(open.Created, 0)) > a.ttl {
+			delete(a.battles, id)
+		}
+	}
+}
+
+// Vote records the winner of a battle, an answer label or VoteTie, and
+// reveals its members. Every battle takes one vote.
+func (a *Arena) Vote(id, winner string) (*VoteResult, error) {
+	a.mu.Lock()
+	battle := a.battles[id]
+	if battle == nil || time.Since(time.Unix(battle.Created, 0)) > a.ttl {
+		a.mu.Unlock()
+		return nil, ErrBattleNotFound
+	}
+	if winner != VoteTie && battle.members[winner] == "" {
+		a.mu.Unlock()
+		return nil, errors.Wrapf(ErrInvalidVote, "unknown answer %s", winner)
+	}
+	delete(a.battles, id)
+	ranking := battle.ranking
+	a.mu.Unlock()
+
+	members := make([]string, 0, len(battle.members))
+	for _, answer := range battle.Answers {
+		members = append(members, battle.members[answer.Label])
+	}
+	result := &VoteResult{Battle: id, Winner: VoteTie, Members: battle.members, PeerRanking: ranking}
+	if winner == VoteTie {
+		a.Ratings.RecordTie(battle.topics, members)
+	} else {
+		result.Winner = battle.members[winner]
+		a.Ratings.RecordPreference(battle.topics, result.Winner, members)
+	}
+	result.Leaderboard = a.Ratings.Leaderboard(TopicAll, members)
+	return result, nil
+}
@@ -0,0 +1,32 @@
+package committee
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"super-llm/config"
+)
+
+func TestArenaOpenBattles(t *testing.T) {
+	arena, err := NewArena(&config.ArenaConfig{Path: filepath.Join(t.TempDir(), "arena.json"), TTL: time.Hour, MaxOpen: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer arena.Close()
+
+	now := time.Now()
+	for i := range 3 {
+		arena.add(&Battle{ID: fmt.Sprintf("b%d", i), Created: now.Add(time.Duration(i) * time.Second).Unix()})
+	}
+	if len(arena.battles) != 2 || arena.battles["b0"] != nil {
+		t.Fatalf("open battles %v, want the two newest", arena.battles)
+	}
+
+	arena.battles["b1"].Created = now.Add(-2 * time.Hour).Unix()
+	arena.prune()
+	if len(arena.battles) != 1 || arena.battles["b2"] == nil {
+		t.Fatalf("open battles %v after pruning, want b2", arena.battles)
+	}
+}
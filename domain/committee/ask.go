@@ -0,0 +1,47 @@
+package committee
+
+import (
+	"context"
+	"slices"
+
+	"github.com/cv70/pkgo/llm"
+	"github.com/pkg/errors"
+)
+
+// Ask sends a request straight to one member, bypassing the committee, and
+// returns the completion with its usage
+func (d *CommitteeDomain) Ask(ctx context.Context, name string, req *llm.ChatCompletionRequest) (*llm.ChatCompletionResponse, *UsageReport, error) {
+	member := d.Members[name]
+	if member == nil {
+		return nil, nil, errors.Errorf("member %s not found", name)
+	}
+	direct := *req
+	direct.Model = member.ModelName
+	direct.Stream = false
+	if member.Persona != "" && !slices.ContainsFunc(req.Messages, func(message *llm.ChatMessage) bool {
+		return message.Role == llm.RoleSystem
+	}) {
+		direct.Messages = append([]*llm.ChatMessage{{Role: llm.RoleSystem, Content: member.Persona}}, req.Messages...)
+	}
+
+	resp, err := member.DoRequest(ctx, &direct)
+	if err != nil {
+		return nil, nil, err
+	}
+	usage := newUsageTracker(d.Prices)
+	usage.RecordChat(PhaseFinal, member, resp.Usage)
+	return resp, usage.Report(), nil
+}
+
+// ReadResponse reads the final response of a blocking run into a completion
+// and records the leader's usage of the final phase. A leader answering with
+// an error status already failed the run with ErrLeaderStatus.
+func (c *CommitteeContext) ReadResponse() (*llm.ChatCompletionResponse, error) {
+	defer c.Response.Body.Close()
+	completion, err := ReadCompletion(c.Response.Body, false)
+	if err != nil {
+		return nil, err
+	}
+	c.Usage.RecordChat(PhaseFinal, c.Leader, completion.Usage)
+	return completion, nil
+}
@@ -0,0 +1,436 @@
+package committee
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"super-llm/config"
+	"super-llm/domain/auth"
+
+	"github.com/pkg/errors"
+	"google.golang.org/adk/model"
+	"google.golang.org/genai"
+)
+
+// promptOverheadTokens approximates the fixed instructions wrapped around the
+// question in review and final prompts
+const promptOverheadTokens = 128
+
+// completionPlans are the per-call completion allowances the planner tries,
+// longest first, before it gives up reviews or members
+var completionPlans = []int32{1024, 512, 256}
+
+// ErrBudgetTooSmall is returned when the budget of a run cannot cover a
+// single opinion and the final answer
+var ErrBudgetTooSmall = errors.New("budget too small for a single opinion")
+
+// Budget limits the tokens and cost a committee run may spend. Zero values
+// mean no limit.
+type Budget struct {
+	MaxTokens int32   `json:"max_tokens,omitempty"`
+	MaxCost   float64 `json:"max_cost,omitempty"`
+}
+
+// BudgetFromConfig converts a configured budget
+func BudgetFromConfig(c *config.BudgetConfig) *Budget {
+	if c == nil {
+		return nil
+	}
+	return &Budget{MaxTokens: int32(c.MaxTokens), MaxCost: c.MaxCost}
+}
+
+// QuotaBudget limits a run to the tokens left of the caller's daily quota,
+// nil when the caller has none
+func QuotaBudget(caller *auth.Caller) *Budget {
+	remaining := caller.RemainingTokens()
+	if remaining < 0 {
+		return nil
+	}
+	return &Budget{MaxTokens: int32(max(min(remaining, math.MaxInt32), 1))}
+}
+
+// Limited reports whether the budget sets any limit
+func (b *Budget) Limited() bool {
+	return b != nil && (b.MaxTokens > 0 || b.MaxCost > 0)
+}
+
+// Merge returns the stricter combination of two budgets
+func (b *Budget) Merge(o *Budget) *Budget {
+	if !b.Limited() {
+		return o
+	}
+	if !o.Limited() {
+		return b
+	}
+	merged := *b
+	if o.MaxTokens > 0 && (merged.MaxTokens == 0 || o.MaxTokens < merged.MaxTokens) {
+		merged.MaxTokens = o.MaxTokens
+	}
+	if o.MaxCost > 0 && (merged.MaxCost == 0 || o.MaxCost < merged.MaxCost) {
+		merged.MaxCost = o.MaxCost
+	}
+	return &merged
+}
+
+// Split shares the budget evenly among n runs. A limit too small to share
+// stays a limit, so that the runs fail their budget check.
+func (b *Budget) Split(n int) *Budget {
+	if !b.Limited() || n <= 1 {
+		return b
+	}
+	split := &Budget{MaxTokens: b.MaxTokens / int32(n), MaxCost: b.MaxCost / float64(n)}
+	if b.MaxTokens > 0 && split.MaxTokens == 0 {
+		split.MaxTokens = 1
+	}
+	return split
+}
+
+// BudgetReport describes how a run was fitted to its budget
+type BudgetReport struct {
+	Limit           *Budget  `json:"limit"`
+	PlannedMembers  int      `json:"planned_members"`
+	PlannedReview   bool     `json:"planned_review"`
+	CompletionLimit int32    `json:"completion_limit"`
+	TrimmedOpinions bool     `json:"trimmed_opinions,omitempty"`
+	CutShort        bool     `json:"cut_short"`
+	Reasons         []string `json:"reasons,omitempty"`
+}
+
+// spend is an amount of tokens and cost
+type spend struct {
+	tokens int32
+	cost   float64
+}
+
+func (s *spend) add(o spend) {
+	s.tokens += o.tokens
+	s.cost += o.cost
+}
+
+// BudgetTracker enforces the budget of a committee run. Calls reserve their
+// estimated spend before launch so concurrent calls cannot overrun the
+// limit, and a reservation is held back for the leader's final answer.
+type BudgetTracker struct {
+	mu       sync.Mutex
+	limit    *Budget
+	usage    *UsageTracker
+	inflight spend
+	final    spend
+	report   *BudgetReport
+}
+
+func newBudgetTracker(limit *Budget, usage *UsageTracker) *BudgetTracker {
+	return &BudgetTracker{
+		limit:  limit,
+		usage:  usage,
+		report: &BudgetReport{Limit: limit},
+	}
+}
+
+// Limited reports whether the run has a budget to enforce
+func (b *BudgetTracker) Limited() bool {
+	return b.limit.Limited()
+}
+
+// estimate prices a call to the member with the given token counts
+func (b *BudgetTracker) estimate(member *Member, promptTokens, completionTokens int32) spend {
+	e := spend{tokens: promptTokens + completionTokens}
+	if price := b.usage.price(member); price != nil {
+		e.cost = price.Cost(promptTokens, completionTokens)
+	}
+	return e
+}
+
+// within reports whether spent plus extra stays inside the limit
+func (b *BudgetTracker) within(extra spend) bool {
+	spent := b.usage.Totals()
+	if b.limit.MaxTokens > 0 && spent.TotalTokens+extra.tokens > b.limit.MaxTokens {
+		return false
+	}
+	if b.limit.MaxCost > 0 && spent.Cost+extra.cost > b.limit.MaxCost {
+		return false
+	}
+	return true
+}
+
+// Acquire reserves the estimated spend of a call before it is launched. It
+// returns false, and marks the run as cut short, when the call would eat
+// into the reservation for the final answer.
+func (b *BudgetTracker) Acquire(member *Member, promptTokens int32, what string) (spend, bool) {
+	if !b.Limited() {
+		return spend{}, true
+	}
+	completion := b.CompletionLimit()
+	if completion == 0 {
+		// Calls made before planning, such as cascade drafts
+		completion = completionPlans[1]
+	}
+	e := b.estimate(member, promptTokens, completion)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	total := b.inflight
+	total.add(b.final)
+	total.add(e)
+	if !b.within(total) {
+		b.cutShort(fmt.Sprintf("%s skipped: budget exhausted", what))
+		return spend{}, false
+	}
+	b.inflight.add(e)
+	return e, true
+}
+
+// Release returns a reservation once the call finished and its actual usage
+// has been recorded
+func (b *BudgetTracker) Release(e spend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inflight.tokens -= e.tokens
+	b.inflight.cost -= e.cost
+}
+
+// Remaining returns the spend left after usage and reservations
+func (b *BudgetTracker) Remaining() spend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.remaining()
+}
+
+func (b *BudgetTracker) remaining() spend {
+	spent := b.usage.Totals()
+	left := spend{tokens: math.MaxInt32, cost: math.Inf(1)}
+	if b.limit.MaxTokens > 0 {
+		left.tokens = b.limit.MaxTokens - spent.TotalTokens - b.inflight.tokens - b.final.tokens
+	}
+	if b.limit.MaxCost > 0 {
+		left.cost = b.limit.MaxCost - spent.Cost - b.inflight.cost - b.final.cost
+	}
+	return left
+}
+
+// CompletionLimit returns the planned completion allowance per call, or 0
+// when the run is not budgeted
+func (b *BudgetTracker) CompletionLimit() int32 {
+	return b.report.CompletionLimit
+}
+
+// Apply caps the completion length of a member request to the plan
+func (b *BudgetTracker) Apply(req *model.LLMRequest) *model.LLMRequest {
+	if limit := b.CompletionLimit(); limit > 0 {
+		if req.Config == nil {
+			req.Config = &genai.GenerateContentConfig{}
+		}
+		req.Config.MaxOutputTokens = limit
+	}
+	return req
+}
+
+// CutShort records that the run had to drop work to stay within budget
+func (b *BudgetTracker) CutShort(reason string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cutShort(reason)
+}
+
+func (b *BudgetTracker) cutShort(reason string) {
+	b.report.CutShort = true
+	b.report.Reasons = append(b.report.Reasons, reason)
+}
+
+// Report returns how the run was fitted to its budget, or nil when the run
+// was not budgeted
+func (b *BudgetTracker) Report() *BudgetReport {
+	if !b.Limited() {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	report := *b.report
+	report.Reasons = slices.Clone(b.report.Reasons)
+	return &report
+}
+
+// PlanBudget fits the committee to the budget once the question is known. It
+// prefers shorter completions over skipping the review phase, and skipping
+// reviews over seating fewer members, then reserves the final answer. It
+// fails with ErrBudgetTooSmall when not even one member fits.
+func (d *CommitteeDomain) PlanBudget(c *CommitteeContext) error {
+	b := c.Budget
+	if !b.Limited() {
+		return nil
+	}
+
+	// Seat the leader first, then the other members by name
+	candidates := slices.SortedFunc(c.GetMembers(), func(x, y *Member) int {
+		if x == c.Leader {
+			return -1
+		}
+		if y == c.Leader {
+			return 1
+		}
+		return strings.Compare(x.Name(), y.Name())
+	})
+	question := estimateTokens(c.MessageSummary)
+
+	var seated []*Member
+	var review bool
+	var completion int32
+plan:
+	for n := len(candidates); n >= 1; n-- {
+		for _, withReview := range []bool{true, false} {
+			if withReview && n < 2 {
+				continue
+			}
+			for _, limit := range completionPlans {
+				if b.within(d.estimatePlan(c, candidates[:n], question, withReview, limit)) {
+					seated, review, completion = candidates[:n], withReview, limit
+					break plan
+				}
+			}
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if seated == nil {
+		b.cutShort(ErrBudgetTooSmall.Error())
+		return ErrBudgetTooSmall
+	}
+	b.report.PlannedMembers = len(seated)
+	b.report.PlannedReview = review
+	b.report.CompletionLimit = completion
+	if len(seated) < len(candidates) {
+		b.report.Reasons = append(b.report.Reasons, fmt.Sprintf("members reduced from %d to %d", len(candidates), len(seated)))
+		c.Members = make(map[string]*Member, len(seated))
+		for _, member := range seated {
+			c.Members[member.Name()] = member
+		}
+	}
+	if !review && len(candidates) > 1 {
+		b.report.Reasons = append(b.report.Reasons, "review phase skipped")
+		c.SkipReview = true
+	}
+
+	// Hold back the final answer so earlier phases cannot spend it
+	opinions := int32(len(seated)) * completion
+	reviews := int32(0)
+	if review {
+		reviews = opinions
+	}
+	b.final = b.estimate(c.Leader, question+opinions+reviews+promptOverheadTokens, completion)
+	return nil
+}
+
+// estimatePlan estimates the spend of running the remaining phases with the
+// given members, review choice and completion allowance
+func (d *CommitteeDomain) estimatePlan(c *CommitteeContext, seated []*Member, question int32, review bool, completion int32) spend {
+	var total spend
+	for _, member := range seated {
+		total.add(c.Budget.estimate(member, question+estimateTokens(member.Prompt), completion))
+	}
+	opinions := int32(len(seated)) * completion
+	reviews := int32(0)
+	if review {
+		for _, member := range seated {
+			total.add(c.Budget.estimate(member, question+opinions+promptOverheadTokens, completion))
+		}
+		reviews = opinions
+	}
+	total.add(c.Budget.estimate(c.Leader, question+opinions+reviews+promptOverheadTokens, completion))
+	return total
+}
+
+// TrimOpinions shortens the opinions shown to reviewers and the leader when
+// the full texts would not fit the remaining budget
+func (d *CommitteeDomain) TrimOpinions(c *CommitteeContext) {
+	c.ReviewOpinions = c.Opinions
+	b := c.Budget
+	if !b.Limited() || c.SkipReview || len(c.Opinions) == 0 {
+		return
+	}
+
+	reviewers := int32(len(c.Members))
+	left := b.Remaining()
+	perReview := left.tokens / reviewers
+	if left.cost < math.Inf(1) {
+		if price := b.usage.price(c.Leader); price != nil && price.Prompt > 0 {
+			perReview = min(perReview, int32(left.cost/float64(reviewers)*1e6/price.Prompt))
+		}
+	}
+	perOpinion := (perReview - estimateTokens(c.MessageSummary) - promptOverheadTokens - b.CompletionLimit()) / int32(len(c.Opinions))
+	if perOpinion <= 0 {
+		b.CutShort("review phase skipped: no budget left for opinions")
+		c.SkipReview = true
+		return
+	}
+
+	trimmed := make(map[string]string, len(c.Opinions))
+	for name, opinion := range c.Opinions {
+		trimmed[name] = truncateTokens(opinion, perOpinion)
+		if trimmed[name] != opinion {
+			b.mu.Lock()
+			b.report.TrimmedOpinions = true
+			b.mu.Unlock()
+		}
+	}
+	c.ReviewOpinions = trimmed
+}
+
+// ReleaseFinal frees the final answer reservation and returns the completion
+// allowance left for the leader, or 0 when the run is not token budgeted. The
+// allowance never exceeds what remains; when nothing remains the leader is
+// held to a single token and the run is marked as cut short.
+func (b *BudgetTracker) ReleaseFinal(promptTokens int32) int32 {
+	if !b.Limited() {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.final = spend{}
+	if b.limit.MaxTokens == 0 {
+		return 0
+	}
+	left := b.remaining().tokens - promptTokens
+	if left < 1 {
+		b.cutShort("final answer cut: budget exhausted")
+		return 1
+	}
+	return left
+}
+
+// estimateTokens roughly counts tokens: ASCII text at four bytes per token,
+// other characters such as CJK at one token each
+func estimateTokens(s string) int32 {
+	var ascii, other int32
+	for _, r := range s {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return ascii/4 + other + 1
+}
+
+// truncateTokens cuts s down to roughly limit tokens
+func truncateTokens(s string, limit int32) string {
+	if estimateTokens(s) <= limit {
+		return s
+	}
+	var ascii, other int32
+	for i, r := range s {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+		if ascii/4+other >= limit {
+			return s[:i] + "……（已截断）"
+		}
+	}
+	return s
+}
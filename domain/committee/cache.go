@@ -0,0 +1,155 @@
+package committee
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cv70/pkgo/llm"
+)
+
+// Cache modes requested by the client
+const (
+	// CacheDefault serves cached answers and stores fresh ones
+	CacheDefault = ""
+	// CacheRefresh skips the lookup but stores the fresh answer (no-cache)
+	CacheRefresh = "refresh"
+	// CacheSkip neither reads nor writes the cache (no-store)
+	CacheSkip = "skip"
+)
+
+// Cache statuses reported to the client
+const (
+	CacheHit    = "HIT"
+	CacheMiss   = "MISS"
+	CacheBypass = "BYPASS"
+)
+
+// cacheEntry is a committee answer stored in the response cache
+type cacheEntry struct {
+	Completion *llm.ChatCompletionResponse `json:"completion"`
+	// Deliberation is the ID of the run that produced the answer
+	Deliberation string `json:"deliberation,omitempty"`
+	// Opinions and Ranking let a hit return the opinions as choices too
+	Opinions  map[string]string `json:"opinions,omitempty"`
+	Ranking   []string          `json:"ranking,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// cacheKeyInput is the normalized form of everything that shapes an answer
+type cacheKeyInput struct {
+	// Owner keeps the answers of API keys apart, so that the deliberation
+	// of a hit belongs to the caller
+	Owner          string                  `json:"owner,omitempty"`
+	Leader         string                  `json:"leader"`
+	Preset         string                  `json:"preset,omitempty"`
+	Members        []string                `json:"members"`
+	Strategy       string                  `json:"strategy"`
+	Budget         *Budget                 `json:"budget,omitempty"`
+	Messages       []*llm.ChatMessage      `json:"messages"`
+	Tools          []*llm.ChatTool         `json:"tools,omitempty"`
+	Temperature    *float32                `json:"temperature,omitempty"`
+	MaxTokens      *int32                  `json:"max_tokens,omitempty"`
+	TopP           *float32                `json:"top_p,omitempty"`
+	Stop           []string                `json:"stop,omitempty"`
+	ResponseFormat *llm.ChatResponseFormat `json:"response_format,omitempty"`
+}
+
+// CacheKey hashes the normalized request. Stream mode is left out so that
+// streamed and blocking requests share entries.
+func (d *CommitteeDomain) CacheKey(c *CommitteeContext) string {
+	input := cacheKeyInput{
+		Owner:          c.Owner,
+		Leader:         c.Leader.Name(),
+		Members:        memberNames(c.Members),
+		Strategy:       c.Strategy,
+		Budget:         c.Budget.limit,
+		Tools:          c.Request.Tools,
+		Temperature:    c.Request.Temperature,
+		MaxTokens:      c.Request.MaxTokens,
+		TopP:           c.Request.TopP,
+		Stop:           c.Request.Stop,
+		ResponseFormat: c.Request.ResponseFormat,
+	}
+	if d.Presets[c.Model] != nil {
+		input.Preset = c.Model
+	}
+	for _, message := range c.Messages {
+		normalized := *message
+		if text, ok := message.Content.(string); ok {
+			normalized.Content = strings.TrimSpace(text)
+		}
+		input.Messages = append(input.Messages, &normalized)
+	}
+
+	data, _ := json.Marshal(&input)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// LookupCache serves the request from the cache when allowed. On a miss the
+// answer is stored by finishResponse once it has been read completely.
+func (d *CommitteeDomain) LookupCache(c *CommitteeContext, mode string) bool {
+	if d.Cache == nil {
+		return false
+	}
+	if mode == CacheSkip {
+		c.CacheStatus = CacheBypass
+		return false
+	}
+	c.CacheKey = d.CacheKey(c)
+	if mode == CacheRefresh {
+		c.CacheStatus = CacheBypass
+		return false
+	}
+
+	data, ok := d.Cache.Get(c.CacheKey)
+	if !ok {
+		c.CacheStatus = CacheMiss
+		return false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Completion == nil {
+		slog.Error("decode cache entry", slog.Any("key", c.CacheKey), slog.Any("err", err))
+		c.CacheStatus = CacheMiss
+		return false
+	}
+	c.CacheStatus = CacheHit
+	if entry.Deliberation != "" {
+		c.ID = entry.Deliberation
+	}
+	c.Opinions, c.Ranking = entry.Opinions, entry.Ranking
+	c.Response = NewCompletionResponse(entry.Completion, c.Request.Stream)
+	return true
+}
+
+// cacheable reports whether the answer of this run may be cached. Runs cut
+// short by the budget are not cached.
+func (d *CommitteeDomain) cacheable(c *CommitteeContext) bool {
+	if d.Cache == nil || c.CacheKey == "" || c.CacheStatus == CacheHit {
+		return false
+	}
+	if c.Response.StatusCode != http.StatusOK {
+		return false
+	}
+	report := c.Budget.Report()
+	return report == nil || !report.CutShort
+}
+
+// storeCache caches the completion the client received
+func (d *CommitteeDomain) storeCache(c *CommitteeContext, completion *llm.ChatCompletionResponse) {
+	if CompletionText(completion) == "" {
+		return
+	}
+	entry := cacheEntry{Completion: completion, Deliberation: c.ID, Opinions: c.Opinions, Ranking: c.Ranking, CreatedAt: time.Now()}
+	entry.Completion.Usage = nil
+	value, err := json.Marshal(&entry)
+	if err != nil {
+		return
+	}
+	d.Cache.Set(c.CacheKey, value, d.CacheTTL)
+}
@@ -0,0 +1,57 @@
+package committee
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"super-llm/config"
+	"super-llm/domain/auth"
+	"super-llm/infra"
+	"super-llm/infra/fake"
+)
+
+// TestCachePerCaller serves a cached answer only to the key that asked, so
+// that the deliberation of a hit is visible to its caller
+func TestCachePerCaller(t *testing.T) {
+	d := newFakeDomain(t, &fake.Config{}, func(cfg *config.Config) {
+		cfg.Storage = &config.StorageConfig{Type: infra.StorageJSONL, Path: filepath.Join(t.TempDir(), "deliberations.jsonl")}
+		cfg.Cache = &config.CacheConfig{TTL: time.Minute}
+	})
+	keys, err := auth.New(&config.AuthConfig{Keys: []*config.APIKeyConfig{
+		{Key: "sk-a", Name: "team-a"},
+		{Key: "sk-b", Name: "team-b"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := keys.Caller(keys.Authenticate("sk-a")), keys.Caller(keys.Authenticate("sk-b"))
+
+	run := func(caller *auth.Caller) *CommitteeContext {
+		t.Helper()
+		c, err := d.RunCommitteeProcess(context.Background(), question(), &RunOptions{Caller: caller})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.ReadResponse(); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	first := run(a)
+	if first.CacheStatus != CacheMiss {
+		t.Fatalf("first run cache %s, want %s", first.CacheStatus, CacheMiss)
+	}
+	other := run(b)
+	if other.CacheStatus != CacheMiss || other.ID == first.ID {
+		t.Errorf("other key cache %s with deliberation %s, want a miss of its own", other.CacheStatus, other.ID)
+	}
+	if _, err := d.GetDeliberationFor(context.Background(), b, other.ID); err != nil {
+		t.Errorf("other key cannot read its deliberation: %v", err)
+	}
+	again := run(a)
+	if again.CacheStatus != CacheHit || again.ID != first.ID {
+		t.Errorf("same key cache %s with deliberation %s, want a hit of %s", again.CacheStatus, again.ID, first.ID)
+	}
+}
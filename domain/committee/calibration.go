@@ -0,0 +1,280 @@
+package committee
+
+import (
+	"cmp"
+	"encoding/json"
+	"math"
+	"os"
+	"slices"
+	"sync"
+
+	"super-llm/config"
+	"super-llm/infra"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultMinReviews = 5
+	minReviewerWeight = 0.1
+)
+
+// reviewerTally accumulates a reviewer's behaviour across deliberations
+type reviewerTally struct {
+	Reviews int `json:"reviews"`
+	// SelfReviews counts reviews in which the reviewer saw its own opinion
+	SelfReviews int `json:"self_reviews"`
+	SelfFirst   int `json:"self_first"`
+	// SelfExpected sums the chance of ranking itself first by luck
+	SelfExpected float64 `json:"self_expected"`
+	Agreement    float64 `json:"agreement"`
+	LengthBias   float64 `json:"length_bias"`
+	// Family sums how many places better than the committee the reviewer
+	// ranks each backend model
+	Family      map[string]float64 `json:"family,omitempty"`
+	FamilyCount map[string]int     `json:"family_count,omitempty"`
+}
+
+// ReviewerStats describes how well calibrated a reviewer is
+type ReviewerStats struct {
+	Reviewer string `json:"reviewer"`
+	Reviews  int    `json:"reviews"`
+	// SelfFirstRate is how often the reviewer ranks its own opinion first,
+	// against ExpectedSelfFirstRate for an unbiased reviewer
+	SelfFirstRate         float64 `json:"self_first_rate"`
+	ExpectedSelfFirstRate float64 `json:"expected_self_first_rate"`
+	// Agreement is the mean Kendall tau with the committee ranking
+	Agreement float64 `json:"agreement"`
+	// LengthBias is the mean rank correlation between answer length and
+	// the reviewer's ranking; positive favours longer answers
+	LengthBias float64 `json:"length_bias"`
+	// FamilyBias is the mean number of places each backend model is ranked
+	// above the committee ranking
+	FamilyBias map[string]float64 `json:"family_bias,omitempty"`
+	// Weight scales the reviewer's ranking in the aggregation
+	Weight float64 `json:"weight"`
+}
+
+// Calibration tracks reviewer biases and turns them into ranking weights
+type Calibration struct {
+	// mu guards the tallies, shared by the calibrations of reloads
+	mu         *sync.RWMutex
+	path       string
+	minReviews int
+	tallies    map[string]*reviewerTally
+	flusher    *infra.Flusher
+
+	// DownWeight scales each reviewer's ranking by its calibration
+	DownWeight bool
+	// ExcludeSelf hides each reviewer's own opinion in the review phase
+	ExcludeSelf bool
+}
+
+// NewCalibration loads the reviewer statistics, starting empty if the file
+// does not exist
+func NewCalibration(c *config.CalibrationConfig) (*Calibration, error) {
+	cal := &Calibration{
+		mu:      &sync.RWMutex{},
+		path:    calibrationPath(c),
+		tallies: map[string]*reviewerTally{},
+	}
+	cal.configure(c)
+	cal.flusher = infra.NewFlusher(cal.path, cal.snapshot)
+	data, err := os.ReadFile(cal.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cal, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read calibration")
+	}
+	if err := json.Unmarshal(data, &cal.tallies); err != nil {
+		return nil, errors.Wrap(err, "decode calibration")
+	}
+	return cal, nil
+}
+
+// reload returns the calibration of a new configuration. A configuration of
+// the same file shares the tallies with cal, so that the file keeps a single
+// writer; nil is returned for another file.
+func (cal *Calibration) reload(c *config.CalibrationConfig) *Calibration {
+	if cal == nil || cal.path != calibrationPath(c) {
+		return nil
+	}
+	next := &Calibration{mu: cal.mu, path: cal.path, tallies: cal.tallies, flusher: cal.flusher}
+	next.configure(c)
+	return next
+}
+
+// configure applies the settings of the configuration
+func (cal *Calibration) configure(c *config.CalibrationConfig) {
+	cal.minReviews = c.MinReviews
+	if cal.minReviews <= 0 {
+		cal.minReviews = defaultMinReviews
+	}
+	cal.DownWeight = c.DownWeight
+	cal.ExcludeSelf = c.ExcludeSelf
+}
+
+func calibrationPath(c *config.CalibrationConfig) string {
+	if c.Path == "" {
+		return "calibration.json"
+	}
+	return c.Path
+}
+
+// Record updates the statistics of every reviewer from one deliberation.
+// lengths and families describe the ranked opinions and their members.
+func (cal *Calibration) Record(rankings map[string][]string, consensus []string, lengths map[string]int, families map[string]string) {
+	if len(consensus) < 2 {
+		return
+	}
+	cal.mu.Lock()
+	defer cal.mu.Unlock()
+	for reviewer, ranking := range rankings {
+		if len(ranking) < 2 {
+			continue
+		}
+		tally := cal.tallies[reviewer]
+		if tally == nil {
+			tally = &reviewerTally{}
+			cal.tallies[reviewer] = tally
+		}
+		tally.Reviews++
+		tally.Agreement += kendallTau(ranking, consensus)
+		tally.LengthBias += lengthCorrelation(ranking, lengths)
+		if slices.Contains(ranking, reviewer) {
+			tally.SelfReviews++
+			tally.SelfExpected += 1 / float64(len(ranking))
+			if ranking[0] == reviewer {
+				tally.SelfFirst++
+			}
+		}
+		for i, name := range ranking {
+			family := families[name]
+			if family == "" || name == reviewer {
+				continue
+			}
+			if tally.Family == nil {
+				tally.Family = map[string]float64{}
+				tally.FamilyCount = map[string]int{}
+			}
+			tally.Family[family] += float64(slices.Index(consensus, name) - i)
+			tally.FamilyCount[family]++
+		}
+	}
+	cal.flusher.Mark()
+}
+
+func (cal *Calibration) snapshot() ([]byte, error) {
+	cal.mu.RLock()
+	defer cal.mu.RUnlock()
+	return json.MarshalIndent(cal.tallies, "", "  ")
+}
+
+// Flush saves the statistics not yet written
+func (cal *Calibration) Flush() error {
+	return cal.flusher.Flush()
+}
+
+// Stats reports the calibration of every tracked reviewer
+func (cal *Calibration) Stats() []*ReviewerStats {
+	cal.mu.RLock()
+	defer cal.mu.RUnlock()
+	stats := make([]*ReviewerStats, 0, len(cal.tallies))
+	for reviewer, tally := range cal.tallies {
+		stats = append(stats, cal.stats(reviewer, tally))
+	}
+	slices.SortFunc(stats, func(a, b *ReviewerStats) int {
+		return cmp.Compare(a.Reviewer, b.Reviewer)
+	})
+	return stats
+}
+
+func (cal *Calibration) stats(reviewer string, tally *reviewerTally) *ReviewerStats {
+	stats := &ReviewerStats{
+		Reviewer:   reviewer,
+		Reviews:    tally.Reviews,
+		Agreement:  tally.Agreement / float64(tally.Reviews),
+		LengthBias: tally.LengthBias / float64(tally.Reviews),
+		Weight:     1,
+	}
+	if tally.SelfReviews > 0 {
+		stats.SelfFirstRate = float64(tally.SelfFirst) / float64(tally.SelfReviews)
+		stats.ExpectedSelfFirstRate = tally.SelfExpected / float64(tally.SelfReviews)
+	}
+	for family, sum := range tally.Family {
+		if stats.FamilyBias == nil {
+			stats.FamilyBias = map[string]float64{}
+		}
+		stats.FamilyBias[family] = sum / float64(tally.FamilyCount[family])
+	}
+	if tally.Reviews < cal.minReviews {
+		return stats
+	}
+
+	// Agreement maps tau from [-1, 1] to [0, 1]; excess self preference and
+	// length bias each take their share off
+	weight := (1 + stats.Agreement) / 2
+	if excess := stats.SelfFirstRate - stats.ExpectedSelfFirstRate; excess > 0 {
+		weight *= 1 - excess
+	}
+	weight *= 1 - math.Abs(stats.LengthBias)/2
+	stats.Weight = max(weight, minReviewerWeight)
+	return stats
+}
+
+// Weights returns the ranking weight of each reviewer, 1 for reviewers
+// without enough history
+func (cal *Calibration) Weights(reviewers []string) map[string]float64 {
+	cal.mu.RLock()
+	defer cal.mu.RUnlock()
+	weights := map[string]float64{}
+	for _, reviewer := range reviewers {
+		weights[reviewer] = 1
+		if tally := cal.tallies[reviewer]; tally != nil && tally.Reviews > 0 {
+			weights[reviewer] = cal.stats(reviewer, tally).Weight
+		}
+	}
+	return weights
+}
+
+// kendallTau compares a ranking with the consensus over the items it ranks
+func kendallTau(ranking, consensus []string) float64 {
+	var concordant, discordant int
+	for i := range ranking {
+		for j := i + 1; j < len(ranking); j++ {
+			a, b := slices.Index(consensus, ranking[i]), slices.Index(consensus, ranking[j])
+			switch {
+			case a < 0 || b < 0:
+			case a < b:
+				concordant++
+			case a > b:
+				discordant++
+			}
+		}
+	}
+	if concordant+discordant == 0 {
+		return 0
+	}
+	return float64(concordant-discordant) / float64(concordant+discordant)
+}
+
+// lengthCorrelation is the Kendall tau between a ranking and answer length,
+// positive when longer answers are ranked higher. Equal lengths are ties.
+func lengthCorrelation(ranking []string, lengths map[string]int) float64 {
+	var concordant, discordant int
+	for i := range ranking {
+		for j := i + 1; j < len(ranking); j++ {
+			switch cmp.Compare(lengths[ranking[i]], lengths[ranking[j]]) {
+			case 1:
+				concordant++
+			case -1:
+				discordant++
+			}
+		}
+	}
+	if concordant+discordant == 0 {
+		return 0
+	}
+	return float64(concordant-discordant) / float64(concordant+discordant)
+}
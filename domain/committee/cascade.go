@@ -0,0 +1,248 @@
+package committee
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"super-llm/config"
+
+	"github.com/cv70/pkgo/llm"
+	"github.com/pkg/errors"
+)
+
+// Strategies a committee run can follow
+const (
+	StrategyCommittee = "committee"
+	StrategyCascade   = "cascade"
+)
+
+// Cascade checks that decide whether a cheap answer is good enough
+const (
+	CascadeCheckAgreement = "agreement"
+	CascadeCheckSelf      = "self"
+)
+
+// PhaseCascade is the usage phase of the cascade's first answers and checks
+const PhaseCascade = "cascade"
+
+const defaultCascadeThreshold = 0.6
+
+// CascadeReport records the decision taken by the cascade strategy
+type CascadeReport struct {
+	Member    string  `json:"member"`
+	Checker   string  `json:"checker,omitempty"`
+	Check     string  `json:"check"`
+	Score     float64 `json:"score"`
+	Threshold float64 `json:"threshold"`
+	Escalated bool    `json:"escalated"`
+	Reason    string  `json:"reason"`
+}
+
+// RunCascade answers with the cheapest member when a second opinion agrees
+// with it, or when the member is confident in its own answer, and escalates
+// to the full committee otherwise
+func (d *CommitteeDomain) RunCascade(c *CommitteeContext) error {
+	cfg := d.Cascade
+	if cfg == nil {
+		cfg = &config.CascadeConfig{}
+	}
+	report := &CascadeReport{Check: cfg.Check, Threshold: cfg.Threshold}
+	if report.Threshold == 0 {
+		report.Threshold = defaultCascadeThreshold
+	}
+	c.Cascade = report
+
+	candidates := d.cheapestMembers(c)
+	if report.Check == "" {
+		report.Check = CascadeCheckAgreement
+		if len(candidates) < 2 {
+			report.Check = CascadeCheckSelf
+		}
+	}
+	if report.Check == CascadeCheckAgreement && len(candidates) < 2 {
+		return errors.New("agreement check needs at least two members")
+	}
+	report.Member = candidates[0].Name()
+
+	// Draft an answer, with a second member answering alongside it
+	var answers [2]*llm.ChatCompletionResponse
+	var errs [2]error
+	var wg sync.WaitGroup
+	drafters := candidates[:1]
+	if report.Check == CascadeCheckAgreement {
+		drafters = candidates[:2]
+		report.Checker = candidates[1].Name()
+	}
+	for i, member := range drafters {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			answers[i], errs[i] = d.draftAnswer(c, member)
+		}()
+	}
+	wg.Wait()
+
+	failed := true
+	switch {
+	case errs[0] != nil:
+		slog.Error("cascade draft", slog.Any("member", report.Member), slog.Any("err", errs[0]))
+		report.Reason = "first answer failed"
+	case report.Check == CascadeCheckAgreement && errs[1] != nil:
+		slog.Error("cascade draft", slog.Any("member", report.Checker), slog.Any("err", errs[1]))
+		report.Reason = "second answer failed"
+	case report.Check == CascadeCheckAgreement:
+		report.Score = lexicalSimilarity(CompletionText(answers[0]), CompletionText(answers[1]))
+		report.Reason = fmt.Sprintf("agreement %.2f with %s", report.Score, report.Checker)
+		failed = false
+	default:
+		report.Checker = report.Member
+		score, err := d.selfCheck(c, candidates[0], CompletionText(answers[0]))
+		if err != nil {
+			slog.Error("cascade self check", slog.Any("member", report.Member), slog.Any("err", err))
+			report.Reason = "self check failed"
+			break
+		}
+		report.Score = score
+		report.Reason = fmt.Sprintf("self-assessed confidence %.2f", score)
+		failed = false
+	}
+
+	if !failed && report.Score >= report.Threshold {
+		c.Response = NewCompletionResponse(answers[0], c.Request.Stream)
+		return nil
+	}
+
+	// Low confidence or disagreement: run the full committee
+	report.Escalated = true
+	if !failed {
+		report.Reason += fmt.Sprintf(", below threshold %.2f", report.Threshold)
+	}
+	return d.Deliberate(c)
+}
+
+// cheapestMembers orders the seated members by their token prices, with the
+// leader first among equally priced or unpriced members
+func (d *CommitteeDomain) cheapestMembers(c *CommitteeContext) []*Member {
+	cost := func(member *Member) float64 {
+		if price := c.Usage.price(member); price != nil {
+			return price.Prompt + price.Completion
+		}
+		return math.MaxFloat64
+	}
+	return slices.SortedFunc(c.GetMembers(), func(x, y *Member) int {
+		if cx, cy := cost(x), cost(y); cx != cy {
+			if cx < cy {
+				return -1
+			}
+			return 1
+		}
+		if x == c.Leader {
+			return -1
+		}
+		if y == c.Leader {
+			return 1
+		}
+		return strings.Compare(x.Name(), y.Name())
+	})
+}
+
+// draftAnswer asks a member to answer the client's conversation directly
+func (d *CommitteeDomain) draftAnswer(c *CommitteeContext, member *Member) (*llm.ChatCompletionResponse, error) {
+	var prompt strings.Builder
+	for _, message := range c.Messages {
+		if text, ok := message.Content.(string); ok {
+			prompt.WriteString(text)
+		}
+	}
+	reserved, ok := c.Budget.Acquire(member, estimateTokens(prompt.String()), "cascade answer of "+member.Name())
+	if !ok {
+		return nil, errors.New("budget exhausted")
+	}
+	defer c.Budget.Release(reserved)
+
+	messages := c.Messages
+	if member.Persona != "" && !slices.ContainsFunc(messages, func(message *llm.ChatMessage) bool {
+		return message.Role == llm.RoleSystem
+	}) {
+		messages = append([]*llm.ChatMessage{{Role: llm.RoleSystem, Content: member.Persona}}, messages...)
+	}
+	req := &llm.ChatCompletionRequest{
+		Model:       member.ModelName,
+		Messages:    messages,
+		Temperature: c.Request.Temperature,
+		MaxTokens:   c.Request.MaxTokens,
+		TopP:        c.Request.TopP,
+		Stop:        c.Request.Stop,
+	}
+	if limit := c.Budget.CompletionLimit(); limit > 0 && (req.MaxTokens == nil || *req.MaxTokens > limit) {
+		req.MaxTokens = &limit
+	}
+
+	resp, err := member.DoRequest(c, req)
+	if err != nil {
+		return nil, err
+	}
+	c.Usage.RecordChat(PhaseCascade, member, resp.Usage)
+	if CompletionText(resp) == "" {
+		return nil, errors.Errorf("empty answer from %v", member.Name())
+	}
+	return resp, nil
+}
+
+var confidencePattern = regexp.MustCompile(`\d+(\.\d+)?`)
+
+// selfCheck asks a member how confident it is in its own answer, in [0, 1]
+func (d *CommitteeDomain) selfCheck(c *CommitteeContext, member *Member, answer string) (float64, error) {
+	var promptBuilder strings.Builder
+	promptBuilder.WriteString("请检查以下对话的最后一个问题的回答是否正确、完整。\n\n")
+	for _, message := range c.Messages {
+		if text, ok := message.Content.(string); ok {
+			promptBuilder.WriteString(message.Role)
+			promptBuilder.WriteString(": ")
+			promptBuilder.WriteString(text)
+			promptBuilder.WriteString("\n\n")
+		}
+	}
+	promptBuilder.WriteString("回答：")
+	promptBuilder.WriteString(llm.RemoveThink(answer))
+	promptBuilder.WriteString("\n\n请只输出一个 0 到 100 之间的整数，表示你对该回答正确性的信心。")
+	prompt := promptBuilder.String()
+
+	reserved, ok := c.Budget.Acquire(member, estimateTokens(prompt), "cascade self check of "+member.Name())
+	if !ok {
+		return 0, errors.New("budget exhausted")
+	}
+	defer c.Budget.Release(reserved)
+
+	var reply string
+	for resp, err := range member.GenerateContent(c, c.Budget.Apply(member.NewRequest(prompt)), false) {
+		if err != nil {
+			return 0, err
+		}
+		c.Usage.Record(PhaseCascade, member, resp.UsageMetadata)
+		if resp.Content != nil {
+			for _, part := range resp.Content.Parts {
+				if !part.Thought {
+					reply += part.Text
+				}
+			}
+		}
+		break
+	}
+
+	match := confidencePattern.FindString(llm.RemoveThink(reply))
+	if match == "" {
+		return 0, errors.Errorf("no confidence in reply %q", reply)
+	}
+	score, err := strconv.ParseFloat(match, 64)
+	if err != nil {
+		return 0, err
+	}
+	return min(max(score/100, 0), 1), nil
+}
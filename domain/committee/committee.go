@@ -7,9 +7,12 @@ import (
 	"log/slog"
 	"maps"
 	"net/http"
+	"slices"
 	"strings"
 	"sync"
 
+	"super-llm/infra"
+
 	"github.com/cv70/pkgo/llm"
 
 	"github.com/cv70/pkgo/gslice"
@@ -19,11 +22,21 @@ import (
 	"google.golang.org/genai"
 )
 
+// ErrLeaderStatus is returned when the leader answers the final phase with an
+// error status
+var ErrLeaderStatus = errors.New("leader returned an error status")
+
 // GetMembers returns the list of committee members
-func (d *CommitteeDomain) GetMembers() iter.Seq[*llm.OpenAIModel] {
+func (d *CommitteeDomain) GetMembers() iter.Seq[*Member] {
 	return maps.Values(d.Members)
 }
 
+// ModelNames lists the names a request can address as its model: the
+// presets, then the members
+func (d *CommitteeDomain) ModelNames() []string {
+	return append(slices.Sorted(maps.Keys(d.Presets)), memberNames(d.Members)...)
+}
+
 // Phase1InitialOpinions collects initial opinions from all LLMs
 func (d *CommitteeDomain) Phase1InitialOpinions(c *CommitteeContext) error {
 	results := make(map[string]string)
@@ -35,21 +48,23 @@ func (d *CommitteeDomain) Phase1InitialOpinions(c *CommitteeContext) error {
 		name  string
 		reply string
 		err   error
-	}, len(d.Members))
+	}, len(c.Members))
 
 	// Send question to all LLMs concurrently
-	for member := range d.GetMembers() {
+	for member := range c.GetMembers() {
+		prompt := member.OpinionPrompt(c.MessageSummary)
+		reserved, ok := c.Budget.Acquire(member, estimateTokens(prompt), "opinion of "+member.Name())
+		if !ok {
+			continue
+		}
+
 		wg.Add(1)
-		go func(member model.LLM) {
+		go func(member *Member) {
 			defer wg.Done()
+			defer c.Budget.Release(reserved)
 
-			// Create content for the LLM
-			content := genai.NewContentFromText(c.MessageSummary, genai.RoleUser)
-
-			// Create request
-			req := &model.LLMRequest{
-				Contents: []*genai.Content{content},
-			}
+			// Create request with the member's persona and prompt variant
+			req := c.Budget.Apply(member.NewRequest(prompt))
 
 			// Generate response
 			seq := member.GenerateContent(c, req, false)
@@ -66,6 +81,9 @@ func (d *CommitteeDomain) Phase1InitialOpinions(c *CommitteeContext) error {
 				response = resp
 				break
 			}
+			if response != nil {
+				c.Usage.Record(PhaseOpinion, member, response.UsageMetadata)
+			}
 
 			if response == nil {
 				resultChan <- struct {
@@ -101,6 +119,7 @@ func (d *CommitteeDomain) Phase1InitialOpinions(c *CommitteeContext) error {
 	}()
 
 	// Collect results
+	var busy error
 	for result := range resultChan {
 		mu.Lock()
 		results[result.name] = result.reply
@@ -109,6 +128,14 @@ func (d *CommitteeDomain) Phase1InitialOpinions(c *CommitteeContext) error {
 		if result.err != nil {
 			slog.Error("getting opinion", slog.Any("name", result.name), slog.Any("err", result.err))
 		}
+		if errors.Is(result.err, infra.ErrBusy) {
+			busy = result.err
+		}
+	}
+	// An opinion lost to a backend limit fails the run, so that the client
+	// is told to retry rather than given a smaller committee's answer
+	if busy != nil {
+		return busy
 	}
 
 	c.Opinions = results
@@ -126,41 +153,30 @@ func (d *CommitteeDomain) Phase2Review(c *CommitteeContext) error {
 		name   string
 		review []string
 		err    error
-	}, len(d.Members))
+	}, len(c.Members))
+
+	// Prepare review prompt, one per reviewer when reviewers must not see
+	// their own opinion
+	prompt := reviewPrompt(c, "")
 
 	// Each LLM reviews all other LLMs' responses anonymously
-	for member := range d.GetMembers() {
+	for member := range c.GetMembers() {
+		prompt := prompt
+		if d.excludeSelf() {
+			prompt = reviewPrompt(c, member.Name())
+		}
+		reserved, ok := c.Budget.Acquire(member, estimateTokens(prompt), "review of "+member.Name())
+		if !ok {
+			continue
+		}
+
 		wg.Add(1)
-		go func(member model.LLM) {
+		go func(member *Member) {
 			defer wg.Done()
+			defer c.Budget.Release(reserved)
 
-			// Prepare review prompt
-			var promptBuilder strings.Builder
-			promptBuilder.WriteString("请对以下内容的回复进行匿名评审和排名：\n\n")
-			promptBuilder.WriteString(c.MessageSummary)
-			promptBuilder.WriteString("\n\n请对以下回复进行评分和排名（从高到低）：\n")
-
-			// Add all opinions
-			for name, opinion := range c.Opinions {
-				promptBuilder.WriteString(name)
-				promptBuilder.WriteString(": ")
-				promptBuilder.WriteString(opinion)
-				promptBuilder.WriteString("\n\n")
-			}
-
-			promptBuilder.WriteString("请按以下格式回答：\n")
-			promptBuilder.WriteString("1. 评分最高的回复：[模型名称]\n")
-			promptBuilder.WriteString("2. 评分第二高的回复：[模型名称]\n")
-			promptBuilder.WriteString("3. 评分第三高的回复：[模型名称]\n")
-			promptBuilder.WriteString("4. 详细评价：[简要说明]\n")
-
-			// Create content for the LLM
-			content := genai.NewContentFromText(promptBuilder.String(), genai.RoleUser)
-
-			// Create request
-			req := &model.LLMRequest{
-				Contents: []*genai.Content{content},
-			}
+			// Create request with the member's persona
+			req := c.Budget.Apply(member.NewRequest(prompt))
 
 			// Generate response
 			seq := member.GenerateContent(c, req, false)
@@ -177,6 +193,9 @@ func (d *CommitteeDomain) Phase2Review(c *CommitteeContext) error {
 				response = resp
 				break
 			}
+			if response != nil {
+				c.Usage.Record(PhaseReview, member, response.UsageMetadata)
+			}
 
 			if response == nil {
 				reviewChan <- struct {
@@ -233,8 +252,96 @@ func (d *CommitteeDomain) Phase2Review(c *CommitteeContext) error {
 	return nil
 }
 
+// reviewPrompt asks for a ranking of the opinions, leaving out the opinion
+// of the member named exclude
+func reviewPrompt(c *CommitteeContext, exclude string) string {
+	var promptBuilder strings.Builder
+	promptBuilder.WriteString("请对以下内容的回复进行匿名评审和排名：\n\n")
+	promptBuilder.WriteString(c.MessageSummary)
+	promptBuilder.WriteString("\n\n请对以下回复进行评分和排名（从高到低）：\n")
+
+	// Add all opinions
+	for name, opinion := range c.ReviewOpinions {
+		if name == exclude {
+			continue
+		}
+		promptBuilder.WriteString(name)
+		promptBuilder.WriteString(": ")
+		promptBuilder.WriteString(opinion)
+		promptBuilder.WriteString("\n\n")
+	}
+
+	promptBuilder.WriteString("请按以下格式回答：\n")
+	promptBuilder.WriteString("1. 评分最高的回复：[模型名称]\n")
+	promptBuilder.WriteString("2. 评分第二高的回复：[模型名称]\n")
+	promptBuilder.WriteString("3. 评分第三高的回复：[模型名称]\n")
+	promptBuilder.WriteString("4. 详细评价：[简要说明]\n")
+	return promptBuilder.String()
+}
+
 // Phase3FinalAnswer generates the final answer using the leader model
 func (d *CommitteeDomain) Phase3FinalAnswer(c *CommitteeContext) (*http.Response, error) {
+	prompt, err := d.finalPrompt(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "render final prompt")
+	}
+
+	// Create request
+	c.Request.Messages = make([]*llm.ChatMessage, 0, 1)
+	systemMessage, _ := gslice.FirstIf(c.Request.Messages, func(message *llm.ChatMessage) bool {
+		return message.Role == "system"
+	})
+	if systemMessage != nil {
+		c.Request.Messages = append(c.Request.Messages, systemMessage)
+	}
+	c.Request.Messages = append(c.Request.Messages, &llm.ChatMessage{
+		Role:    "user",
+		Content: prompt,
+	})
+
+	// Cap the answer to what is left of the budget
+	if limit := c.Budget.ReleaseFinal(estimateTokens(prompt)); limit > 0 {
+		if c.Request.MaxTokens == nil || *c.Request.MaxTokens > limit {
+			c.Request.MaxTokens = &limit
+		}
+	}
+
+	// Generate response, addressing the leader's backend model
+	c.Request.Model = c.Leader.ModelName
+	resp, err := c.Leader.SendRequest(c, c.Request)
+	var status *infra.StatusError
+	if errors.As(err, &status) {
+		return nil, errors.Wrapf(ErrLeaderStatus, "status %d", status.StatusCode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		// The client drops error responses when no transport reports them
+		return nil, ErrLeaderStatus
+	}
+	return resp, nil
+}
+
+// finalPrompt builds the leader's prompt from the summary, opinions and
+// reviews, using the context's template when one is set
+func (d *CommitteeDomain) finalPrompt(c *CommitteeContext) (string, error) {
+	var weights map[string]float64
+	if d.Reputation != nil && d.Reputation.Weights {
+		weights = d.Reputation.MemberWeights(c.Topic(), memberNames(c.Members))
+	}
+	if c.FinalTemplate != nil {
+		var promptBuilder strings.Builder
+		err := c.FinalTemplate.Execute(&promptBuilder, &FinalPromptData{
+			Summary:  c.MessageSummary,
+			Opinions: c.ReviewOpinions,
+			Reviews:  c.Reviews,
+			Ranking:  c.Ranking,
+			Weights:  weights,
+		})
+		return promptBuilder.String(), err
+	}
+
 	// Prepare final answer prompt
 	var promptBuilder strings.Builder
 	promptBuilder.WriteString("请基于以下信息生成最终回答：\n\n")
@@ -255,7 +362,11 @@ func (d *CommitteeDomain) Phase3FinalAnswer(c *CommitteeContext) (*http.Response
 	// }
 
 	promptBuilder.WriteString("各模型的初始回复：\n")
-	for name, opinion := range c.Opinions {
+	for name, opinion := range c.ReviewOpinions {
+		if weight, ok := weights[name]; ok {
+			promptBuilder.WriteString(fmt.Sprintf("%s（权重 %.2f）: %s\n\n", name, weight, opinion))
+			continue
+		}
 		promptBuilder.WriteString(fmt.Sprintf("%s: %s\n\n", name, opinion))
 	}
 
@@ -268,23 +379,11 @@ func (d *CommitteeDomain) Phase3FinalAnswer(c *CommitteeContext) (*http.Response
 		promptBuilder.WriteString("\n")
 	}
 
-	promptBuilder.WriteString("请综合所有回复和评审意见，给出一个高质量、准确且全面的最终回答。")
-
-	// Create request
-	c.Request.Messages = make([]*llm.ChatMessage, 0, 1)
-	systemMessage, _ := gslice.FirstIf(c.Request.Messages, func(message *llm.ChatMessage) bool {
-		return message.Role == "system"
-	})
-	if systemMessage != nil {
-		c.Request.Messages = append(c.Request.Messages, systemMessage)
+	if len(weights) > 0 {
+		promptBuilder.WriteString("权重反映各模型在此类问题上的历史表现，请在整合时适当参考。\n")
 	}
-	c.Request.Messages = append(c.Request.Messages, &llm.ChatMessage{
-		Role:    "user",
-		Content: promptBuilder.String(),
-	})
-
-	// Generate response
-	return c.Leader.SendRequest(c, c.Request)
+	promptBuilder.WriteString("请综合所有回复和评审意见，给出一个高质量、准确且全面的最终回答。")
+	return promptBuilder.String(), nil
 }
 
 // GenerateConversationSummary generates a summary of the conversation
@@ -342,6 +441,7 @@ func (d *CommitteeDomain) GenerateConversationSummary(c *CommitteeContext) error
 	if response == nil {
 		return errors.New("no response from leader model for summary")
 	}
+	c.Usage.Record(PhaseSummary, c.Leader, response.UsageMetadata)
 
 	// Extract text from response
 	var summaryText string
@@ -357,37 +457,79 @@ func (d *CommitteeDomain) GenerateConversationSummary(c *CommitteeContext) error
 	return nil
 }
 
-// RunCommitteeProcess executes the complete committee process
-func (d *CommitteeDomain) RunCommitteeProcess(ctx context.Context, req *llm.ChatCompletionRequest, members []string, opinion, review bool) (*http.Response, error) {
-	c, err := d.BuildCommitteeContext(ctx, req, members, opinion, review)
+// RunCommitteeProcess executes the complete committee process. The returned
+// context carries the final response and the usage of the run. The run holds
+// its place among the runs in flight until the response body is closed.
+func (d *CommitteeDomain) RunCommitteeProcess(ctx context.Context, req *llm.ChatCompletionRequest, opts *RunOptions) (*CommitteeContext, error) {
+	release, err := d.Runs.Acquire(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	c, err := d.BuildCommitteeContext(ctx, req, opts)
 	if err != nil {
+		release()
 		return nil, errors.Wrap(err, "build committee context")
 	}
+	if !d.LookupCache(c, opts.Cache) {
+		switch c.Strategy {
+		case StrategyCascade:
+			err = d.RunCascade(c)
+		default:
+			err = d.Deliberate(c)
+		}
+		if err != nil {
+			release()
+			return nil, err
+		}
+		d.finishResponse(c)
+	}
+	c.Response.Body = infra.ReleaseOnClose(c.Response.Body, release)
+	return c, nil
+}
 
+// Deliberate runs the summary and the three committee phases
+func (d *CommitteeDomain) Deliberate(c *CommitteeContext) error {
 	// Generate summary before phase 1
-	err = d.GenerateConversationSummary(c)
+	err := d.GenerateConversationSummary(c)
 	if err != nil {
 		slog.Error("生成摘要失败", slog.Any("err", err))
-		return nil, errors.Wrap(err, "generate summary")
+		return errors.Wrap(err, "generate summary")
+	}
+
+	// Fit members and phases to the budget
+	if err := d.PlanBudget(c); err != nil {
+		return err
 	}
 
 	// Phase 1: Initial Opinions
 	err = d.Phase1InitialOpinions(c)
 	if err != nil {
-		return nil, errors.Wrap(err, "phase 1")
+		return errors.Wrap(err, "phase 1")
+	}
+
+	// Skip reviews or the synthesis when the opinions already agree
+	d.DetectConsensus(c)
+	if c.Response != nil {
+		return nil
 	}
+	d.TrimOpinions(c)
 
 	// Phase 2: Review
-	err = d.Phase2Review(c)
-	if err != nil {
-		return nil, errors.Wrap(err, "phase 2")
+	if !c.SkipReview {
+		err = d.Phase2Review(c)
+		if err != nil {
+			return errors.Wrap(err, "phase 2")
+		}
+
+		// Rank the opinions and learn from the ranking
+		d.rankOpinions(c)
+		d.recordRanking(c)
 	}
 
 	// Phase 3: Final Answer
-	finalAnswer, err := d.Phase3FinalAnswer(c)
+	c.Response, err = d.Phase3FinalAnswer(c)
 	if err != nil {
-		return nil, errors.Wrap(err, "phase 3")
+		return errors.Wrap(err, "phase 3")
 	}
-
-	return finalAnswer, nil
+	return nil
 }
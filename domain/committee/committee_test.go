@@ -0,0 +1,120 @@
+package committee
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"super-llm/config"
+	"super-llm/infra"
+	"super-llm/infra/fake"
+
+	"github.com/cv70/pkgo/llm"
+	"github.com/pkg/errors"
+)
+
+// newFakeDomain builds a committee of two members backed by a fake backend
+func newFakeDomain(t *testing.T, fakeCfg *fake.Config, configure func(cfg *config.Config)) *CommitteeDomain {
+	t.Helper()
+	backend, err := fake.NewServer(fakeCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(backend.Handler())
+	t.Cleanup(server.Close)
+
+	cfg := &config.Config{
+		LLMs: []*config.LLMConfig{{BaseURL: server.URL + "/v1", Model: "fake-model", APIKey: "test"}},
+		Members: []*config.MemberConfig{
+			{Name: "alice", LLM: "fake-model"},
+			{Name: "bob", LLM: "fake-model"},
+		},
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+	d, err := BuildCommitteeDomain(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func question() *llm.ChatCompletionRequest {
+	return &llm.ChatCompletionRequest{
+		Model:    "alice",
+		Messages: []*llm.ChatMessage{{Role: llm.RoleUser, Content: "2+2 等于几？"}},
+	}
+}
+
+// TestLeaderErrorStatus fails a run whose leader answers with an error
+// status and expects its committee slot back
+func TestLeaderErrorStatus(t *testing.T) {
+	d := newFakeDomain(t, &fake.Config{Rules: []*fake.Rule{
+		{Match: "请基于以下信息生成最终回答", Status: http.StatusInternalServerError},
+	}}, func(cfg *config.Config) {
+		cfg.Limits = &config.LimitConfig{MaxConcurrent: 1, MaxWait: 10 * time.Millisecond}
+	})
+	for _, stream := range []bool{false, true, false} {
+		req := question()
+		req.Stream = stream
+		_, err := d.RunCommitteeProcess(context.Background(), req, &RunOptions{})
+		if !errors.Is(err, ErrLeaderStatus) {
+			t.Fatalf("stream=%v: err %v, want the leader's status", stream, err)
+		}
+	}
+}
+
+// TestMemberErrorStatus fails a run whose members all answer with an error
+// status
+func TestMemberErrorStatus(t *testing.T) {
+	d := newFakeDomain(t, &fake.Config{ErrorRate: 1, ErrorStatus: http.StatusServiceUnavailable}, nil)
+	if _, err := d.RunCommitteeProcess(context.Background(), question(), &RunOptions{}); err == nil {
+		t.Fatal("run succeeded without members")
+	}
+	resp, _, err := d.Ask(context.Background(), "alice", question())
+	var status *infra.StatusError
+	if !errors.As(err, &status) || status.StatusCode != http.StatusServiceUnavailable || resp != nil {
+		t.Errorf("ask: err %v, want the backend status", err)
+	}
+}
+
+// TestRerunSlot holds a committee slot for a rerun until its response is
+// read, and gives it back when the leader fails
+func TestRerunSlot(t *testing.T) {
+	d := newFakeDomain(t, &fake.Config{Rules: []*fake.Rule{
+		{Match: "失败", Status: http.StatusInternalServerError},
+	}}, func(cfg *config.Config) {
+		cfg.Storage = &config.StorageConfig{Type: infra.StorageJSONL, Path: filepath.Join(t.TempDir(), "deliberations.jsonl")}
+		cfg.Limits = &config.LimitConfig{MaxConcurrent: 1, MaxWait: 10 * time.Millisecond}
+	})
+	c, err := d.RunCommitteeProcess(context.Background(), question(), &RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ReadResponse(); err != nil {
+		t.Fatal(err)
+	}
+
+	rerun, err := d.Rerun(context.Background(), c.ID, &RerunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Rerun(context.Background(), c.ID, &RerunOptions{}); !errors.Is(err, infra.ErrBusy) {
+		t.Errorf("rerun while another holds the slot: err %v, want busy", err)
+	}
+	if _, err := rerun.ReadResponse(); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		_, err := d.Rerun(context.Background(), c.ID, &RerunOptions{Template: "失败"})
+		if !errors.Is(err, ErrLeaderStatus) {
+			t.Fatalf("rerun with a failing leader: err %v", err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package committee
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/cv70/pkgo/llm"
+	"github.com/pkg/errors"
+)
+
+// ErrStreamCut is returned when a completion stream ends before [DONE]
+var ErrStreamCut = errors.New("stream ended before [DONE]")
+
+// ReadCompletion reads an OpenAI-compatible response body, either a JSON
+// completion or an SSE stream of chunks, into a single completion. A stream
+// that breaks off yields what was read so far along with the error.
+func ReadCompletion(r io.Reader, stream bool) (*llm.ChatCompletionResponse, error) {
+	if !stream {
+		var completion llm.ChatCompletionResponse
+		if err := json.NewDecoder(r).Decode(&completion); err != nil {
+			return nil, errors.Wrap(err, "decode completion")
+		}
+		return &completion, nil
+	}
+
+	completion := &llm.ChatCompletionResponse{Object: "chat.completion"}
+	var contents, reasonings []strings.Builder
+	err := ReadChunks(r, func(chunk *llm.ChatCompletionResponse) error {
+		completion.ID = chunk.ID
+		completion.Created = chunk.Created
+		completion.Model = chunk.Model
+		if chunk.Usage != nil {
+			completion.Usage = chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			for len(completion.Choices) <= choice.Index {
+				completion.Choices = append(completion.Choices, llm.ChatChoice{
+					Index:   len(completion.Choices),
+					Message: &llm.ChatMessage{Role: llm.RoleAssistant},
+				})
+				contents = append(contents, strings.Builder{})
+				reasonings = append(reasonings, strings.Builder{})
+			}
+			if choice.FinishReason != "" {
+				completion.Choices[choice.Index].FinishReason = choice.FinishReason
+			}
+			if choice.Delta == nil {
+				continue
+			}
+			if text, ok := choice.Delta.Content.(string); ok {
+				contents[choice.Index].WriteString(text)
+			}
+			if text, ok := choice.Delta.ReasoningContent.(string); ok {
+				reasonings[choice.Index].WriteString(text)
+			}
+		}
+		return nil
+	})
+	for i := range completion.Choices {
+		completion.Choices[i].Message.Content = contents[i].String()
+		if reasonings[i].Len() > 0 {
+			completion.Choices[i].Message.ReasoningContent = reasonings[i].String()
+		}
+	}
+	return completion, err
+}
+
+// ReadChunks calls fn for every chunk of an SSE completion stream until
+// [DONE]. Lines that are not JSON chunks are skipped; a stream ending without
+// [DONE] was cut off and yields ErrStreamCut.
+func ReadChunks(r io.Reader, fn func(chunk *llm.ChatCompletionResponse) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			return nil
+		}
+		var chunk llm.ChatCompletionResponse
+		if json.Unmarshal([]byte(data), &chunk) != nil {
+			continue
+		}
+		if err := fn(&chunk); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "read stream")
+	}
+	return ErrStreamCut
+}
+
+// captureBody records a response body as it is read and hands it to onClose
+// when closed, reporting whether the body was read to the end
+type captureBody struct {
+	io.ReadCloser
+	buf     bytes.Buffer
+	eof     bool
+	drain   bool
+	onClose func(data []byte, eof bool)
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *captureBody) Close() error {
+	// A JSON decoder may stop right before EOF; an unfinished stream
+	// means the client went away and is not worth waiting for
+	if !b.eof && b.drain {
+		if _, err := io.Copy(&b.buf, b.ReadCloser); err == nil {
+			b.eof = true
+		}
+	}
+	err := b.ReadCloser.Close()
+	b.onClose(b.buf.Bytes(), b.eof)
+	return err
+}
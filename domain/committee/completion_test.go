@@ -0,0 +1,29 @@
+package committee
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestReadCompletionStream(t *testing.T) {
+	chunk := `data: {"id":"c1","choices":[{"index":0,"delta":{"content":"你好"}}]}` + "\n\n"
+
+	completion, err := ReadCompletion(strings.NewReader(chunk+"data: [DONE]\n\n"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := completion.Choices[0].Message.Content; got != "你好" {
+		t.Fatalf("content %v", got)
+	}
+
+	// A stream cut off before [DONE] keeps the partial answer but fails
+	completion, err = ReadCompletion(strings.NewReader(chunk), true)
+	if !errors.Is(err, ErrStreamCut) {
+		t.Fatalf("cut stream returned %v", err)
+	}
+	if completion == nil || completion.Choices[0].Message.Content != "你好" {
+		t.Fatalf("partial completion lost: %+v", completion)
+	}
+}
@@ -0,0 +1,194 @@
+package committee
+
+import (
+	"log/slog"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+
+	"super-llm/config"
+
+	"github.com/cv70/pkgo/llm"
+)
+
+// Similarity methods used for consensus detection
+const (
+	SimilarityLexical   = "lexical"
+	SimilarityEmbedding = "embedding"
+)
+
+// PhaseConsensus is the usage phase of consensus embeddings
+const PhaseConsensus = "consensus"
+
+const defaultClusterThreshold = 0.7
+
+// Position is a cluster of opinions taking the same stance
+type Position struct {
+	Members []string `json:"members"`
+	// Representative is the member whose opinion is closest to the others
+	Representative string `json:"representative"`
+}
+
+// ConsensusReport describes how much the initial opinions agree
+type ConsensusReport struct {
+	Score     float64     `json:"score"`
+	Method    string      `json:"method"`
+	Positions []*Position `json:"positions"`
+	// SkippedReview and SkippedFinal record the early exits taken
+	SkippedReview bool `json:"skipped_review,omitempty"`
+	SkippedFinal  bool `json:"skipped_final,omitempty"`
+}
+
+// DetectConsensus scores the agreement between initial opinions, groups them
+// into positions and, past the configured thresholds, skips the review phase
+// or answers with the consensus opinion directly
+func (d *CommitteeDomain) DetectConsensus(c *CommitteeContext) {
+	names := slices.Sorted(maps.Keys(c.Opinions))
+	names = slices.DeleteFunc(names, func(name string) bool {
+		return strings.TrimSpace(c.Opinions[name]) == ""
+	})
+	if len(names) < 2 {
+		return
+	}
+	cfg := d.Consensus
+	if cfg == nil {
+		cfg = &config.ConsensusConfig{}
+	}
+
+	texts := make([]string, len(names))
+	for i, name := range names {
+		texts[i] = strings.TrimSpace(llm.RemoveThink(c.Opinions[name]))
+	}
+	similarity, method := d.similarityMatrix(c, texts)
+
+	// Agreement is the mean pairwise similarity
+	var sum float64
+	pairs := 0
+	for i := range names {
+		for j := i + 1; j < len(names); j++ {
+			sum += similarity[i][j]
+			pairs++
+		}
+	}
+	report := &ConsensusReport{
+		Score:     sum / float64(pairs),
+		Method:    method,
+		Positions: clusterOpinions(names, similarity, cfg.ClusterThreshold),
+	}
+	c.Consensus = report
+
+	if cfg.ReviewThreshold > 0 && report.Score >= cfg.ReviewThreshold && !c.SkipReview {
+		report.SkippedReview = true
+		c.SkipReview = true
+	}
+	if cfg.FinalThreshold > 0 && report.Score >= cfg.FinalThreshold {
+		if !c.SkipReview {
+			report.SkippedReview = true
+			c.SkipReview = true
+		}
+		report.SkippedFinal = true
+		answer := strings.TrimSpace(llm.RemoveThink(c.Opinions[report.Positions[0].Representative]))
+		c.Response = NewCompletionResponse(NewTextCompletion(c.Request.Model, answer), c.Request.Stream)
+	}
+}
+
+// similarityMatrix compares every pair of texts with embeddings when
+// configured, falling back to lexical similarity
+func (d *CommitteeDomain) similarityMatrix(c *CommitteeContext, texts []string) ([][]float64, string) {
+	similarity := make([][]float64, len(texts))
+	for i := range similarity {
+		similarity[i] = make([]float64, len(texts))
+		similarity[i][i] = 1
+	}
+
+	if d.Embedder != nil {
+		vectors, usage, err := d.Embedder.Embed(c, texts)
+		if err == nil {
+			if usage != nil {
+				c.Usage.RecordTokens(PhaseConsensus, d.Embedder.Model, d.Embedder.Model, usage.PromptTokens, 0, usage.TotalTokens)
+			}
+			for i := range texts {
+				for j := i + 1; j < len(texts); j++ {
+					similarity[i][j] = vectorCosine(vectors[i], vectors[j])
+					similarity[j][i] = similarity[i][j]
+				}
+			}
+			return similarity, SimilarityEmbedding
+		}
+		slog.Error("embedding opinions, falling back to lexical similarity", slog.Any("err", err))
+	}
+
+	terms := make([]map[string]float64, len(texts))
+	for i, text := range texts {
+		terms[i] = lexicalTerms(text)
+	}
+	for i := range texts {
+		for j := i + 1; j < len(texts); j++ {
+			similarity[i][j] = cosine(terms[i], terms[j])
+			similarity[j][i] = similarity[i][j]
+		}
+	}
+	return similarity, SimilarityLexical
+}
+
+// clusterOpinions groups opinions by average-link similarity, largest
+// position first
+func clusterOpinions(names []string, similarity [][]float64, threshold float64) []*Position {
+	if threshold == 0 {
+		threshold = defaultClusterThreshold
+	}
+	var clusters [][]int
+	for i := range names {
+		best, bestScore := -1, threshold
+		for k, cluster := range clusters {
+			var sum float64
+			for _, j := range cluster {
+				sum += similarity[i][j]
+			}
+			if score := sum / float64(len(cluster)); score >= bestScore {
+				best, bestScore = k, score
+			}
+		}
+		if best < 0 {
+			clusters = append(clusters, []int{i})
+		} else {
+			clusters[best] = append(clusters[best], i)
+		}
+	}
+	slices.SortStableFunc(clusters, func(a, b []int) int {
+		return len(b) - len(a)
+	})
+
+	positions := make([]*Position, len(clusters))
+	for k, cluster := range clusters {
+		position := &Position{}
+		medoid, medoidScore := cluster[0], -1.0
+		for _, i := range cluster {
+			position.Members = append(position.Members, names[i])
+			var sum float64
+			for _, j := range cluster {
+				sum += similarity[i][j]
+			}
+			if sum > medoidScore {
+				medoid, medoidScore = i, sum
+			}
+		}
+		position.Representative = names[medoid]
+		positions[k] = position
+	}
+	return positions
+}
+
+func vectorCosine(a, b []float64) float64 {
+	var dot, normA, normB float64
+	for i := range min(len(a), len(b)) {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(normA*normB)
+}
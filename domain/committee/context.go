@@ -2,8 +2,17 @@ package committee
 
 import (
 	"context"
+	"iter"
+	"maps"
+	"net/http"
+	"slices"
+	"text/template"
+	"time"
+
+	"super-llm/infra"
 
 	"github.com/cv70/pkgo/llm"
+	"github.com/google/uuid"
 
 	"github.com/cv70/pkgo/gslice"
 
@@ -12,35 +21,131 @@ import (
 
 type CommitteeContext struct {
 	context.Context
+	// ID identifies the deliberation in storage and responses
+	ID        string
+	CreatedAt time.Time
+	// Parent is the deliberation a rerun or follow-up started from
+	Parent string
+	// Model is the model requested by the client, a preset or the leader
+	Model string
+	// Owner is the API key the run is made for, empty when the API is open
+	Owner    string
 	Request  *llm.ChatCompletionRequest
 	Messages []*llm.ChatMessage
-	Leader   *llm.OpenAIModel
-	Members  map[string]*llm.OpenAIModel
+	Leader   *Member
+	Members  map[string]*Member
 
 	Opinions       map[string]string
 	Reviews        map[string][]string
 	MessageSummary string
 
+	// ReviewOpinions are the opinions shown to reviewers and the leader,
+	// trimmed when the full texts would not fit the budget
+	ReviewOpinions map[string]string
+	// SkipReview is set when the review phase is planned out of the run
+	SkipReview bool
+
+	// FinalTemplate replaces the built-in final answer prompt when set
+	FinalTemplate *template.Template
+
 	OutputOpinion bool
 	OutputReview  bool
+
+	// Usage collects token usage of every call made for this request
+	Usage *UsageTracker
+	// Budget enforces the token and cost limits of this request
+	Budget *BudgetTracker
+	// Topics tag the request for member reputation
+	Topics []string
+	// Ranking is the committee's aggregated ranking of opinions, best first
+	Ranking []string
+	// ReviewRankings are the rankings parsed from each reviewer's review
+	ReviewRankings map[string][]string
+	// ReviewerWeights scale the reviewers' rankings, nil for equal weights
+	ReviewerWeights map[string]float64
+	// Strategy selects how the request is answered
+	Strategy string
+	// Cascade records the decision of the cascade strategy, if used
+	Cascade *CascadeReport
+	// Consensus describes the agreement between initial opinions
+	Consensus *ConsensusReport
+	// CacheKey identifies the request in the response cache
+	CacheKey string
+	// CacheStatus reports whether the answer came from the cache
+	CacheStatus string
+	// Response is the leader's OpenAI-compatible final response
+	Response *http.Response
 }
 
-func (d *CommitteeDomain) BuildCommitteeContext(ctx context.Context, req *llm.ChatCompletionRequest, members []string, opinion, review bool) (*CommitteeContext, error) {
+func (d *CommitteeDomain) BuildCommitteeContext(ctx context.Context, req *llm.ChatCompletionRequest, opts *RunOptions) (*CommitteeContext, error) {
+	// Backend limiters take turns between the runs they queue
+	id := uuid.NewString()
 	c := CommitteeContext{
-		Context:       ctx,
+		Context:       infra.WithFlow(ctx, id),
+		ID:            id,
+		CreatedAt:     time.Now(),
+		Parent:        opts.Parent,
+		Model:         req.Model,
+		Owner:         opts.Caller.Owner(),
+		Topics:        NormalizeTopics(opts.Topics),
 		Request:       req,
 		Messages:      req.Messages,
-		OutputOpinion: opinion,
-		OutputReview:  review,
+		OutputOpinion: opts.Opinion,
+		OutputReview:  opts.Review,
+		Usage:         newUsageTracker(d.Prices),
+	}
+
+	// A preset supplies the leader, default members, strategy and budget
+	members := opts.Members
+	budget := opts.Budget
+	c.Strategy = opts.Strategy
+	preset := d.Presets[req.Model]
+	checked := members
+	if opts.reseat {
+		checked = nil
+	}
+	if err := opts.Caller.CheckAccess(req.Model, preset != nil, checked); err != nil {
+		return nil, err
+	}
+	if preset != nil {
+		c.Leader = d.Members[preset.Leader]
+		if len(members) == 0 {
+			members = preset.Members
+		}
+		if c.Strategy == "" {
+			c.Strategy = preset.Strategy
+		}
+		budget = budget.Merge(BudgetFromConfig(preset.Budget))
+	} else {
+		c.Leader = d.Members[req.Model]
+		// A key limited to some members seats those when the request names none
+		if len(members) == 0 {
+			members = opts.Caller.Members()
+		}
 	}
-	c.Leader = d.Members[req.Model]
 	if c.Leader == nil {
 		return nil, errors.New("leader model not found")
 	}
+	switch c.Strategy {
+	case "":
+		c.Strategy = StrategyCommittee
+	case StrategyCommittee, StrategyCascade:
+	default:
+		return nil, errors.Errorf("unknown strategy %s", c.Strategy)
+	}
+	if opts.Caller != nil {
+		c.Usage.charge = opts.Caller.Charge
+	}
+	c.Budget = newBudgetTracker(budget.Merge(QuotaBudget(opts.Caller)), c.Usage)
+
+	// Without explicit members the best rated ones take the seats
+	if len(members) == 0 && d.Reputation != nil && d.Reputation.Select > 0 {
+		members = d.Reputation.Top(c.Topic(), d.Reputation.Select, memberNames(d.Members))
+	}
 	if len(members) == 0 {
-		c.Members = d.Members
+		c.Members = maps.Clone(d.Members)
 	} else {
-		c.Members = gslice.SliceToMapIf(members, func(member string) (string, *llm.OpenAIModel, bool) {
+		c.Members = gslice.SliceToMapIf(members, func(member string) (string, *Member, bool) {
 			model := d.Members[member]
 			if model == nil {
 				return "", nil, false
@@ -53,3 +158,21 @@ func (d *CommitteeDomain) BuildCommitteeContext(ctx context.Context, req *llm.Ch
 	}
 	return &c, nil
 }
+
+// GetMembers returns the members seated for this request
+func (c *CommitteeContext) GetMembers() iter.Seq[*Member] {
+	return maps.Values(c.Members)
+}
+
+// memberNames lists member names in a stable order
+func memberNames(members map[string]*Member) []string {
+	return slices.Sorted(maps.Keys(members))
+}
+
+// Topic is the main topic of the request, TopicAll when untagged
+func (c *CommitteeContext) Topic() string {
+	if len(c.Topics) == 0 {
+		return TopicAll
+	}
+	return c.Topics[0]
+}
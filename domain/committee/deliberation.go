@@ -0,0 +1,214 @@
+package committee
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"super-llm/domain/auth"
+	"super-llm/infra"
+
+	"github.com/cv70/pkgo/llm"
+	"github.com/pkg/errors"
+)
+
+// ErrDeliberationNotFound is returned for unknown deliberation IDs
+var ErrDeliberationNotFound = errors.New("deliberation not found")
+
+// Deliberation is the saved transcript of a committee run
+type Deliberation struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Parent    string    `json:"parent,omitempty"`
+	// Owner is the API key the deliberation was made for
+	Owner string `json:"owner,omitempty"`
+	// CompletionID is the ID of the completion returned to the client
+	CompletionID string                     `json:"completion_id,omitempty"`
+	Model        string                     `json:"model"`
+	Leader       string                     `json:"leader"`
+	Members      []string                   `json:"members"`
+	Strategy     string                     `json:"strategy"`
+	Topics       []string                   `json:"topics,omitempty"`
+	Request      *llm.ChatCompletionRequest `json:"request"`
+	Summary      string                     `json:"summary,omitempty"`
+	Opinions     map[string]string          `json:"opinions,omitempty"`
+	Reviews      map[string][]string        `json:"reviews,omitempty"`
+	Ranking      []string                   `json:"ranking,omitempty"`
+	Answer       string                     `json:"answer"`
+	Completed    bool                       `json:"completed"`
+	Committee    *Extension                 `json:"committee,omitempty"`
+	Feedback     []*Feedback                `json:"feedback,omitempty"`
+}
+
+// Question returns the last user message of the deliberation
+func (d *Deliberation) Question() string {
+	if d.Request == nil {
+		return ""
+	}
+	for i := len(d.Request.Messages) - 1; i >= 0; i-- {
+		message := d.Request.Messages[i]
+		if message.Role != llm.RoleUser {
+			continue
+		}
+		if text, ok := message.Content.(string); ok {
+			return text
+		}
+	}
+	return ""
+}
+
+// DeliberationQuery filters the saved deliberations
+type DeliberationQuery = infra.RecordQuery
+
+// NewDeliberation captures the transcript of the run with the completion
+// returned to the client
+func (c *CommitteeContext) NewDeliberation(completion *llm.ChatCompletionResponse, completed bool) *Deliberation {
+	// The final phase rewrites the request for the leader
+	request := *c.Request
+	request.Model = c.Model
+	request.Messages = c.Messages
+	deliberation := &Deliberation{
+		ID:        c.ID,
+		CreatedAt: c.CreatedAt,
+		Parent:    c.Parent,
+		Owner:     c.Owner,
+		Model:     c.Model,
+		Leader:    c.Leader.Name(),
+		Members:   memberNames(c.Members),
+		Strategy:  c.Strategy,
+		Topics:    c.Topics,
+		Request:   &request,
+		Summary:   c.MessageSummary,
+		Opinions:  c.Opinions,
+		Reviews:   c.Reviews,
+		Ranking:   c.Ranking,
+		Answer:    CompletionText(completion),
+		Completed: completed,
+		Committee: c.Extension(),
+	}
+	if completion != nil {
+		deliberation.CompletionID = completion.ID
+	}
+	return deliberation
+}
+
+// SaveDeliberation stores the deliberation when storage is configured
+func (d *CommitteeDomain) SaveDeliberation(ctx context.Context, deliberation *Deliberation) error {
+	if d.Store == nil {
+		return nil
+	}
+	data, err := json.Marshal(deliberation)
+	if err != nil {
+		return errors.Wrap(err, "encode deliberation")
+	}
+	// Index the conversation and the answer for search
+	var text strings.Builder
+	for _, message := range deliberation.Request.Messages {
+		if content, ok := message.Content.(string); ok {
+			text.WriteString(content)
+			text.WriteString("\n")
+		}
+	}
+	text.WriteString(deliberation.Answer)
+
+	return d.Store.Put(ctx, &infra.Record{
+		ID:        deliberation.ID,
+		CreatedAt: deliberation.CreatedAt,
+		Ref:       deliberation.CompletionID,
+		Owner:     deliberation.Owner,
+		Model:     deliberation.Model,
+		Text:      text.String(),
+		Data:      data,
+	})
+}
+
+// GetDeliberation loads a saved deliberation by ID
+func (d *CommitteeDomain) GetDeliberation(ctx context.Context, id string) (*Deliberation, error) {
+	if d.Store == nil {
+		return nil, ErrDeliberationNotFound
+	}
+	record, err := d.Store.Get(ctx, id)
+	if errors.Is(err, infra.ErrNotFound) {
+		return nil, ErrDeliberationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var deliberation Deliberation
+	if err := json.Unmarshal(record.Data, &deliberation); err != nil {
+		return nil, errors.Wrap(err, "decode deliberation")
+	}
+	return &deliberation, nil
+}
+
+// GetDeliberationFor loads a saved deliberation the caller may see
+func (d *CommitteeDomain) GetDeliberationFor(ctx context.Context, caller *auth.Caller, id string) (*Deliberation, error) {
+	deliberation, err := d.GetDeliberation(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !caller.Sees(deliberation.Owner) {
+		return nil, ErrDeliberationNotFound
+	}
+	return deliberation, nil
+}
+
+// ListDeliberations returns saved deliberations matching the query, newest first
+func (d *CommitteeDomain) ListDeliberations(ctx context.Context, query *DeliberationQuery) ([]*Deliberation, error) {
+	if d.Store == nil {
+		return nil, nil
+	}
+	records, err := d.Store.List(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	deliberations := make([]*Deliberation, 0, len(records))
+	for _, record := range records {
+		var deliberation Deliberation
+		if err := json.Unmarshal(record.Data, &deliberation); err != nil {
+			slog.Error("decode deliberation", slog.Any("id", record.ID), slog.Any("err", err))
+			continue
+		}
+		deliberations = append(deliberations, &deliberation)
+	}
+	return deliberations, nil
+}
+
+// finishResponse hooks the final response so that, once the client has read
+// it, the answer is cached and the deliberation is saved
+func (d *CommitteeDomain) finishResponse(c *CommitteeContext) {
+	if c.Response == nil || c.Response.Body == nil {
+		return
+	}
+	save := d.Store != nil && c.CacheStatus != CacheHit
+	cache := d.cacheable(c)
+	if !save && !cache {
+		return
+	}
+
+	stream := c.Request.Stream
+	ok := c.Response.StatusCode == http.StatusOK
+	c.Response.Body = &captureBody{
+		ReadCloser: c.Response.Body,
+		drain:      !stream,
+		onClose: func(data []byte, eof bool) {
+			var completion *llm.ChatCompletionResponse
+			if ok {
+				completion, _ = ReadCompletion(bytes.NewReader(data), stream)
+			}
+			if cache && eof {
+				d.storeCache(c, completion)
+			}
+			if save {
+				deliberation := c.NewDeliberation(completion, ok && eof)
+				if err := d.SaveDeliberation(context.Background(), deliberation); err != nil {
+					slog.Error("save deliberation", slog.Any("id", c.ID), slog.Any("err", err))
+				}
+			}
+		},
+	}
+}
@@ -2,35 +2,310 @@ package committee
 
 import (
 	"context"
+	"reflect"
 	"super-llm/config"
 	"super-llm/infra"
-
-	"github.com/cv70/pkgo/llm"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
 type CommitteeDomain struct {
-	Members map[string]*llm.OpenAIModel
+	Members   map[string]*Member
+	Prices    map[string]*config.PriceConfig
+	Presets   map[string]*config.PresetConfig
+	Cascade   *config.CascadeConfig
+	Consensus *config.ConsensusConfig
+	Embedder  *infra.Embedder
+	// Cache stores final answers by normalized request, nil when disabled
+	Cache    infra.Cache
+	CacheTTL time.Duration
+	// Store saves deliberation transcripts, nil when disabled
+	Store infra.Store
+	// Reputation rates members over time, nil when disabled
+	Reputation *Reputation
+	// Calibration tracks reviewer biases, nil when disabled
+	Calibration *Calibration
+	// Arena rates members in blind comparisons, nil when disabled
+	Arena *Arena
+	// Runs bounds the committee runs in flight, nil when unlimited
+	Runs *infra.Limiter
+
+	// cfg is the configuration the domain was built from
+	cfg *config.Config
+	// limiters are the backend limiters by model
+	limiters map[string]*infra.Limiter
+	// cassettes are the open recorder cassettes by client name
+	cassettes map[string]*infra.Cassette
+
+	// feedbackMu serializes updates of stored deliberations
+	feedbackMu sync.Mutex
 }
 
 func BuildCommitteeDomain(ctx context.Context, cfg *config.Config) (*CommitteeDomain, error) {
-	if cfg == nil || len(cfg.LLMs) == 0 {
-		return nil, errors.New("invalid configuration")
+	return buildCommitteeDomain(ctx, cfg, nil)
+}
+
+// Reload builds the domain of a new configuration. The cache, storage,
+// ratings, cassettes and limiters whose configuration did not change are
+// carried over, so that the runs still in flight on d share them with the
+// new domain. Once those runs finished, Retire closes the rest of d.
+func (d *CommitteeDomain) Reload(ctx context.Context, cfg *config.Config) (*CommitteeDomain, error) {
+	return buildCommitteeDomain(ctx, cfg, d)
+}
+
+func buildCommitteeDomain(ctx context.Context, cfg *config.Config, prev *CommitteeDomain) (_ *CommitteeDomain, err error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid configuration")
 	}
 
-	domain := &CommitteeDomain{
-		Members: map[string]*llm.OpenAIModel{},
+	var old config.Config
+	if prev != nil {
+		old = *prev.cfg
+	}
+	// keep reports whether a part of the previous domain is configured alike
+	keep := func(before, after any) bool {
+		return prev != nil && reflect.DeepEqual(before, after)
 	}
 
-	// Initialize members
+	domain := &CommitteeDomain{
+		Members:   map[string]*Member{},
+		Prices:    cfg.Prices,
+		Presets:   map[string]*config.PresetConfig{},
+		Cascade:   cfg.Cascade,
+		Consensus: cfg.Consensus,
+		Runs:      infra.NewLimiter("committee", cfg.Limits),
+		cfg:       cfg,
+		limiters:  map[string]*infra.Limiter{},
+		cassettes: map[string]*infra.Cassette{},
+	}
+	// A configuration that fails to load closes what it opened
+	defer func() {
+		if err != nil {
+			domain.closeExcept(prev)
+		}
+	}()
+	// Cassettes stay open across reloads that keep the recorder, so that
+	// replays go on where they were
+	var keptCassettes map[string]*infra.Cassette
+	if keep(old.Recorder, cfg.Recorder) {
+		keptCassettes = prev.cassettes
+	}
+	openCassette := func(name string) (*infra.Cassette, error) {
+		cassette := keptCassettes[name]
+		if cassette == nil {
+			var err error
+			if cassette, err = infra.OpenCassette(cfg.Recorder, name); err != nil || cassette == nil {
+				return nil, err
+			}
+		}
+		domain.cassettes[name] = cassette
+		return cassette, nil
+	}
+	if keep(old.Limits, cfg.Limits) {
+		domain.Runs = prev.Runs
+	}
+	if cfg.Consensus != nil && cfg.Consensus.Embedding != nil {
+		embedding := cfg.Consensus.Embedding
+		cassette, err := openCassette("embeddings-" + embedding.Model)
+		if err != nil {
+			return nil, errors.Wrap(err, "cassette of embeddings")
+		}
+		domain.Embedder = infra.NewEmbedder(embedding, cassette)
+	}
+	switch {
+	case keep(old.Cache, cfg.Cache):
+		domain.Cache, domain.CacheTTL = prev.Cache, prev.CacheTTL
+	case cfg.Cache != nil:
+		cache, err := infra.NewCache(cfg.Cache)
+		if err != nil {
+			return nil, errors.Wrap(err, "create cache")
+		}
+		domain.Cache = cache
+		domain.CacheTTL = cfg.Cache.TTL
+	}
+	switch {
+	case keep(old.Storage, cfg.Storage):
+		domain.Store = prev.Store
+	case cfg.Storage != nil:
+		store, err := infra.NewStore(cfg.Storage)
+		if err != nil {
+			return nil, errors.Wrap(err, "open storage")
+		}
+		domain.Store = store
+	}
+	switch {
+	case keep(old.Reputation, cfg.Reputation):
+		domain.Reputation = prev.Reputation
+	case cfg.Reputation != nil:
+		// Ratings of the same file are shared, so that it keeps one writer
+		if prev != nil {
+			domain.Reputation = prev.Reputation.reload(cfg.Reputation)
+		}
+		if domain.Reputation == nil {
+			reputation, err := NewReputation(cfg.Reputation)
+			if err != nil {
+				return nil, errors.Wrap(err, "load reputation")
+			}
+			domain.Reputation = reputation
+		}
+	}
+	switch {
+	case keep(old.Calibration, cfg.Calibration):
+		domain.Calibration = prev.Calibration
+	case cfg.Calibration != nil:
+		if prev != nil {
+			domain.Calibration = prev.Calibration.reload(cfg.Calibration)
+		}
+		if domain.Calibration == nil {
+			calibration, err := NewCalibration(cfg.Calibration)
+			if err != nil {
+				return nil, errors.Wrap(err, "load calibration")
+			}
+			domain.Calibration = calibration
+		}
+	}
+	switch {
+	case keep(old.Arena, cfg.Arena):
+		domain.Arena = prev.Arena
+	case cfg.Arena != nil:
+		var prevArena *Arena
+		if prev != nil {
+			prevArena = prev.Arena
+		}
+		arena, err := newArena(cfg.Arena, prevArena)
+		if err != nil {
+			return nil, errors.Wrap(err, "load arena")
+		}
+		domain.Arena = arena
+	}
+	// Members sharing a backend share its limits
+	limiters := domain.limiters
 	for _, llmCfg := range cfg.LLMs {
-		model, err := infra.NewLLM(ctx, llmCfg)
+		if before := old.FindLLM(llmCfg.Model); before != nil && keep(before.Limits, llmCfg.Limits) {
+			limiters[llmCfg.Model] = prev.limiters[llmCfg.Model]
+			continue
+		}
+		limiters[llmCfg.Model] = infra.NewLimiter(llmCfg.Model, llmCfg.Limits)
+	}
+	for _, preset := range cfg.Presets {
+		domain.Presets[preset.Name] = preset
+	}
+
+	// Without explicit members every LLM takes a seat under its model name
+	if len(cfg.Members) == 0 {
+		for _, llmCfg := range cfg.LLMs {
+			cassette, err := openCassette(llmCfg.Model)
+			if err != nil {
+				return nil, errors.Wrapf(err, "cassette of %s", llmCfg.Model)
+			}
+			model, err := infra.NewLLM(ctx, llmCfg, cassette, limiters[llmCfg.Model])
+			if err != nil {
+				return nil, errors.Errorf("failed to create LLM for %s: %v", llmCfg.Model, err)
+			}
+
+			domain.Members[model.Name()] = &Member{
+				LLM:        model,
+				MemberName: model.Name(),
+				ModelName:  model.Name(),
+			}
+		}
+		return domain, domain.validatePresets()
+	}
+
+	// Initialize virtual members, each with its own client and sampling
+	for _, memberCfg := range cfg.Members {
+		base := cfg.FindLLM(memberCfg.LLM)
+		if base == nil {
+			return nil, errors.Errorf("member %s: llm %s not found", memberCfg.Name, memberCfg.LLM)
+		}
+		name := memberCfg.Name
+		if name == "" {
+			name = base.Model
+		}
+		if domain.Members[name] != nil {
+			return nil, errors.Errorf("duplicate member name %s", name)
+		}
+
+		cassette, err := openCassette(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cassette of member %s", name)
+		}
+		model, err := infra.NewLLM(ctx, memberCfg.ResolveLLM(base), cassette, limiters[base.Model])
 		if err != nil {
-			return nil, errors.Errorf("failed to create LLM for %s: %v", llmCfg.Model, err)
+			return nil, errors.Errorf("failed to create LLM for member %s: %v", name, err)
 		}
 
-		domain.Members[model.Name()] = model
+		domain.Members[name] = &Member{
+			LLM:        model,
+			MemberName: name,
+			ModelName:  base.Model,
+			Persona:    memberCfg.Persona,
+			Prompt:     memberCfg.Prompt,
+		}
+	}
+	return domain, domain.validatePresets()
+}
+
+// Close saves what the domain holds in memory and closes its storage and
+// cassettes. It is called once no run uses the domain anymore.
+func (d *CommitteeDomain) Close() error {
+	return d.closeExcept(nil)
+}
+
+// Retire closes what the domain holds that next, the domain it was reloaded
+// into, did not carry over. It is called once no run uses the domain
+// anymore.
+func (d *CommitteeDomain) Retire(next *CommitteeDomain) error {
+	return d.closeExcept(next)
+}
+
+// closeExcept closes what the domain holds that next does not share, all of
+// it when next is nil
+func (d *CommitteeDomain) closeExcept(next *CommitteeDomain) error {
+	if next == nil {
+		next = &CommitteeDomain{}
+	}
+	var flushes []func() error
+	for name, cassette := range d.cassettes {
+		if next.cassettes[name] != cassette {
+			flushes = append(flushes, cassette.Close)
+		}
+	}
+	if d.Store != nil && d.Store != next.Store {
+		flushes = append(flushes, d.Store.Close)
+	}
+	// Ratings shared with next are saved again, which does no harm
+	if d.Reputation != nil && d.Reputation != next.Reputation {
+		flushes = append(flushes, d.Reputation.Flush)
+	}
+	if d.Calibration != nil && d.Calibration != next.Calibration {
+		flushes = append(flushes, d.Calibration.Flush)
+	}
+	if d.Arena != nil && d.Arena != next.Arena {
+		flushes = append(flushes, d.Arena.Close)
+	}
+	var first error
+	for _, flush := range flushes {
+		if err := flush(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// validatePresets checks that presets only reference seated members
+func (d *CommitteeDomain) validatePresets() error {
+	for name, preset := range d.Presets {
+		if d.Members[preset.Leader] == nil {
+			return errors.Errorf("preset %s: leader %s not found", name, preset.Leader)
+		}
+		for _, member := range preset.Members {
+			if d.Members[member] == nil {
+				return errors.Errorf("preset %s: member %s not found", name, member)
+			}
+		}
 	}
-	return domain, nil
+	return nil
 }
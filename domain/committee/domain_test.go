@@ -0,0 +1,67 @@
+package committee
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"super-llm/config"
+	"super-llm/infra"
+)
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{
+		LLMs: []*config.LLMConfig{{BaseURL: "http://127.0.0.1:1/v1", Model: "fake-model", APIKey: "test"}},
+		Members: []*config.MemberConfig{
+			{Name: "alice", LLM: "fake-model"},
+			{Name: "bob", LLM: "fake-model"},
+		},
+		Storage:    &config.StorageConfig{Type: infra.StorageJSONL, Path: filepath.Join(dir, "a.jsonl")},
+		Reputation: &config.ReputationConfig{Path: filepath.Join(dir, "reputation.json")},
+		Arena:      &config.ArenaConfig{Path: filepath.Join(dir, "arena.json")},
+		Recorder:   &config.RecorderConfig{Mode: "record", Dir: filepath.Join(dir, "cassettes")},
+	}
+	d, err := BuildCommitteeDomain(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Arena.add(&Battle{ID: "open", Created: time.Now().Unix()})
+
+	// The storage moves, the reputation and arena change their settings only
+	next := *cfg
+	next.Storage = &config.StorageConfig{Type: infra.StorageJSONL, Path: filepath.Join(dir, "b.jsonl")}
+	next.Reputation = &config.ReputationConfig{Path: cfg.Reputation.Path, Select: 1}
+	next.Arena = &config.ArenaConfig{Path: cfg.Arena.Path, PeerReview: true}
+	reloaded, err := d.Reload(context.Background(), &next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+
+	if reloaded.cassettes["alice"] == nil || reloaded.cassettes["alice"] != d.cassettes["alice"] {
+		t.Error("cassettes reopened although the recorder did not change")
+	}
+	if reloaded.Reputation.Select != 1 || reloaded.Reputation.flusher != d.Reputation.flusher {
+		t.Error("reputation of the same file not shared with the new settings")
+	}
+	if reloaded.Arena.Ratings.flusher != d.Arena.Ratings.flusher || reloaded.Arena.battles["open"] == nil {
+		t.Error("arena of the same file did not take over the ratings and open battles")
+	}
+	d.Reputation.RecordRanking(nil, []string{"alice", "bob"})
+	if reloaded.Reputation.rating(TopicAll, "alice").Games != 1 {
+		t.Error("ratings recorded by runs of the previous domain are lost")
+	}
+
+	if err := d.Retire(reloaded); err != nil {
+		t.Fatal(err)
+	}
+	record := &infra.Record{ID: "x", CreatedAt: time.Now(), Data: []byte("{}")}
+	if err := d.Store.Put(context.Background(), record); err == nil {
+		t.Error("replaced storage still open after Retire")
+	}
+	if err := reloaded.Store.Put(context.Background(), record); err != nil {
+		t.Errorf("new storage: %v", err)
+	}
+}
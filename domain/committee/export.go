@@ -0,0 +1,218 @@
+package committee
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"super-llm/infra"
+
+	"github.com/cv70/pkgo/llm"
+	"github.com/pkg/errors"
+)
+
+// Export formats
+const (
+	// ExportDPO writes preference pairs of a chosen and a rejected answer
+	ExportDPO = "dpo"
+	// ExportSFT writes the conversation followed by the final answer
+	ExportSFT = "sft"
+)
+
+// Chosen answers of preference pairs
+const (
+	// ChosenFinal picks the leader's final answer
+	ChosenFinal = "final"
+	// ChosenTop picks the top ranked opinion, or the one the user preferred
+	ChosenTop = "top"
+)
+
+// Feedback filters of exports
+const (
+	FeedbackAny      = "any"
+	FeedbackPositive = "positive"
+	FeedbackNegative = "negative"
+	FeedbackNone     = "none"
+)
+
+const exportPageSize = 100
+
+// ExportOptions selects the deliberations to export and their format
+type ExportOptions struct {
+	Format string
+	// Chosen is ChosenFinal (default) or ChosenTop for preference pairs
+	Chosen string
+	Since  time.Time
+	Until  time.Time
+	// Model matches the requested preset or leader
+	Model string
+	// Owner keeps the deliberations of one API key, all of them when empty
+	Owner string
+	// MinAgreement keeps deliberations whose opinions agreed at least this much
+	MinAgreement float64
+	// Feedback is FeedbackAny, FeedbackPositive, FeedbackNegative or FeedbackNone
+	Feedback string
+}
+
+// Validate checks the options and fills in defaults
+func (o *ExportOptions) Validate() error {
+	switch o.Format {
+	case "":
+		o.Format = ExportDPO
+	case ExportDPO, ExportSFT:
+	default:
+		return errors.Errorf("unknown export format %s", o.Format)
+	}
+	switch o.Chosen {
+	case "":
+		o.Chosen = ChosenFinal
+	case ChosenFinal, ChosenTop:
+	default:
+		return errors.Errorf("unknown chosen answer %s", o.Chosen)
+	}
+	switch o.Feedback {
+	case "", FeedbackAny, FeedbackPositive, FeedbackNegative, FeedbackNone:
+	default:
+		return errors.Errorf("unknown feedback filter %s", o.Feedback)
+	}
+	return nil
+}
+
+// PreferencePair is a DPO example in the conversational format
+type PreferencePair struct {
+	Prompt   []*llm.ChatMessage `json:"prompt"`
+	Chosen   []*llm.ChatMessage `json:"chosen"`
+	Rejected []*llm.ChatMessage `json:"rejected"`
+	// Source fields for tracing the example back to its deliberation
+	Deliberation   string `json:"deliberation"`
+	ChosenMember   string `json:"chosen_member,omitempty"`
+	RejectedMember string `json:"rejected_member"`
+}
+
+// SFTExample is a supervised fine-tuning example
+type SFTExample struct {
+	Messages     []*llm.ChatMessage `json:"messages"`
+	Deliberation string             `json:"deliberation"`
+}
+
+// ExportDeliberations writes the matching deliberations as JSON Lines and
+// returns the number of examples written
+func (d *CommitteeDomain) ExportDeliberations(ctx context.Context, w io.Writer, opts *ExportOptions) (int, error) {
+	if err := opts.Validate(); err != nil {
+		return 0, err
+	}
+	if d.Store == nil {
+		return 0, errors.New("storage is not configured")
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	count := 0
+	query := &DeliberationQuery{Owner: opts.Owner, Model: opts.Model, Since: opts.Since, Until: opts.Until, Limit: exportPageSize}
+	for {
+		deliberations, err := d.ListDeliberations(ctx, query)
+		if err != nil {
+			return count, err
+		}
+		for _, deliberation := range deliberations {
+			if !opts.match(deliberation) {
+				continue
+			}
+			example := opts.example(deliberation)
+			if example == nil {
+				continue
+			}
+			if err := encoder.Encode(example); err != nil {
+				return count, errors.Wrap(err, "write example")
+			}
+			count++
+		}
+		if len(deliberations) < exportPageSize {
+			return count, nil
+		}
+		// Page by position rather than offset, so that deliberations saved
+		// during the export neither repeat nor skip records
+		last := deliberations[len(deliberations)-1]
+		query.After = &infra.Cursor{CreatedAt: last.CreatedAt, ID: last.ID}
+	}
+}
+
+func (o *ExportOptions) match(deliberation *Deliberation) bool {
+	if !deliberation.Completed || deliberation.Answer == "" || deliberation.Request == nil {
+		return false
+	}
+	if o.MinAgreement > 0 {
+		consensus := deliberation.Committee.consensus()
+		if consensus == nil || consensus.Score < o.MinAgreement {
+			return false
+		}
+	}
+
+	positive, negative := false, false
+	for _, feedback := range deliberation.Feedback {
+		approval, ok := feedback.Approval()
+		positive = positive || feedback.Preferred != "" || ok && approval >= 0.5
+		negative = negative || ok && approval < 0.5
+	}
+	switch o.Feedback {
+	case FeedbackAny:
+		return len(deliberation.Feedback) > 0
+	case FeedbackPositive:
+		return positive && !negative
+	case FeedbackNegative:
+		return negative
+	case FeedbackNone:
+		return len(deliberation.Feedback) == 0
+	}
+	return true
+}
+
+// example converts a deliberation, nil when it makes no example
+func (o *ExportOptions) example(deliberation *Deliberation) any {
+	prompt := deliberation.Request.Messages
+	if o.Format == ExportSFT {
+		return &SFTExample{
+			Messages:     append(prompt[:len(prompt):len(prompt)], assistantMessage(deliberation.Answer)),
+			Deliberation: deliberation.ID,
+		}
+	}
+
+	ranking := deliberation.Ranking
+	if len(ranking) < 2 {
+		return nil
+	}
+	pair := &PreferencePair{
+		Prompt:         prompt,
+		Deliberation:   deliberation.ID,
+		RejectedMember: ranking[len(ranking)-1],
+	}
+	chosen := deliberation.Answer
+	if o.Chosen == ChosenTop {
+		pair.ChosenMember = ranking[0]
+		for _, feedback := range deliberation.Feedback {
+			if feedback.Preferred != "" {
+				pair.ChosenMember = feedback.Preferred
+			}
+		}
+		chosen = deliberation.Opinions[pair.ChosenMember]
+	}
+	rejected := deliberation.Opinions[pair.RejectedMember]
+	if pair.ChosenMember == pair.RejectedMember || chosen == "" || rejected == "" || chosen == rejected {
+		return nil
+	}
+	pair.Chosen = []*llm.ChatMessage{assistantMessage(chosen)}
+	pair.Rejected = []*llm.ChatMessage{assistantMessage(rejected)}
+	return pair
+}
+
+func assistantMessage(text string) *llm.ChatMessage {
+	return &llm.ChatMessage{Role: llm.RoleAssistant, Content: text}
+}
+
+func (e *Extension) consensus() *ConsensusReport {
+	if e == nil {
+		return nil
+	}
+	return e.Consensus
+}
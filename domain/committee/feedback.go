@@ -0,0 +1,128 @@
+package committee
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"super-llm/domain/auth"
+
+	"github.com/pkg/errors"
+)
+
+// Thumbs ratings
+const (
+	RatingUp   = "up"
+	RatingDown = "down"
+)
+
+// ErrInvalidFeedback is returned for feedback that cannot be recorded
+var ErrInvalidFeedback = errors.New("invalid feedback")
+
+// Feedback is a user's judgment of a deliberation
+type Feedback struct {
+	CreatedAt time.Time `json:"created_at"`
+	// Rating is RatingUp or RatingDown
+	Rating string `json:"rating,omitempty"`
+	// Score grades the answer from 0 to 1
+	Score *float64 `json:"score,omitempty"`
+	// Preferred names the member whose opinion the user preferred
+	Preferred string `json:"preferred,omitempty"`
+	Comment   string `json:"comment,omitempty"`
+	// Author is the API key that gave the feedback, empty when the API is
+	// open
+	Author string `json:"author,omitempty"`
+}
+
+// Approval maps the rating and score to a single grade from 0 to 1, false
+// when the feedback carries neither
+func (f *Feedback) Approval() (float64, bool) {
+	if f.Score != nil {
+		return *f.Score, true
+	}
+	switch f.Rating {
+	case RatingUp:
+		return 1, true
+	case RatingDown:
+		return 0, true
+	}
+	return 0, false
+}
+
+func (f *Feedback) validate(deliberation *Deliberation) error {
+	if f.Rating == "" && f.Score == nil && f.Preferred == "" {
+		return errors.Wrap(ErrInvalidFeedback, "rating, score or preferred is required")
+	}
+	if f.Rating != "" && f.Rating != RatingUp && f.Rating != RatingDown {
+		return errors.Wrapf(ErrInvalidFeedback, "unknown rating %s", f.Rating)
+	}
+	if f.Score != nil && (*f.Score < 0 || *f.Score > 1) {
+		return errors.Wrap(ErrInvalidFeedback, "score must be between 0 and 1")
+	}
+	if f.Preferred != "" && deliberation.Opinions[f.Preferred] == "" {
+		return errors.Wrapf(ErrInvalidFeedback, "member %s gave no opinion", f.Preferred)
+	}
+	return nil
+}
+
+// findDeliberation looks a deliberation up by its ID or by the ID of the
+// completion returned for it, among those the caller may see
+func (d *CommitteeDomain) findDeliberation(ctx context.Context, caller *auth.Caller, id string) (*Deliberation, error) {
+	deliberation, err := d.GetDeliberationFor(ctx, caller, id)
+	if !errors.Is(err, ErrDeliberationNotFound) || d.Store == nil {
+		return deliberation, err
+	}
+	deliberations, err := d.ListDeliberations(ctx, &DeliberationQuery{Ref: id, Owner: caller.Scope(), Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(deliberations) == 0 {
+		return nil, ErrDeliberationNotFound
+	}
+	return deliberations[0], nil
+}
+
+// AddFeedback stores feedback with the deliberation, identified by its own
+// ID or its completion ID. A caller keeps one feedback per deliberation:
+// later feedback replaces the earlier one, and only the first is fed into
+// member reputation.
+func (d *CommitteeDomain) AddFeedback(ctx context.Context, caller *auth.Caller, id string, feedback *Feedback) (*Deliberation, error) {
+	d.feedbackMu.Lock()
+	defer d.feedbackMu.Unlock()
+
+	deliberation, err := d.findDeliberation(ctx, caller, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := feedback.validate(deliberation); err != nil {
+		return nil, err
+	}
+	feedback.CreatedAt = time.Now()
+	feedback.Author = caller.Owner()
+	earlier := slices.IndexFunc(deliberation.Feedback, func(f *Feedback) bool { return f.Author == feedback.Author })
+	if earlier >= 0 {
+		deliberation.Feedback[earlier] = feedback
+	} else {
+		deliberation.Feedback = append(deliberation.Feedback, feedback)
+	}
+	if err := d.SaveDeliberation(ctx, deliberation); err != nil {
+		return nil, errors.Wrap(err, "save deliberation")
+	}
+
+	if d.Reputation != nil && earlier < 0 {
+		if feedback.Preferred != "" {
+			var others []string
+			for name, opinion := range deliberation.Opinions {
+				if opinion != "" {
+					others = append(others, name)
+				}
+			}
+			slices.Sort(others)
+			d.Reputation.RecordPreference(deliberation.Topics, feedback.Preferred, others)
+		}
+		if approval, ok := feedback.Approval(); ok {
+			d.Reputation.RecordApproval(deliberation.Topics, deliberation.Ranking, approval)
+		}
+	}
+	return deliberation, nil
+}
@@ -0,0 +1,65 @@
+package committee
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"super-llm/config"
+	"super-llm/domain/auth"
+	"super-llm/infra"
+	"super-llm/infra/fake"
+)
+
+// TestFeedbackPerCaller keeps one feedback per caller and deliberation and
+// rates the members from the first one only
+func TestFeedbackPerCaller(t *testing.T) {
+	dir := t.TempDir()
+	d := newFakeDomain(t, &fake.Config{}, func(cfg *config.Config) {
+		cfg.Storage = &config.StorageConfig{Type: infra.StorageJSONL, Path: filepath.Join(dir, "deliberations.jsonl")}
+		cfg.Reputation = &config.ReputationConfig{Path: filepath.Join(dir, "reputation.json")}
+	})
+	keys, err := auth.New(&config.AuthConfig{Keys: []*config.APIKeyConfig{
+		{Key: "sk-a", Name: "team-a"},
+		{Key: "sk-b", Name: "team-b"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := keys.Caller(keys.Authenticate("sk-a")), keys.Caller(keys.Authenticate("sk-b"))
+
+	c, err := d.RunCommitteeProcess(context.Background(), question(), &RunOptions{Caller: a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ReadResponse(); err != nil {
+		t.Fatal(err)
+	}
+	games := func() int {
+		for _, rating := range d.Reputation.Leaderboard(TopicAll, []string{"alice"}) {
+			return rating.Games
+		}
+		return 0
+	}
+	before := games()
+
+	for _, comment := range []string{"first", "second", "third"} {
+		if _, err := d.AddFeedback(context.Background(), a, c.ID, &Feedback{Preferred: "alice", Comment: comment}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deliberation, err := d.AddFeedback(context.Background(), nil, c.ID, &Feedback{Preferred: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliberation.Feedback) != 2 || deliberation.Feedback[0].Author != "team-a" || deliberation.Feedback[0].Comment != "third" {
+		t.Errorf("feedback %+v, want the latest of team-a and the open API's", deliberation.Feedback)
+	}
+	if games() != before+2 {
+		t.Errorf("alice played %d games after feedback, want %d", games(), before+2)
+	}
+
+	if _, err := d.AddFeedback(context.Background(), b, c.ID, &Feedback{Preferred: "alice"}); err == nil {
+		t.Error("feedback on another key's deliberation accepted")
+	}
+}
@@ -0,0 +1,46 @@
+package committee
+
+import (
+	"super-llm/infra"
+
+	"google.golang.org/adk/model"
+	"google.golang.org/genai"
+)
+
+// Member is a committee seat backed by an LLM endpoint of any provider.
+// Several members may share one backend and differ only in sampling, persona
+// and prompt variant.
+type Member struct {
+	infra.LLM
+	MemberName string
+	// ModelName is the backend model
+	ModelName string
+	Persona   string
+	Prompt    string
+}
+
+// Name returns the member name, which may differ from the backend model name
+func (m *Member) Name() string {
+	return m.MemberName
+}
+
+// NewRequest builds a single-turn request carrying the member's persona
+func (m *Member) NewRequest(prompt string) *model.LLMRequest {
+	req := &model.LLMRequest{
+		Contents: []*genai.Content{genai.NewContentFromText(prompt, genai.RoleUser)},
+	}
+	if m.Persona != "" {
+		req.Config = &genai.GenerateContentConfig{
+			SystemInstruction: genai.NewContentFromText(m.Persona, genai.RoleUser),
+		}
+	}
+	return req
+}
+
+// OpinionPrompt applies the member's prompt variant to the question
+func (m *Member) OpinionPrompt(question string) string {
+	if m.Prompt == "" {
+		return question
+	}
+	return question + "\n\n" + m.Prompt
+}
@@ -0,0 +1,147 @@
+package committee
+
+import (
+	"cmp"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// rankLine matches the numbered lines of a review, e.g. "1. 评分最高的回复：xxx"
+var rankLine = regexp.MustCompile(`^\s*\d+\s*[.、)）]\s*(.*)$`)
+
+// parseRanking extracts the ranked candidates from a review, best first
+func parseRanking(review []string, candidates []string) []string {
+	var ranking []string
+	for _, line := range review {
+		match := rankLine.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		label, value, ok := cutLabel(match[1])
+		if !ok || strings.Contains(label, "评价") {
+			continue
+		}
+		name := matchCandidate(value, candidates)
+		if name != "" && !slices.Contains(ranking, name) {
+			ranking = append(ranking, name)
+		}
+	}
+	return ranking
+}
+
+// cutLabel splits "label：value" on the last full-width or ASCII colon
+func cutLabel(s string) (string, string, bool) {
+	i := max(strings.LastIndex(s, "："), strings.LastIndex(s, ":"))
+	if i < 0 {
+		return "", "", false
+	}
+	_, size := utf8.DecodeRuneInString(s[i:])
+	return s[:i], s[i+size:], true
+}
+
+// matchCandidate finds the candidate named in s, preferring an exact match
+// and then the longest name contained in s
+func matchCandidate(s string, candidates []string) string {
+	s = strings.ToLower(strings.Trim(strings.TrimSpace(s), "[]【】*`\"'。."))
+	var best string
+	for _, candidate := range candidates {
+		name := strings.ToLower(candidate)
+		if name == s {
+			return candidate
+		}
+		if strings.Contains(s, name) && len(candidate) > len(best) {
+			best = candidate
+		}
+	}
+	return best
+}
+
+// parseRankings extracts every reviewer's ranking. With excludeSelf the
+// reviewer's own opinion is not a candidate.
+func parseRankings(reviews map[string][]string, candidates []string, excludeSelf bool) map[string][]string {
+	rankings := map[string][]string{}
+	for reviewer, review := range reviews {
+		names := candidates
+		if excludeSelf {
+			names = slices.DeleteFunc(slices.Clone(candidates), func(name string) bool {
+				return name == reviewer
+			})
+		}
+		if ranking := parseRanking(review, names); len(ranking) > 0 {
+			rankings[reviewer] = ranking
+		}
+	}
+	return rankings
+}
+
+// aggregateRanking combines the reviewers' rankings into one by Borda count:
+// a candidate ranked at position i of n earns n-i points, scaled by the
+// reviewer's weight (1 when weights is nil). Returns nil without rankings.
+func aggregateRanking(rankings map[string][]string, candidates []string, weights map[string]float64) []string {
+	if len(rankings) == 0 {
+		return nil
+	}
+	points := map[string]float64{}
+	for reviewer, ranking := range rankings {
+		weight := 1.0
+		if weights != nil {
+			weight = weights[reviewer]
+		}
+		for i, name := range ranking {
+			points[name] += weight * float64(len(candidates)-i)
+		}
+	}
+
+	ranking := slices.Clone(candidates)
+	slices.SortFunc(ranking, func(a, b string) int {
+		if c := cmp.Compare(points[b], points[a]); c != 0 {
+			return c
+		}
+		return cmp.Compare(a, b)
+	})
+	return ranking
+}
+
+// rankOpinions aggregates the reviews of the run into the committee ranking,
+// weighting reviewers by their calibration when enabled
+func (d *CommitteeDomain) rankOpinions(c *CommitteeContext) {
+	var candidates []string
+	for name, opinion := range c.ReviewOpinions {
+		if opinion != "" {
+			candidates = append(candidates, name)
+		}
+	}
+	slices.Sort(candidates)
+
+	c.ReviewRankings = parseRankings(c.Reviews, candidates, d.excludeSelf())
+	if d.Calibration != nil && d.Calibration.DownWeight {
+		c.ReviewerWeights = d.Calibration.Weights(slices.Sorted(maps.Keys(c.ReviewRankings)))
+	}
+	c.Ranking = aggregateRanking(c.ReviewRankings, candidates, c.ReviewerWeights)
+}
+
+// recordRanking feeds the ranking of the run to calibration and reputation
+func (d *CommitteeDomain) recordRanking(c *CommitteeContext) {
+	if d.Calibration != nil {
+		lengths := map[string]int{}
+		families := map[string]string{}
+		for _, name := range c.Ranking {
+			lengths[name] = utf8.RuneCountInString(c.Opinions[name])
+			if member := c.Members[name]; member != nil {
+				families[name] = member.ModelName
+			}
+		}
+		d.Calibration.Record(c.ReviewRankings, c.Ranking, lengths, families)
+	}
+	if d.Reputation != nil {
+		d.Reputation.RecordRanking(c.Topics, c.Ranking)
+	}
+}
+
+// excludeSelf reports whether reviewers are kept from their own opinions
+func (d *CommitteeDomain) excludeSelf() bool {
+	return d.Calibration != nil && d.Calibration.ExcludeSelf
+}
@@ -0,0 +1,312 @@
+package committee
+
+import (
+	"cmp"
+	"encoding/json"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"super-llm/config"
+	"super-llm/infra"
+
+	"github.com/pkg/errors"
+)
+
+// TopicAll holds the ratings across all topics
+const TopicAll = "all"
+
+const (
+	defaultRating = 1500.0
+	defaultEloK   = 16.0
+)
+
+// match is a game between two members; score is a's result, 1 for a win,
+// 0 for a loss and anything between for a partial win
+type match struct {
+	a, b  string
+	score float64
+}
+
+// Rating is a member's Elo rating within one topic
+type Rating struct {
+	Rating float64 `json:"rating"`
+	Games  int     `json:"games"`
+}
+
+// MemberRating is a leaderboard entry
+type MemberRating struct {
+	Member string  `json:"member"`
+	Rating float64 `json:"rating"`
+	Games  int     `json:"games"`
+	// Weight is the expected score against the average member, 0.5 for an
+	// average rating
+	Weight float64 `json:"weight"`
+}
+
+// Reputation keeps persistent Elo ratings of members by topic, updated from
+// the committee ranking of every deliberation
+type Reputation struct {
+	// mu guards the ratings, shared by the reputations of reloads
+	mu   *sync.RWMutex
+	path string
+	k    float64
+	// ratings maps topic to member to rating
+	ratings map[string]map[string]*Rating
+	flusher *infra.Flusher
+
+	// Select seats the highest rated members when a request names none
+	Select int
+	// Weights shows member weights to the leader
+	Weights bool
+}
+
+// NewReputation loads the ratings file, starting empty if it does not exist
+func NewReputation(c *config.ReputationConfig) (*Reputation, error) {
+	r := &Reputation{
+		mu:      &sync.RWMutex{},
+		path:    reputationPath(c),
+		ratings: map[string]map[string]*Rating{},
+	}
+	r.configure(c)
+	r.flusher = infra.NewFlusher(r.path, r.snapshot)
+	data, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read reputation")
+	}
+	if err := json.Unmarshal(data, &r.ratings); err != nil {
+		return nil, errors.Wrap(err, "decode reputation")
+	}
+	return r, nil
+}
+
+// reload returns the reputation of a new configuration. A configuration of
+// the same file shares the ratings with r, so that the file keeps a single
+// writer; nil is returned for another file.
+func (r *Reputation) reload(c *config.ReputationConfig) *Reputation {
+	if r == nil || r.path != reputationPath(c) {
+		return nil
+	}
+	next := &Reputation{mu: r.mu, path: r.path, ratings: r.ratings, flusher: r.flusher}
+	next.configure(c)
+	return next
+}
+
+// configure applies the settings of the configuration
+func (r *Reputation) configure(c *config.ReputationConfig) {
+	r.k = c.K
+	if r.k <= 0 {
+		r.k = defaultEloK
+	}
+	r.Select = c.Select
+	r.Weights = c.Weights
+}
+
+func reputationPath(c *config.ReputationConfig) string {
+	if c.Path == "" {
+		return "reputation.json"
+	}
+	return c.Path
+}
+
+// NormalizeTopics lowercases topic tags and drops empty ones and duplicates
+func NormalizeTopics(topics []string) []string {
+	var normalized []string
+	for _, topic := range topics {
+		topic = strings.ToLower(strings.TrimSpace(topic))
+		if topic != "" && topic != TopicAll && !slices.Contains(normalized, topic) {
+			normalized = append(normalized, topic)
+		}
+	}
+	return normalized
+}
+
+// RecordRanking updates the ratings from a ranking, best first, treating it
+// as a set of pairwise wins. The update is applied overall and per topic.
+func (r *Reputation) RecordRanking(topics []string, ranking []string) {
+	if len(ranking) < 2 {
+		return
+	}
+	var matches []match
+	for i, winner := range ranking {
+		for _, loser := range ranking[i+1:] {
+			matches = append(matches, match{winner, loser, 1})
+		}
+	}
+	r.record(topics, matches, r.k/float64(len(ranking)-1))
+}
+
+// RecordPreference updates the ratings from one member preferred over others
+func (r *Reputation) RecordPreference(topics []string, winner string, losers []string) {
+	var matches []match
+	for _, loser := range losers {
+		if loser != winner {
+			matches = append(matches, match{winner, loser, 1})
+		}
+	}
+	if len(matches) == 0 {
+		return
+	}
+	r.record(topics, matches, r.k)
+}
+
+// RecordTie updates the ratings from a draw between all given members
+func (r *Reputation) RecordTie(topics []string, members []string) {
+	if len(members) < 2 {
+		return
+	}
+	var matches []match
+	for i, a := range members {
+		for _, b := range members[i+1:] {
+			matches = append(matches, match{a, b, 0.5})
+		}
+	}
+	r.record(topics, matches, r.k/float64(len(members)-1))
+}
+
+// RecordApproval updates the ratings from a judgment of the committee's
+// favourite: score 1 confirms that ranking[0] beats every other member,
+// score 0 reverses it
+func (r *Reputation) RecordApproval(topics []string, ranking []string, score float64) {
+	if len(ranking) < 2 {
+		return
+	}
+	var matches []match
+	for _, other := range ranking[1:] {
+		matches = append(matches, match{ranking[0], other, score})
+	}
+	r.record(topics, matches, r.k/float64(len(ranking)-1))
+}
+
+// record applies pairwise Elo updates computed from the ratings before the
+// update, then schedules saving the ratings
+func (r *Reputation) record(topics []string, matches []match, k float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, topic := range append([]string{TopicAll}, topics...) {
+		ratings := r.ratings[topic]
+		if ratings == nil {
+			ratings = map[string]*Rating{}
+			r.ratings[topic] = ratings
+		}
+		deltas := map[string]float64{}
+		for _, m := range matches {
+			a, b := r.get(ratings, m.a), r.get(ratings, m.b)
+			delta := k * (m.score - expectedScore(a.Rating, b.Rating))
+			deltas[m.a] += delta
+			deltas[m.b] -= delta
+		}
+		for member, delta := range deltas {
+			rating := r.get(ratings, member)
+			rating.Rating += delta
+			rating.Games++
+		}
+	}
+	r.flusher.Mark()
+}
+
+func (r *Reputation) get(ratings map[string]*Rating, member string) *Rating {
+	rating := ratings[member]
+	if rating == nil {
+		rating = &Rating{Rating: defaultRating}
+		ratings[member] = rating
+	}
+	return rating
+}
+
+func (r *Reputation) snapshot() ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return json.MarshalIndent(r.ratings, "", "  ")
+}
+
+// Flush saves the rating updates not yet written
+func (r *Reputation) Flush() error {
+	return r.flusher.Flush()
+}
+
+// rating returns the member's rating within the topic, falling back to the
+// overall rating for members not yet rated in it
+func (r *Reputation) rating(topic, member string) Rating {
+	if rating := r.ratings[topic][member]; rating != nil {
+		return *rating
+	}
+	if rating := r.ratings[TopicAll][member]; rating != nil {
+		return *rating
+	}
+	return Rating{Rating: defaultRating}
+}
+
+// Leaderboard ranks the given members, or every rated member when members
+// is empty, within the topic
+func (r *Reputation) Leaderboard(topic string, members []string) []*MemberRating {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if topic == "" {
+		topic = TopicAll
+	}
+	if len(members) == 0 {
+		for member := range r.ratings[topic] {
+			members = append(members, member)
+		}
+	}
+
+	board := make([]*MemberRating, 0, len(members))
+	var mean float64
+	for _, member := range members {
+		rating := r.rating(topic, member)
+		mean += rating.Rating / float64(len(members))
+		board = append(board, &MemberRating{Member: member, Rating: rating.Rating, Games: rating.Games})
+	}
+	for _, entry := range board {
+		entry.Weight = expectedScore(entry.Rating, mean)
+	}
+	slices.SortFunc(board, func(a, b *MemberRating) int {
+		if c := cmp.Compare(b.Rating, a.Rating); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Member, b.Member)
+	})
+	return board
+}
+
+// Topics lists the topics with ratings
+func (r *Reputation) Topics() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	topics := make([]string, 0, len(r.ratings))
+	for topic := range r.ratings {
+		topics = append(topics, topic)
+	}
+	slices.Sort(topics)
+	return topics
+}
+
+// Top returns the n highest rated of the given members within the topic
+func (r *Reputation) Top(topic string, n int, members []string) []string {
+	board := r.Leaderboard(topic, members)
+	top := make([]string, 0, n)
+	for _, entry := range board[:min(n, len(board))] {
+		top = append(top, entry.Member)
+	}
+	return top
+}
+
+// MemberWeights returns the leaderboard weight of each given member
+func (r *Reputation) MemberWeights(topic string, members []string) map[string]float64 {
+	weights := map[string]float64{}
+	for _, entry := range r.Leaderboard(topic, members) {
+		weights[entry.Member] = entry.Weight
+	}
+	return weights
+}
+
+// expectedScore is the Elo probability that a beats b
+func expectedScore(a, b float64) float64 {
+	return 1 / (1 + math.Pow(10, (b-a)/400))
+}
@@ -0,0 +1,156 @@
+package committee
+
+import (
+	"context"
+	"maps"
+	"text/template"
+
+	"super-llm/domain/auth"
+	"super-llm/infra"
+
+	"github.com/cv70/pkgo/llm"
+	"github.com/pkg/errors"
+)
+
+// Rerun phases
+const (
+	// RerunFinal re-runs only the final answer
+	RerunFinal = "final"
+	// RerunReview re-runs the review and the final answer
+	RerunReview = "review"
+)
+
+// ErrInvalidRerun is returned when a rerun cannot be made as requested
+var ErrInvalidRerun = errors.New("invalid rerun")
+
+// FinalPromptData is passed to custom final answer templates
+type FinalPromptData struct {
+	Summary  string
+	Opinions map[string]string
+	Reviews  map[string][]string
+	// Ranking is the aggregated ranking of the reviews, best first
+	Ranking []string
+	// Weights are the members' reputation weights, when enabled
+	Weights map[string]float64
+}
+
+// RerunOptions selects what to change when re-running a deliberation
+type RerunOptions struct {
+	// Phase is RerunFinal (default) or RerunReview
+	Phase string
+	// Leader replaces the original leader
+	Leader string
+	// Reviewers replace the original members in the review phase
+	Reviewers []string
+	// Template is a text/template for the final prompt over FinalPromptData
+	Template string
+
+	Stream      bool
+	Temperature *float32
+	TopP        *float32
+	MaxTokens   *int32
+
+	// Budget limits the phases run again
+	Budget *Budget
+	// Caller is the API key of the request, nil when the API is open
+	Caller *auth.Caller
+}
+
+// Rerun answers a stored deliberation again from its saved opinions,
+// re-running only the final answer, or the review and the final answer.
+// The rerun is saved as a new deliberation pointing to the original. Like a
+// run, it holds its place among the runs in flight until the response body
+// is closed.
+func (d *CommitteeDomain) Rerun(ctx context.Context, id string, opts *RerunOptions) (*CommitteeContext, error) {
+	deliberation, err := d.GetDeliberationFor(ctx, opts.Caller, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(deliberation.Opinions) == 0 {
+		return nil, errors.Wrap(ErrInvalidRerun, "deliberation has no opinions")
+	}
+	switch opts.Phase {
+	case "":
+		opts.Phase = RerunFinal
+	case RerunFinal, RerunReview:
+	default:
+		return nil, errors.Wrapf(ErrInvalidRerun, "unknown phase %s", opts.Phase)
+	}
+
+	var final *template.Template
+	if opts.Template != "" {
+		final, err = template.New("final").Parse(opts.Template)
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidRerun, "parse template: %v", err)
+		}
+	}
+
+	req := *deliberation.Request
+	req.Stream = opts.Stream
+	if opts.Leader != "" {
+		req.Model = opts.Leader
+	}
+	if opts.Temperature != nil {
+		req.Temperature = opts.Temperature
+	}
+	if opts.TopP != nil {
+		req.TopP = opts.TopP
+	}
+	if opts.MaxTokens != nil {
+		req.MaxTokens = opts.MaxTokens
+	}
+	// The caller may seat the original members again, but needs access to
+	// the leader and reviewers it swaps in
+	runOpts := &RunOptions{Members: deliberation.Members, Caller: opts.Caller, reseat: true}
+	if opts.Phase == RerunReview && len(opts.Reviewers) > 0 {
+		runOpts.Members, runOpts.reseat = opts.Reviewers, false
+	}
+
+	release, err := d.Runs.Acquire(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	c, err := d.rerun(ctx, deliberation, &req, runOpts, opts, final)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	c.Response.Body = infra.ReleaseOnClose(c.Response.Body, release)
+	return c, nil
+}
+
+// rerun runs the phases of a rerun in its committee slot
+func (d *CommitteeDomain) rerun(ctx context.Context, deliberation *Deliberation, req *llm.ChatCompletionRequest, runOpts *RunOptions, opts *RerunOptions, final *template.Template) (*CommitteeContext, error) {
+	c, err := d.BuildCommitteeContext(ctx, req, runOpts)
+	if errors.Is(err, auth.ErrForbidden) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.Wrapf(ErrInvalidRerun, "build committee context: %v", err)
+	}
+	// The original phases are already paid for; only those run again count
+	// against the budget
+	c.Budget = newBudgetTracker(opts.Budget.Merge(QuotaBudget(opts.Caller)), c.Usage)
+	c.Strategy = StrategyCommittee
+	c.Parent = deliberation.ID
+	c.FinalTemplate = final
+	c.MessageSummary = deliberation.Summary
+	c.Opinions = deliberation.Opinions
+	c.ReviewOpinions = maps.Clone(deliberation.Opinions)
+	c.Reviews = deliberation.Reviews
+	c.Topics = deliberation.Topics
+	c.Ranking = deliberation.Ranking
+
+	if opts.Phase == RerunReview {
+		if err := d.Phase2Review(c); err != nil {
+			return nil, errors.Wrap(err, "phase 2 review")
+		}
+		d.rankOpinions(c)
+	}
+	c.Response, err = d.Phase3FinalAnswer(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "phase 3 final answer")
+	}
+	d.finishResponse(c)
+	return c, nil
+}
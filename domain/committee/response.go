@@ -0,0 +1,148 @@
+package committee
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cv70/pkgo/llm"
+	"github.com/google/uuid"
+)
+
+// Extension is the committee specific field attached to client responses
+type Extension struct {
+	Deliberation string           `json:"deliberation,omitempty"`
+	Parent       string           `json:"parent,omitempty"`
+	Usage        *UsageReport     `json:"usage,omitempty"`
+	Budget       *BudgetReport    `json:"budget,omitempty"`
+	Cascade      *CascadeReport   `json:"cascade,omitempty"`
+	Consensus    *ConsensusReport `json:"consensus,omitempty"`
+	Ranking      []string         `json:"ranking,omitempty"`
+	// ReviewerWeights are the calibration weights used for the ranking
+	ReviewerWeights map[string]float64 `json:"reviewer_weights,omitempty"`
+	Cache           string             `json:"cache,omitempty"`
+	// Choices names the member behind each choice after the leader's answer
+	Choices []string `json:"choices,omitempty"`
+}
+
+// OpinionChoice is a member opinion returned as a choice of its own
+type OpinionChoice struct {
+	// Member is the member name, or a letter when anonymized
+	Member string
+	Text   string
+	// name is the member behind an anonymized choice
+	name string
+}
+
+// OpinionChoices lists the opinions of the run to return next to the answer.
+// Named opinions follow the committee ranking; anonymized ones are shuffled
+// and labelled A, B, C so their order gives nothing away.
+func (c *CommitteeContext) OpinionChoices(named bool) []*OpinionChoice {
+	names := slices.Clone(c.Ranking)
+	for _, name := range slices.Sorted(maps.Keys(c.Opinions)) {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	if !named {
+		rand.Shuffle(len(names), func(i, j int) { names[i], names[j] = names[j], names[i] })
+	}
+
+	var choices []*OpinionChoice
+	for _, name := range names {
+		text := strings.TrimSpace(llm.RemoveThink(c.Opinions[name]))
+		if text == "" {
+			continue
+		}
+		label := name
+		if !named {
+			label = string(rune('A' + len(choices)))
+		}
+		choices = append(choices, &OpinionChoice{Member: label, Text: text, name: name})
+	}
+	return choices
+}
+
+// Extension collects the committee metadata of the run
+func (c *CommitteeContext) Extension() *Extension {
+	return &Extension{
+		Deliberation:    c.ID,
+		Parent:          c.Parent,
+		Usage:           c.Usage.Report(),
+		Budget:          c.Budget.Report(),
+		Cascade:         c.Cascade,
+		Consensus:       c.Consensus,
+		Ranking:         c.Ranking,
+		ReviewerWeights: c.ReviewerWeights,
+		Cache:           c.CacheStatus,
+	}
+}
+
+// NewTextCompletion builds a completion answering with text on behalf of model
+func NewTextCompletion(model, text string) *llm.ChatCompletionResponse {
+	return &llm.ChatCompletionResponse{
+		ID:      "chatcmpl-" + uuid.NewString(),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []llm.ChatChoice{{
+			Index:        0,
+			Message:      &llm.ChatMessage{Role: llm.RoleAssistant, Content: text},
+			FinishReason: "stop",
+		}},
+	}
+}
+
+// NewCompletionResponse wraps a completion produced inside the committee as
+// an OpenAI-compatible HTTP response, encoded as JSON or as an SSE stream.
+// Usage is left out; the API layer reports the committee totals instead.
+func NewCompletionResponse(completion *llm.ChatCompletionResponse, stream bool) *http.Response {
+	resp := *completion
+	resp.Usage = nil
+
+	var body bytes.Buffer
+	header := http.Header{}
+	if !stream {
+		header.Set("Content-Type", "application/json")
+		json.NewEncoder(&body).Encode(&resp)
+	} else {
+		header.Set("Content-Type", "text/event-stream")
+		for _, choice := range resp.Choices {
+			writeChunk(&body, &resp, llm.ChatChoice{Index: choice.Index, Delta: choice.Message})
+			writeChunk(&body, &resp, llm.ChatChoice{Index: choice.Index, Delta: &llm.ChatMessage{Role: llm.RoleAssistant}, FinishReason: choice.FinishReason})
+		}
+		body.WriteString("data: [DONE]\n\n")
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     header,
+		Body:       io.NopCloser(&body),
+	}
+}
+
+func writeChunk(w io.Writer, resp *llm.ChatCompletionResponse, choice llm.ChatChoice) {
+	data, _ := json.Marshal(&llm.ChatCompletionResponse{
+		ID:      resp.ID,
+		Object:  "chat.completion.chunk",
+		Created: resp.Created,
+		Model:   resp.Model,
+		Choices: []llm.ChatChoice{choice},
+	})
+	fmt.Fprintf(w, "data: %s\n\n", data)
+}
+
+// CompletionText returns the text of the first choice of a completion
+func CompletionText(completion *llm.ChatCompletionResponse) string {
+	if completion == nil || len(completion.Choices) == 0 || completion.Choices[0].Message == nil {
+		return ""
+	}
+	text, _ := completion.Choices[0].Message.Content.(string)
+	return text
+}
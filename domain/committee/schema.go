@@ -1,5 +1,7 @@
 package committee
 
+import "super-llm/domain/auth"
+
 type RunCommitteeProcessInput struct {
 	Question string
 	Model    string
@@ -7,4 +9,26 @@ type RunCommitteeProcessInput struct {
 	Opinion  bool
 	Review   bool
 	Stream   bool
-}
\ No newline at end of file
+}
+
+// RunOptions carries the per-request committee settings
+type RunOptions struct {
+	Members []string
+	Opinion bool
+	Review  bool
+	Budget  *Budget
+	// Strategy overrides the preset strategy, StrategyCommittee by default
+	Strategy string
+	// Topics tag the request for member reputation
+	Topics []string
+	// Cache is CacheDefault, CacheRefresh or CacheSkip
+	Cache string
+	// Parent is the deliberation the conversation continues from
+	Parent string
+	// Caller is the API key of the request, nil when the API is open
+	Caller *auth.Caller
+
+	// reseat marks members taken over from a deliberation of the caller,
+	// which need no access check again
+	reseat bool
+}
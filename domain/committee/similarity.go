@@ -0,0 +1,64 @@
+package committee
+
+import (
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/cv70/pkgo/llm"
+)
+
+// lexicalTerms splits text into comparable terms: lowercase words for
+// alphabetic scripts and character bigrams for CJK text, which has no spaces
+func lexicalTerms(text string) map[string]float64 {
+	terms := map[string]float64{}
+	var word strings.Builder
+	var prev rune
+	flush := func() {
+		if word.Len() > 0 {
+			terms[word.String()]++
+			word.Reset()
+		}
+	}
+	for _, r := range strings.ToLower(llm.RemoveThink(text)) {
+		switch {
+		case unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r):
+			flush()
+			if prev != 0 {
+				terms[string([]rune{prev, r})]++
+			} else {
+				terms[string(r)]++
+			}
+			prev = r
+			continue
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word.WriteRune(r)
+		default:
+			flush()
+		}
+		prev = 0
+	}
+	flush()
+	return terms
+}
+
+// lexicalSimilarity is the cosine similarity of the term frequencies of two
+// texts, in [0, 1]
+func lexicalSimilarity(a, b string) float64 {
+	return cosine(lexicalTerms(a), lexicalTerms(b))
+}
+
+func cosine(a, b map[string]float64) float64 {
+	var dot, normA, normB float64
+	for term, x := range a {
+		dot += x * b[term]
+		normA += x * x
+	}
+	for _, y := range b {
+		normB += y * y
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(normA*normB)
+}
@@ -0,0 +1,180 @@
+package committee
+
+import (
+	"sync"
+
+	"super-llm/config"
+
+	"github.com/cv70/pkgo/llm"
+	"google.golang.org/genai"
+)
+
+// Committee phases, used to break usage down
+const (
+	PhaseSummary = "summary"
+	PhaseOpinion = "opinion"
+	PhaseReview  = "review"
+	PhaseFinal   = "final"
+)
+
+// UsageTotals is an aggregate of token usage and its cost
+type UsageTotals struct {
+	PromptTokens     int32   `json:"prompt_tokens"`
+	CompletionTokens int32   `json:"completion_tokens"`
+	TotalTokens      int32   `json:"total_tokens"`
+	Cost             float64 `json:"cost"`
+	Calls            int     `json:"calls"`
+}
+
+func (t *UsageTotals) add(o *UsageTotals) {
+	t.PromptTokens += o.PromptTokens
+	t.CompletionTokens += o.CompletionTokens
+	t.TotalTokens += o.TotalTokens
+	t.Cost += o.Cost
+	t.Calls += o.Calls
+}
+
+// UsageReport is the usage of a committee run with its breakdowns
+type UsageReport struct {
+	Total   *UsageTotals            `json:"total"`
+	Phases  map[string]*UsageTotals `json:"phases"`
+	Members map[string]*UsageTotals `json:"members"`
+}
+
+// Add merges the usage of another run into the report
+func (r *UsageReport) Add(o *UsageReport) {
+	r.Total.add(o.Total)
+	for phase, totals := range o.Phases {
+		if r.Phases[phase] == nil {
+			r.Phases[phase] = &UsageTotals{}
+		}
+		r.Phases[phase].add(totals)
+	}
+	for name, totals := range o.Members {
+		if r.Members[name] == nil {
+			r.Members[name] = &UsageTotals{}
+		}
+		r.Members[name].add(totals)
+	}
+}
+
+// UsageTracker collects token usage from every backend call of a committee run
+type UsageTracker struct {
+	mu     sync.Mutex
+	prices map[string]*config.PriceConfig
+	report *UsageReport
+	// charge bills every call to the API key of the run, nil when the API
+	// is open
+	charge func(prompt, completion int64, cost float64)
+}
+
+func newUsageTracker(prices map[string]*config.PriceConfig) *UsageTracker {
+	return &UsageTracker{
+		prices: prices,
+		report: &UsageReport{
+			Total:   &UsageTotals{},
+			Phases:  map[string]*UsageTotals{},
+			Members: map[string]*UsageTotals{},
+		},
+	}
+}
+
+// Record adds the usage metadata of a content generation call
+func (t *UsageTracker) Record(phase string, member *Member, usage *genai.GenerateContentResponseUsageMetadata) {
+	if usage == nil {
+		return
+	}
+	t.RecordTokens(phase, member.Name(), member.ModelName, usage.PromptTokenCount, usage.CandidatesTokenCount, usage.TotalTokenCount)
+}
+
+// RecordChat adds the usage of a raw chat completion call
+func (t *UsageTracker) RecordChat(phase string, member *Member, usage *llm.ChatUsage) {
+	if usage == nil {
+		return
+	}
+	t.RecordTokens(phase, member.Name(), member.ModelName, usage.PromptTokens, usage.CompletionTokens, usage.TotalTokens)
+}
+
+// RecordTokens adds the usage of a call made on behalf of name, priced by
+// name or by its backend model
+func (t *UsageTracker) RecordTokens(phase, name, model string, prompt, completion, total int32) {
+	if total == 0 {
+		total = prompt + completion
+	}
+	totals := &UsageTotals{
+		PromptTokens:     prompt,
+		CompletionTokens: completion,
+		TotalTokens:      total,
+		Calls:            1,
+	}
+	if price := t.priceOf(name, model); price != nil {
+		totals.Cost = price.Cost(prompt, completion)
+	}
+
+	if t.charge != nil {
+		t.charge(int64(prompt), int64(completion), totals.Cost)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.report.Total.add(totals)
+	if t.report.Phases[phase] == nil {
+		t.report.Phases[phase] = &UsageTotals{}
+	}
+	t.report.Phases[phase].add(totals)
+	if t.report.Members[name] == nil {
+		t.report.Members[name] = &UsageTotals{}
+	}
+	t.report.Members[name].add(totals)
+}
+
+// price looks up the member by name first, then by its backend model
+func (t *UsageTracker) price(member *Member) *config.PriceConfig {
+	return t.priceOf(member.Name(), member.ModelName)
+}
+
+func (t *UsageTracker) priceOf(name, model string) *config.PriceConfig {
+	if price := t.prices[name]; price != nil {
+		return price
+	}
+	return t.prices[model]
+}
+
+// Report returns a snapshot of the usage collected so far
+func (t *UsageTracker) Report() *UsageReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	report := &UsageReport{
+		Total:   &UsageTotals{},
+		Phases:  make(map[string]*UsageTotals, len(t.report.Phases)),
+		Members: make(map[string]*UsageTotals, len(t.report.Members)),
+	}
+	report.Total.add(t.report.Total)
+	for phase, totals := range t.report.Phases {
+		report.Phases[phase] = &UsageTotals{}
+		report.Phases[phase].add(totals)
+	}
+	for name, totals := range t.report.Members {
+		report.Members[name] = &UsageTotals{}
+		report.Members[name].add(totals)
+	}
+	return report
+}
+
+// Totals returns the aggregated usage collected so far
+func (t *UsageTracker) Totals() UsageTotals {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return *t.report.Total
+}
+
+// ChatUsage returns the aggregated totals in the OpenAI usage format
+func (t *UsageTracker) ChatUsage() *llm.ChatUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return &llm.ChatUsage{
+		PromptTokens:     t.report.Total.PromptTokens,
+		CompletionTokens: t.report.Total.CompletionTokens,
+		TotalTokens:      t.report.Total.TotalTokens,
+	}
+}
@@ -0,0 +1,277 @@
+package eval
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"super-llm/domain/committee"
+
+	"github.com/cv70/pkgo/llm"
+	"github.com/pkg/errors"
+)
+
+const defaultConcurrency = 4
+
+// Item is one question of the dataset with its reference answer
+type Item struct {
+	ID        string             `json:"id"`
+	Question  string             `json:"question,omitempty"`
+	Messages  []*llm.ChatMessage `json:"messages,omitempty"`
+	Reference string             `json:"reference"`
+	// Scorer overrides the default scorer for this item
+	Scorer string `json:"scorer,omitempty"`
+	// Tolerance is the relative tolerance of the numeric scorer
+	Tolerance float64 `json:"tolerance,omitempty"`
+}
+
+func (i *Item) messages() []*llm.ChatMessage {
+	if len(i.Messages) > 0 {
+		return i.Messages
+	}
+	return []*llm.ChatMessage{{Role: llm.RoleUser, Content: i.Question}}
+}
+
+func (i *Item) question() string {
+	if i.Question != "" {
+		return i.Question
+	}
+	for _, message := range slices.Backward(i.Messages) {
+		if text, ok := message.Content.(string); ok && message.Role == llm.RoleUser {
+			return text
+		}
+	}
+	return ""
+}
+
+// ReadDataset reads a JSONL dataset, numbering items without an ID
+func ReadDataset(r io.Reader) ([]*Item, error) {
+	var items []*Item
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var item Item
+		if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+			return nil, errors.Wrapf(err, "line %d", line)
+		}
+		if item.Question == "" && len(item.Messages) == 0 {
+			return nil, errors.Errorf("line %d: question or messages is required", line)
+		}
+		if item.ID == "" {
+			item.ID = "item-" + strconv.Itoa(line)
+		}
+		items = append(items, &item)
+	}
+	return items, errors.Wrap(scanner.Err(), "read dataset")
+}
+
+// RunConfig is one configuration under evaluation
+type RunConfig struct {
+	Name string `yaml:"name" json:"name"`
+	// Member answers directly, bypassing the committee
+	Member string `yaml:"member,omitempty" json:"member,omitempty"`
+	// Model is the preset or leader of a committee run
+	Model    string   `yaml:"model,omitempty" json:"model,omitempty"`
+	Members  []string `yaml:"members,omitempty" json:"members,omitempty"`
+	Strategy string   `yaml:"strategy,omitempty" json:"strategy,omitempty"`
+}
+
+// DefaultRuns compares every member on its own with the committee led by
+// leader under each strategy and with every preset
+func DefaultRuns(domain *committee.CommitteeDomain, leader string) []*RunConfig {
+	var runs []*RunConfig
+	members := slices.Sorted(maps.Keys(domain.Members))
+	for _, member := range members {
+		runs = append(runs, &RunConfig{Name: "member:" + member, Member: member})
+	}
+	if leader == "" && len(members) > 0 {
+		leader = members[0]
+	}
+	for _, strategy := range []string{committee.StrategyCommittee, committee.StrategyCascade} {
+		runs = append(runs, &RunConfig{Name: "strategy:" + strategy, Model: leader, Strategy: strategy})
+	}
+	for _, preset := range slices.Sorted(maps.Keys(domain.Presets)) {
+		runs = append(runs, &RunConfig{Name: "preset:" + preset, Model: preset})
+	}
+	return runs
+}
+
+// Result is the outcome of one item under one configuration
+type Result struct {
+	Run       string                `json:"run"`
+	Item      string                `json:"item"`
+	Answer    string                `json:"answer"`
+	Correct   bool                  `json:"correct"`
+	LatencyMS int64                 `json:"latency_ms"`
+	Usage     committee.UsageTotals `json:"usage"`
+	Error     string                `json:"error,omitempty"`
+}
+
+// RunSummary aggregates the results of one configuration
+type RunSummary struct {
+	Name          string                `json:"name"`
+	Total         int                   `json:"total"`
+	Correct       int                   `json:"correct"`
+	Errors        int                   `json:"errors"`
+	Accuracy      float64               `json:"accuracy"`
+	MeanLatencyMS int64                 `json:"mean_latency_ms"`
+	P95LatencyMS  int64                 `json:"p95_latency_ms"`
+	Usage         committee.UsageTotals `json:"usage"`
+}
+
+// Report compares the configurations over the dataset
+type Report struct {
+	CreatedAt  time.Time             `json:"created_at"`
+	Items      int                   `json:"items"`
+	Runs       []*RunSummary         `json:"runs"`
+	JudgeUsage committee.UsageTotals `json:"judge_usage"`
+	Results    []*Result             `json:"results"`
+}
+
+// Runner evaluates configurations of a committee over a dataset
+type Runner struct {
+	Domain *committee.CommitteeDomain
+	// Scorer is the default scorer of items that name none
+	Scorer string
+	// Judge is the member grading answers for the judge scorer
+	Judge       string
+	Concurrency int
+
+	mu         sync.Mutex
+	judgeUsage committee.UsageTotals
+}
+
+func (r *Runner) addJudgeUsage(report *committee.UsageReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addUsage(&r.judgeUsage, report.Total)
+}
+
+func addUsage(t *committee.UsageTotals, o *committee.UsageTotals) {
+	t.PromptTokens += o.PromptTokens
+	t.CompletionTokens += o.CompletionTokens
+	t.TotalTokens += o.TotalTokens
+	t.Cost += o.Cost
+	t.Calls += o.Calls
+}
+
+// Run evaluates every configuration over the items, one configuration at
+// a time so that latencies are comparable
+func (r *Runner) Run(ctx context.Context, items []*Item, runs []*RunConfig) (*Report, error) {
+	for _, item := range items {
+		if item.Scorer == "" {
+			item.Scorer = r.Scorer
+		}
+		if item.Scorer == "" {
+			item.Scorer = ScorerExact
+		}
+	}
+	concurrency := r.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+
+	report := &Report{CreatedAt: time.Now(), Items: len(items)}
+	for _, run := range runs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		results := make([]*Result, len(items))
+		sem := make(chan struct{}, concurrency)
+		var wg sync.WaitGroup
+		for i, item := range items {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				results[i] = r.evaluate(ctx, run, item)
+			}()
+		}
+		wg.Wait()
+		report.Runs = append(report.Runs, summarize(run.Name, results))
+		report.Results = append(report.Results, results...)
+	}
+	report.JudgeUsage = r.judgeUsage
+	return report, nil
+}
+
+// evaluate answers one item under one configuration and scores the answer
+func (r *Runner) evaluate(ctx context.Context, run *RunConfig, item *Item) *Result {
+	result := &Result{Run: run.Name, Item: item.ID}
+	start := time.Now()
+	answer, usage, err := r.answer(ctx, run, item)
+	result.LatencyMS = time.Since(start).Milliseconds()
+	if usage != nil {
+		result.Usage = *usage.Total
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Answer = answer
+	result.Correct, err = r.score(ctx, item, answer)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func (r *Runner) answer(ctx context.Context, run *RunConfig, item *Item) (string, *committee.UsageReport, error) {
+	req := &llm.ChatCompletionRequest{Model: run.Model, Messages: item.messages()}
+	if run.Member != "" {
+		resp, usage, err := r.Domain.Ask(ctx, run.Member, req)
+		if err != nil {
+			return "", usage, err
+		}
+		return committee.CompletionText(resp), usage, nil
+	}
+
+	c, err := r.Domain.RunCommitteeProcess(ctx, req, &committee.RunOptions{
+		Members:  run.Members,
+		Strategy: run.Strategy,
+		Cache:    committee.CacheSkip,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	completion, err := c.ReadResponse()
+	if err != nil {
+		return "", c.Usage.Report(), err
+	}
+	return committee.CompletionText(completion), c.Usage.Report(), nil
+}
+
+func summarize(name string, results []*Result) *RunSummary {
+	summary := &RunSummary{Name: name, Total: len(results)}
+	latencies := make([]int64, 0, len(results))
+	var latency int64
+	for _, result := range results {
+		if result.Correct {
+			summary.Correct++
+		}
+		if result.Error != "" {
+			summary.Errors++
+		}
+		latency += result.LatencyMS
+		latencies = append(latencies, result.LatencyMS)
+		addUsage(&summary.Usage, &result.Usage)
+	}
+	if len(results) == 0 {
+		return summary
+	}
+	slices.Sort(latencies)
+	summary.Accuracy = float64(summary.Correct) / float64(summary.Total)
+	summary.MeanLatencyMS = latency / int64(len(results))
+	summary.P95LatencyMS = latencies[(len(latencies)*95+99)/100-1]
+	return summary
+}
@@ -0,0 +1,82 @@
+package eval
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"super-llm/config"
+	"super-llm/domain/committee"
+	"super-llm/infra/fake"
+)
+
+// newFakeDomain builds a committee of two members backed by a fake backend
+// that answers 4 and judges every answer correct
+func newFakeDomain(t *testing.T) *committee.CommitteeDomain {
+	t.Helper()
+	backend, err := fake.NewServer(&fake.Config{
+		Default: "答案是 4。",
+		Rules:   []*fake.Rule{{Match: "请判断回答是否与参考答案一致", Reply: "正确"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(backend.Handler())
+	t.Cleanup(server.Close)
+
+	d, err := committee.BuildCommitteeDomain(context.Background(), &config.Config{
+		LLMs: []*config.LLMConfig{{BaseURL: server.URL + "/v1", Model: "fake-model", APIKey: "test"}},
+		Members: []*config.MemberConfig{
+			{Name: "alice", LLM: "fake-model"},
+			{Name: "bob", LLM: "fake-model"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// TestRun evaluates the default runs over a small dataset
+func TestRun(t *testing.T) {
+	items, err := ReadDataset(strings.NewReader(`{"question": "2+2 等于几？", "reference": "4", "scorer": "numeric"}
+
+{"id": "wrong", "question": "2+3 等于几？", "reference": "5", "scorer": "numeric"}
+{"messages": [{"role": "user", "content": "2+2 等于几？"}], "reference": "四"}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 || items[0].ID != "item-1" || items[1].ID != "wrong" || items[2].ID != "item-4" {
+		t.Fatalf("read items %+v", items)
+	}
+
+	d := newFakeDomain(t)
+	runs := DefaultRuns(d, "alice")
+	r := &Runner{Domain: d, Scorer: ScorerJudge, Judge: "bob"}
+	report, err := r.Run(context.Background(), items, runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Runs) != len(runs) || len(report.Results) != len(runs)*len(items) {
+		t.Fatalf("report of %d runs and %d results, want %d and %d", len(report.Runs), len(report.Results), len(runs), len(runs)*len(items))
+	}
+	for _, summary := range report.Runs {
+		if summary.Total != 3 || summary.Correct != 2 || summary.Errors != 0 {
+			t.Errorf("run %s: %d of %d correct with %d errors, want 2 of 3 without errors", summary.Name, summary.Correct, summary.Total, summary.Errors)
+		}
+		if summary.Usage.Calls == 0 {
+			t.Errorf("run %s recorded no calls", summary.Name)
+		}
+	}
+	for _, result := range report.Results {
+		if result.Correct == (result.Item == "wrong") {
+			t.Errorf("run %s item %s answered %q, correct %v", result.Run, result.Item, result.Answer, result.Correct)
+		}
+	}
+	if report.JudgeUsage.Calls != len(runs) {
+		t.Errorf("judge made %d calls, want one per run", report.JudgeUsage.Calls)
+	}
+}
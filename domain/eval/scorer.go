@@ -0,0 +1,102 @@
+package eval
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"super-llm/domain/committee"
+
+	"github.com/cv70/pkgo/llm"
+	"github.com/pkg/errors"
+)
+
+// Scorers
+const (
+	ScorerExact   = "exact"
+	ScorerNumeric = "numeric"
+	ScorerRegex   = "regex"
+	ScorerJudge   = "judge"
+)
+
+const defaultTolerance = 1e-6
+
+var numberPattern = regexp.MustCompile(`-?\d[\d,]*(\.\d+)?`)
+
+// normalize lowercases the answer and collapses whitespace and trailing
+// punctuation so that formatting does not decide exact matches
+func normalize(s string) string {
+	s = strings.ToLower(strings.Join(strings.Fields(llm.RemoveThink(s)), " "))
+	return strings.TrimRight(s, ".。!！")
+}
+
+// lastNumber extracts the last number of the answer
+func lastNumber(s string) (float64, bool) {
+	matches := numberPattern.FindAllString(llm.RemoveThink(s), -1)
+	if len(matches) == 0 {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(strings.ReplaceAll(matches[len(matches)-1], ",", ""), 64)
+	return n, err == nil
+}
+
+// score grades an answer against the item's reference
+func (r *Runner) score(ctx context.Context, item *Item, answer string) (bool, error) {
+	switch item.Scorer {
+	case ScorerExact:
+		return normalize(answer) == normalize(item.Reference), nil
+	case ScorerNumeric:
+		want, err := strconv.ParseFloat(strings.TrimSpace(item.Reference), 64)
+		if err != nil {
+			return false, errors.Wrap(err, "parse numeric reference")
+		}
+		got, ok := lastNumber(answer)
+		if !ok {
+			return false, nil
+		}
+		tolerance := item.Tolerance
+		if tolerance <= 0 {
+			tolerance = defaultTolerance
+		}
+		return math.Abs(got-want) <= tolerance*max(1, math.Abs(want)), nil
+	case ScorerRegex:
+		pattern, err := regexp.Compile(item.Reference)
+		if err != nil {
+			return false, errors.Wrap(err, "compile regex reference")
+		}
+		return pattern.MatchString(llm.RemoveThink(answer)), nil
+	case ScorerJudge:
+		return r.judge(ctx, item, answer)
+	default:
+		return false, errors.Errorf("unknown scorer %s", item.Scorer)
+	}
+}
+
+// judge asks the judge member whether the answer agrees with the reference
+func (r *Runner) judge(ctx context.Context, item *Item, answer string) (bool, error) {
+	if r.Judge == "" {
+		return false, errors.New("judge scorer needs a judge member")
+	}
+	var prompt strings.Builder
+	prompt.WriteString("请判断回答是否与参考答案一致。\n\n")
+	fmt.Fprintf(&prompt, "问题：%s\n\n", item.question())
+	fmt.Fprintf(&prompt, "参考答案：%s\n\n", item.Reference)
+	fmt.Fprintf(&prompt, "回答：%s\n\n", llm.RemoveThink(answer))
+	prompt.WriteString("如果回答与参考答案一致，只输出“正确”；否则只输出“错误”。")
+
+	resp, usage, err := r.Domain.Ask(ctx, r.Judge, &llm.ChatCompletionRequest{
+		Messages: []*llm.ChatMessage{{Role: llm.RoleUser, Content: prompt.String()}},
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "judge")
+	}
+	r.addJudgeUsage(usage)
+	verdict := llm.RemoveThink(committee.CompletionText(resp))
+	if strings.Contains(verdict, "错误") || strings.Contains(verdict, "不正确") {
+		return false, nil
+	}
+	return strings.Contains(verdict, "正确"), nil
+}
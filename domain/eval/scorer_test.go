@@ -0,0 +1,51 @@
+package eval
+
+import (
+	"context"
+	"testing"
+)
+
+// TestScore grades answers with the scorers that need no judge
+func TestScore(t *testing.T) {
+	cases := []struct {
+		item   Item
+		answer string
+		want   bool
+	}{
+		{Item{Scorer: ScorerExact, Reference: "Paris"}, "  paris。", true},
+		{Item{Scorer: ScorerExact, Reference: "Paris"}, "<think>Lyon?</think>Paris", true},
+		{Item{Scorer: ScorerExact, Reference: "Paris"}, "Lyon", false},
+		{Item{Scorer: ScorerNumeric, Reference: "1234.5"}, "先算 1000，结果是 1,234.5", true},
+		{Item{Scorer: ScorerNumeric, Reference: "4"}, "答案是 5", false},
+		{Item{Scorer: ScorerNumeric, Reference: "100", Tolerance: 0.05}, "约 97", true},
+		{Item{Scorer: ScorerNumeric, Reference: "4"}, "不知道", false},
+		{Item{Scorer: ScorerRegex, Reference: `^\s*(B|b)\b`}, "B，因为……", true},
+		{Item{Scorer: ScorerRegex, Reference: `^\s*(B|b)\b`}, "<think>B?</think>A", false},
+	}
+	r := &Runner{}
+	for _, tc := range cases {
+		got, err := r.score(context.Background(), &tc.item, tc.answer)
+		if err != nil {
+			t.Errorf("%s %q: %v", tc.item.Scorer, tc.answer, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s %q against %q scored %v, want %v", tc.item.Scorer, tc.answer, tc.item.Reference, got, tc.want)
+		}
+	}
+}
+
+// TestScoreErrors rejects references and scorers that cannot grade
+func TestScoreErrors(t *testing.T) {
+	r := &Runner{}
+	for _, item := range []*Item{
+		{Scorer: ScorerNumeric, Reference: "four"},
+		{Scorer: ScorerRegex, Reference: "("},
+		{Scorer: ScorerJudge, Reference: "4"},
+		{Scorer: "fuzzy", Reference: "4"},
+	} {
+		if _, err := r.score(context.Background(), item, "4"); err == nil {
+			t.Errorf("%s scorer of %q graded without error", item.Scorer, item.Reference)
+		}
+	}
+}
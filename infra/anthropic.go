@@ -0,0 +1,281 @@
+package infra
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"super-llm/config"
+
+	"github.com/cv70/pkgo/llm"
+	"github.com/pkg/errors"
+)
+
+const (
+	anthropicVersion   = "2023-06-01"
+	anthropicMaxTokens = 4096
+)
+
+// anthropicTransport speaks the Anthropic Messages API
+type anthropicTransport struct {
+	base    http.RoundTripper
+	config  *config.LLMConfig
+	baseURL string
+}
+
+type anthropicRequest struct {
+	Model         string              `json:"model"`
+	System        string              `json:"system,omitempty"`
+	Messages      []*anthropicMessage `json:"messages"`
+	MaxTokens     int32               `json:"max_tokens"`
+	Temperature   *float32            `json:"temperature,omitempty"`
+	TopP          *float32            `json:"top_p,omitempty"`
+	StopSequences []string            `json:"stop_sequences,omitempty"`
+	Stream        bool                `json:"stream,omitempty"`
+	Tools         []*anthropicTool    `json:"tools,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string            `json:"role"`
+	Content []*anthropicBlock `json:"content"`
+}
+
+type anthropicBlock struct {
+	Type      string         `json:"type"`
+	Text      string         `json:"text,omitempty"`
+	ID        string         `json:"id,omitempty"`
+	Name      string         `json:"name,omitempty"`
+	Input     map[string]any `json:"input,omitempty"`
+	ToolUseID string         `json:"tool_use_id,omitempty"`
+	Content   string         `json:"content,omitempty"`
+}
+
+type anthropicTool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	InputSchema map[string]any `json:"input_schema"`
+}
+
+type anthropicResponse struct {
+	ID         string            `json:"id"`
+	Model      string            `json:"model"`
+	Content    []*anthropicBlock `json:"content"`
+	StopReason string            `json:"stop_reason"`
+	Usage      *anthropicUsage   `json:"usage"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int32 `json:"input_tokens"`
+	OutputTokens int32 `json:"output_tokens"`
+}
+
+// anthropicEvent is a server-sent event of a streamed message
+type anthropicEvent struct {
+	Type         string             `json:"type"`
+	Index        int                `json:"index"`
+	Message      *anthropicResponse `json:"message"`
+	ContentBlock *anthropicBlock    `json:"content_block"`
+	Delta        struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage *anthropicUsage `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (t *anthropicTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	chat, err := readChatRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	out, err := nativeRequest(req, strings.TrimSuffix(t.baseURL, "/")+"/messages", newAnthropicRequest(chat))
+	if err != nil {
+		return nil, err
+	}
+	out.Header.Set("x-api-key", t.config.APIKey)
+	version := t.config.APIVersion
+	if version == "" {
+		version = anthropicVersion
+	}
+	out.Header.Set("anthropic-version", version)
+	setHeaders(out, t.config.Headers)
+
+	resp, err := t.base.RoundTrip(out)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	if chat.Stream {
+		return streamResponse(resp, chat.Model, func(body io.Reader, w *chunkWriter) error {
+			return translateAnthropicStream(body, w, chat.includeUsage())
+		}), nil
+	}
+
+	defer resp.Body.Close()
+	var message anthropicResponse
+	if err := json.NewDecoder(resp.Body).Decode(&message); err != nil {
+		return nil, errors.Wrap(err, "decode anthropic response")
+	}
+	completion := newChatCompletion(message.ID, chat.Model)
+	reply := &llm.ChatMessage{Role: llm.RoleAssistant}
+	var text strings.Builder
+	for _, block := range message.Content {
+		switch block.Type {
+		case "text":
+			text.WriteString(block.Text)
+		case "tool_use":
+			arguments, _ := json.Marshal(block.Input)
+			reply.ToolCalls = append(reply.ToolCalls, llm.ChatToolCall{
+				ID:       block.ID,
+				Type:     "function",
+				Function: llm.ChatFunctionCall{Name: block.Name, Arguments: string(arguments)},
+			})
+		}
+	}
+	reply.Content = text.String()
+	completion.Choices = []llm.ChatChoice{{Message: reply, FinishReason: anthropicFinishReason(message.StopReason)}}
+	if message.Usage != nil {
+		completion.Usage = message.Usage.chatUsage()
+	}
+	return completionResponse(resp, completion), nil
+}
+
+func newAnthropicRequest(chat *chatRequest) *anthropicRequest {
+	out := &anthropicRequest{
+		Model:         chat.Model,
+		MaxTokens:     anthropicMaxTokens,
+		Temperature:   chat.Temperature,
+		TopP:          chat.TopP,
+		StopSequences: chat.Stop,
+		Stream:        chat.Stream,
+	}
+	if chat.MaxTokens != nil {
+		out.MaxTokens = *chat.MaxTokens
+	}
+	var system []string
+	for _, message := range chat.Messages {
+		switch message.Role {
+		case llm.RoleSystem:
+			system = append(system, messageText(message.Content))
+			continue
+		case "tool":
+			out.appendBlock("user", &anthropicBlock{Type: "tool_result", ToolUseID: message.ToolCallID, Content: messageText(message.Content)})
+			continue
+		}
+		role := "user"
+		if message.Role == llm.RoleAssistant {
+			role = "assistant"
+		}
+		if text := messageText(message.Content); text != "" {
+			out.appendBlock(role, &anthropicBlock{Type: "text", Text: text})
+		}
+		for i := range message.ToolCalls {
+			call := &message.ToolCalls[i]
+			out.appendBlock(role, &anthropicBlock{Type: "tool_use", ID: call.ID, Name: call.Function.Name, Input: toolArguments(call)})
+		}
+	}
+	out.System = strings.Join(system, "\n\n")
+	for _, tool := range chat.Tools {
+		schema := tool.Function.Parameters
+		if schema == nil {
+			schema = map[string]any{"type": "object"}
+		}
+		out.Tools = append(out.Tools, &anthropicTool{Name: tool.Function.Name, Description: tool.Function.Description, InputSchema: schema})
+	}
+	return out
+}
+
+// appendBlock adds a content block, merging consecutive turns of one role as
+// the Messages API requires alternating roles
+func (r *anthropicRequest) appendBlock(role string, block *anthropicBlock) {
+	if n := len(r.Messages); n > 0 && r.Messages[n-1].Role == role {
+		r.Messages[n-1].Content = append(r.Messages[n-1].Content, block)
+		return
+	}
+	r.Messages = append(r.Messages, &anthropicMessage{Role: role, Content: []*anthropicBlock{block}})
+}
+
+func translateAnthropicStream(body io.Reader, w *chunkWriter, includeUsage bool) error {
+	usage := &anthropicUsage{}
+	// tools maps content block indexes to tool call indexes
+	tools := map[int]int{}
+	return readEvents(body, func(data []byte) error {
+		var event anthropicEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			return errors.Wrap(err, "decode anthropic event")
+		}
+		switch event.Type {
+		case "message_start":
+			if event.Message != nil {
+				w.id = event.Message.ID
+				if event.Message.Usage != nil {
+					usage.InputTokens = event.Message.Usage.InputTokens
+				}
+			}
+			return w.delta(&llm.ChatMessage{}, "")
+		case "content_block_start":
+			if event.ContentBlock == nil || event.ContentBlock.Type != "tool_use" {
+				return nil
+			}
+			index := len(tools)
+			tools[event.Index] = index
+			return w.delta(&llm.ChatMessage{ToolCalls: []llm.ChatToolCall{{
+				ID:       event.ContentBlock.ID,
+				Index:    &index,
+				Type:     "function",
+				Function: llm.ChatFunctionCall{Name: event.ContentBlock.Name},
+			}}}, "")
+		case "content_block_delta":
+			switch event.Delta.Type {
+			case "text_delta":
+				return w.delta(&llm.ChatMessage{Content: event.Delta.Text}, "")
+			case "input_json_delta":
+				index := tools[event.Index]
+				return w.delta(&llm.ChatMessage{ToolCalls: []llm.ChatToolCall{{
+					Index:    &index,
+					Function: llm.ChatFunctionCall{Arguments: event.Delta.PartialJSON},
+				}}}, "")
+			}
+		case "message_delta":
+			if event.Usage != nil {
+				usage.OutputTokens = event.Usage.OutputTokens
+			}
+			return w.delta(&llm.ChatMessage{}, anthropicFinishReason(event.Delta.StopReason))
+		case "message_stop":
+			if includeUsage {
+				if err := w.usage(usage.chatUsage()); err != nil {
+					return err
+				}
+			}
+			return w.done()
+		case "error":
+			if event.Error != nil {
+				return errors.Errorf("anthropic stream error: %s", event.Error.Message)
+			}
+		}
+		return nil
+	})
+}
+
+func (u *anthropicUsage) chatUsage() *llm.ChatUsage {
+	return &llm.ChatUsage{
+		PromptTokens:     u.InputTokens,
+		CompletionTokens: u.OutputTokens,
+		TotalTokens:      u.InputTokens + u.OutputTokens,
+	}
+}
+
+func anthropicFinishReason(reason string) string {
+	switch reason {
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	default:
+		return "stop"
+	}
+}
@@ -0,0 +1,166 @@
+package infra
+
+import (
+	"container/list"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"super-llm/config"
+
+	"github.com/pkg/errors"
+)
+
+// Cache types
+const (
+	CacheMemory = "memory"
+	CacheDisk   = "disk"
+)
+
+const defaultCacheEntries = 1024
+
+// Cache stores values by key until their TTL expires
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration)
+}
+
+// NewCache builds the cache selected by the configuration
+func NewCache(c *config.CacheConfig) (Cache, error) {
+	switch c.Type {
+	case "", CacheMemory:
+		return NewMemoryCache(c.MaxEntries), nil
+	case CacheDisk:
+		return NewDiskCache(c.Dir)
+	default:
+		return nil, errors.Errorf("unknown cache type %s", c.Type)
+	}
+}
+
+type cacheItem struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+func (i *cacheItem) expired() bool {
+	return !i.expiresAt.IsZero() && time.Now().After(i.expiresAt)
+}
+
+func expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+// MemoryCache is an in-memory LRU cache
+type MemoryCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	order      *list.List
+	items      map[string]*list.Element
+}
+
+func NewMemoryCache(maxEntries int) *MemoryCache {
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheEntries
+	}
+	return &MemoryCache{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		items:      map[string]*list.Element{},
+	}
+}
+
+func (m *MemoryCache) Get(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	elem, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := elem.Value.(*cacheItem)
+	if item.expired() {
+		m.order.Remove(elem)
+		delete(m.items, key)
+		return nil, false
+	}
+	m.order.MoveToFront(elem)
+	return item.value, true
+}
+
+func (m *MemoryCache) Set(key string, value []byte, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item := &cacheItem{key: key, value: value, expiresAt: expiry(ttl)}
+	if elem, ok := m.items[key]; ok {
+		elem.Value = item
+		m.order.MoveToFront(elem)
+		return
+	}
+	m.items[key] = m.order.PushFront(item)
+	for m.order.Len() > m.maxEntries {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.items, oldest.Value.(*cacheItem).key)
+	}
+}
+
+// DiskCache stores one JSON file per key in a directory
+type DiskCache struct {
+	dir string
+}
+
+type diskCacheFile struct {
+	ExpiresAt time.Time `json:"expires_at"`
+	Value     []byte    `json:"value"`
+}
+
+func NewDiskCache(dir string) (*DiskCache, error) {
+	if dir == "" {
+		dir = "cache"
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, errors.Wrap(err, "create cache dir")
+	}
+	return &DiskCache{dir: dir}, nil
+}
+
+// path maps a key to its file; keys are expected to be hex digests
+func (d *DiskCache) path(key string) string {
+	return filepath.Join(d.dir, filepath.Base(key)+".json")
+}
+
+func (d *DiskCache) Get(key string) ([]byte, bool) {
+	data, err := os.ReadFile(d.path(key))
+	if err != nil {
+		return nil, false
+	}
+	var file diskCacheFile
+	if json.Unmarshal(data, &file) != nil {
+		return nil, false
+	}
+	if !file.ExpiresAt.IsZero() && time.Now().After(file.ExpiresAt) {
+		os.Remove(d.path(key))
+		return nil, false
+	}
+	return file.Value, true
+}
+
+func (d *DiskCache) Set(key string, value []byte, ttl time.Duration) {
+	if err := d.write(key, value, ttl); err != nil {
+		slog.Error("write disk cache", slog.Any("key", key), slog.Any("err", err))
+	}
+}
+
+func (d *DiskCache) write(key string, value []byte, ttl time.Duration) error {
+	data, err := json.Marshal(&diskCacheFile{ExpiresAt: expiry(ttl), Value: value})
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(d.path(key), data)
+}
@@ -0,0 +1,283 @@
+package infra
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"super-llm/config"
+
+	"github.com/pkg/errors"
+)
+
+// Recorder modes
+const (
+	RecordMode = "record"
+	ReplayMode = "replay"
+)
+
+// Interaction is a request/response pair saved in a cassette. Streamed
+// responses are kept as the raw SSE body.
+type Interaction struct {
+	RecordedAt  time.Time       `json:"recorded_at"`
+	Key         string          `json:"key"`
+	Method      string          `json:"method"`
+	URL         string          `json:"url"`
+	Request     json.RawMessage `json:"request,omitempty"`
+	Status      int             `json:"status,omitempty"`
+	ContentType string          `json:"content_type,omitempty"`
+	Response    string          `json:"response,omitempty"`
+	// Error is the transport error of a request that got no response
+	Error string `json:"error,omitempty"`
+}
+
+// Cassette records the backend traffic of one client to a JSON Lines file,
+// or replays it from there
+type Cassette struct {
+	mode string
+	path string
+
+	mu           sync.Mutex
+	file         *os.File
+	interactions []*Interaction
+	used         []bool
+}
+
+// OpenCassette opens the cassette of the named client. It returns nil when
+// no recorder is configured.
+func OpenCassette(c *config.RecorderConfig, name string) (*Cassette, error) {
+	if c == nil || c.Mode == "" {
+		return nil, nil
+	}
+	dir := c.Dir
+	if dir == "" {
+		dir = "cassettes"
+	}
+	cassette := &Cassette{mode: c.Mode, path: filepath.Join(dir, cassetteFile(name))}
+
+	switch c.Mode {
+	case RecordMode:
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, errors.Wrap(err, "create cassette dir")
+		}
+		file, err := os.OpenFile(cassette.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, errors.Wrap(err, "open cassette")
+		}
+		cassette.file = file
+	case ReplayMode:
+		file, err := os.Open(cassette.path)
+		if err != nil {
+			return nil, errors.Wrap(err, "open cassette")
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		for scanner.Scan() {
+			var interaction Interaction
+			if err := json.Unmarshal(scanner.Bytes(), &interaction); err != nil {
+				return nil, errors.Wrapf(err, "decode cassette %s", cassette.path)
+			}
+			cassette.interactions = append(cassette.interactions, &interaction)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, errors.Wrap(err, "read cassette")
+		}
+		cassette.used = make([]bool, len(cassette.interactions))
+	default:
+		return nil, errors.Errorf("unknown recorder mode %s", c.Mode)
+	}
+	return cassette, nil
+}
+
+// cassetteFile turns a client name into a file name within the cassette
+// directory. Model names such as "Qwen/Qwen2.5-7B" may hold separators, so
+// other characters than letters, digits, dots, dashes and underscores are
+// replaced, and a hash of the name keeps altered names apart.
+func cassetteFile(name string) string {
+	safe := []rune(name)
+	for i, r := range safe {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_') {
+			safe[i] = '_'
+		}
+	}
+	file := strings.TrimLeft(string(safe), ".")
+	if file != name {
+		sum := sha256.Sum256([]byte(name))
+		file += "-" + hex.EncodeToString(sum[:4])
+	}
+	return file + ".jsonl"
+}
+
+// Close closes the file a recording cassette writes to
+func (c *Cassette) Close() error {
+	if c == nil || c.file == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.file.Close()
+}
+
+// Transport wraps base to record through it, or replaces it when replaying
+func (c *Cassette) Transport(base http.RoundTripper) http.RoundTripper {
+	if c.mode == ReplayMode {
+		return &replayTransport{cassette: c}
+	}
+	return &recordTransport{base: base, cassette: c}
+}
+
+func (c *Cassette) append(interaction *Interaction) {
+	data, err := json.Marshal(interaction)
+	if err != nil {
+		slog.Error("encode interaction", slog.Any("err", err))
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.file.Write(append(data, '\n')); err != nil {
+		slog.Error("write cassette", slog.Any("path", c.path), slog.Any("err", err))
+	}
+}
+
+// next returns the first unused interaction with the key, or the first
+// unused one at all when the request was not recorded verbatim
+func (c *Cassette) next(key string) *Interaction {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fallback := -1
+	for i, interaction := range c.interactions {
+		if c.used[i] {
+			continue
+		}
+		if interaction.Key == key {
+			c.used[i] = true
+			return interaction
+		}
+		if fallback < 0 {
+			fallback = i
+		}
+	}
+	if fallback < 0 {
+		return nil
+	}
+	slog.Warn("replaying interaction out of order", slog.Any("cassette", c.path), slog.Any("key", key))
+	c.used[fallback] = true
+	return c.interactions[fallback]
+}
+
+// readRequest takes the body of req, leaving req with a fresh copy, and
+// returns the interaction key of the request
+func readRequest(req *http.Request) ([]byte, string, error) {
+	var body []byte
+	if req.Body != nil {
+		data, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, "", err
+		}
+		body = data
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	sum := sha256.New()
+	sum.Write([]byte(req.Method + " " + req.URL.Path + "\n"))
+	sum.Write(body)
+	return body, hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// recordTransport saves every exchange once the response body is closed, so
+// streams are recorded as far as the client read them
+type recordTransport struct {
+	base     http.RoundTripper
+	cassette *Cassette
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, key, err := readRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	interaction := &Interaction{
+		RecordedAt: time.Now(),
+		Key:        key,
+		Method:     req.Method,
+		URL:        req.URL.String(),
+	}
+	if json.Valid(body) {
+		interaction.Request = body
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		interaction.Error = err.Error()
+		t.cassette.append(interaction)
+		return nil, err
+	}
+	interaction.Status = resp.StatusCode
+	interaction.ContentType = resp.Header.Get("Content-Type")
+	resp.Body = &recordBody{ReadCloser: resp.Body, done: func(data []byte) {
+		interaction.Response = string(data)
+		t.cassette.append(interaction)
+	}}
+	return resp, nil
+}
+
+type recordBody struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	once sync.Once
+	done func(data []byte)
+}
+
+func (b *recordBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+func (b *recordBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.done(b.buf.Bytes()) })
+	return err
+}
+
+// replayTransport answers from the cassette without touching the network
+type replayTransport struct {
+	cassette *Cassette
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	_, key, err := readRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	interaction := t.cassette.next(key)
+	if interaction == nil {
+		return nil, errors.Errorf("cassette %s has no interaction left for %s %s", t.cassette.path, req.Method, req.URL.Path)
+	}
+	if interaction.Error != "" {
+		return nil, errors.New(interaction.Error)
+	}
+	header := http.Header{}
+	if interaction.ContentType != "" {
+		header.Set("Content-Type", interaction.ContentType)
+	}
+	return &http.Response{
+		StatusCode:    interaction.Status,
+		Status:        http.StatusText(interaction.Status),
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewBufferString(interaction.Response)),
+		ContentLength: int64(len(interaction.Response)),
+		Request:       req,
+	}, nil
+}
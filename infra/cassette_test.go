@@ -0,0 +1,69 @@
+package infra
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"super-llm/config"
+)
+
+func TestCassetteFile(t *testing.T) {
+	for _, name := range []string{"Qwen/Qwen2.5-7B", "../escape", "..", "a\\b"} {
+		file := cassetteFile(name)
+		if strings.ContainsAny(file, "/\\") || strings.HasPrefix(file, ".") {
+			t.Errorf("cassette of %q leaves the directory: %s", name, file)
+		}
+	}
+	if file := cassetteFile("qwen-rigorous"); file != "qwen-rigorous.jsonl" {
+		t.Errorf("plain name changed to %s", file)
+	}
+	if cassetteFile("a/b") == cassetteFile("a_b") {
+		t.Errorf("altered name collides with a plain one")
+	}
+}
+
+// TestCassetteReplay records an exchange and replays it without the backend
+func TestCassetteReplay(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"ok":true}`)
+	}))
+	dir := t.TempDir()
+
+	do := func(transport http.RoundTripper) string {
+		resp, err := (&http.Client{Transport: transport}).Post(backend.URL+"/v1/x", "application/json", strings.NewReader(`{"q":1}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return string(data)
+	}
+
+	recorder, err := OpenCassette(&config.RecorderConfig{Mode: RecordMode, Dir: dir}, "Qwen/Qwen2.5-7B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := do(recorder.Transport(http.DefaultTransport)); got != `{"ok":true}` {
+		t.Fatalf("recorded %s", got)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.jsonl")); len(files) != 1 {
+		t.Fatalf("cassette files %v", files)
+	}
+
+	backend.Close()
+	player, err := OpenCassette(&config.RecorderConfig{Mode: ReplayMode, Dir: dir}, "Qwen/Qwen2.5-7B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := do(player.Transport(http.DefaultTransport)); got != `{"ok":true}` {
+		t.Fatalf("replayed %s", got)
+	}
+}
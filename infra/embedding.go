@@ -0,0 +1,100 @@
+package infra
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"super-llm/config"
+
+	"github.com/pkg/errors"
+)
+
+// Embedder calls an OpenAI-compatible /embeddings endpoint
+type Embedder struct {
+	Model      string
+	BaseURL    string
+	APIKey     string
+	HTTPClient *http.Client
+}
+
+// EmbeddingUsage is the token usage reported by the endpoint
+type EmbeddingUsage struct {
+	PromptTokens int32 `json:"prompt_tokens"`
+	TotalTokens  int32 `json:"total_tokens"`
+}
+
+// NewEmbedder creates an embedder, recording or replaying its calls through
+// the cassette when one is given
+func NewEmbedder(c *config.EmbeddingConfig, cassette *Cassette) *Embedder {
+	var transport http.RoundTripper = http.DefaultTransport
+	if cassette != nil {
+		transport = cassette.Transport(transport)
+	}
+	return &Embedder{
+		Model:      c.Model,
+		BaseURL:    c.BaseURL,
+		APIKey:     c.APIKey,
+		HTTPClient: &http.Client{Transport: transport},
+	}
+}
+
+// Embed returns one vector per input text, in input order
+func (e *Embedder) Embed(ctx context.Context, texts []string) ([][]float64, *EmbeddingUsage, error) {
+	reqBody, err := json.Marshal(map[string]any{
+		"model": e.Model,
+		"input": texts,
+	})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "marshal embedding request")
+	}
+	embeddingURL, err := url.JoinPath(e.BaseURL, "/embeddings")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "join embedding url")
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, embeddingURL, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "create embedding request")
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if e.APIKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+e.APIKey)
+	}
+
+	httpResp, err := e.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "embedding request")
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(httpResp.Body)
+		return nil, nil, fmt.Errorf("embedding API error (status %d): %s", httpResp.StatusCode, data)
+	}
+
+	var resp struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+		Usage *EmbeddingUsage `json:"usage"`
+	}
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return nil, nil, errors.Wrap(err, "decode embedding response")
+	}
+	vectors := make([][]float64, len(texts))
+	for _, item := range resp.Data {
+		if item.Index < 0 || item.Index >= len(vectors) {
+			return nil, nil, errors.Errorf("embedding index %d out of range", item.Index)
+		}
+		vectors[item.Index] = item.Embedding
+	}
+	for i, vector := range vectors {
+		if vector == nil {
+			return nil, nil, errors.Errorf("missing embedding for input %d", i)
+		}
+	}
+	return vectors, resp.Usage, nil
+}
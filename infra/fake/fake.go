@@ -0,0 +1,476 @@
+// Package fake serves a scripted OpenAI-compatible chat completions backend,
+// so that the committee can run end to end without a GPU or network. It is
+// started by the fake subcommand, and tests can mount Handler on an
+// httptest.Server and point the LLM base URLs at it.
+package fake
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/cv70/pkgo/llm"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Default replies used when no rule matches
+const (
+	// ReplyEcho answers with the last user message
+	ReplyEcho = "echo"
+	// ReplyHash answers with a stable text derived from the request
+	ReplyHash = "hash"
+)
+
+// Config scripts the fake backend
+type Config struct {
+	// Models are listed by /v1/models; requests for any model are served
+	Models []string `yaml:"models"`
+	// Latency delays every response, plus a random Jitter
+	Latency time.Duration `yaml:"latency"`
+	Jitter  time.Duration `yaml:"jitter"`
+	// ChunkDelay is waited between streamed chunks
+	ChunkDelay time.Duration `yaml:"chunk_delay"`
+	// ErrorRate is the share of requests failed with ErrorStatus
+	ErrorRate   float64 `yaml:"error_rate"`
+	ErrorStatus int     `yaml:"error_status"`
+	// MalformedRate is the share of requests answered with broken JSON
+	MalformedRate float64 `yaml:"malformed_rate"`
+	// Seed makes the injected latency, errors and malformed output repeatable
+	Seed int64 `yaml:"seed"`
+	// Default is echo, hash or a reply template used when no rule matches
+	Default string  `yaml:"default"`
+	Rules   []*Rule `yaml:"rules"`
+}
+
+// Rule answers requests whose conversation matches Match. Replies are
+// text/template templates given the Data of the request; several replies
+// are returned in turn.
+type Rule struct {
+	// Match is a regular expression over all message contents
+	Match string `yaml:"match"`
+	// Model restricts the rule to requests for this model
+	Model     string        `yaml:"model"`
+	Reply     string        `yaml:"reply"`
+	Replies   []string      `yaml:"replies"`
+	Status    int           `yaml:"status"`
+	Malformed bool          `yaml:"malformed"`
+	Latency   time.Duration `yaml:"latency"`
+
+	pattern   *regexp.Regexp
+	templates []*template.Template
+	next      int
+}
+
+// Data is passed to reply templates
+type Data struct {
+	Model string
+	// Prompt is the last user message
+	Prompt string
+	// System is the system message, if any
+	System string
+	// Count is the number of requests served so far, starting at 1
+	Count int
+}
+
+// LoadConfig reads a fake backend script from a YAML file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read fake config")
+	}
+	var c Config
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, errors.Wrap(err, "parse fake config")
+	}
+	return &c, nil
+}
+
+// Server is the fake backend
+type Server struct {
+	config *Config
+	router *gin.Engine
+
+	mu       sync.Mutex
+	rand     *rand.Rand
+	count    int
+	fallback *template.Template
+}
+
+// NewServer compiles the rules of the script
+func NewServer(c *Config) (*Server, error) {
+	if c == nil {
+		c = &Config{}
+	}
+	s := &Server{config: c}
+	if c.Seed != 0 {
+		s.rand = rand.New(rand.NewSource(c.Seed))
+	} else {
+		s.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	if c.Default != "" && c.Default != ReplyEcho && c.Default != ReplyHash {
+		tmpl, err := template.New("default").Parse(c.Default)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse default reply")
+		}
+		s.fallback = tmpl
+	}
+	for i, rule := range c.Rules {
+		if err := rule.compile(); err != nil {
+			return nil, errors.Wrapf(err, "rule %d", i)
+		}
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	s.router = gin.New()
+	s.router.Use(gin.Recovery())
+	s.router.POST("/v1/chat/completions", s.chatCompletions)
+	s.router.POST("/v1/embeddings", s.embeddings)
+	s.router.GET("/v1/models", s.models)
+	return s, nil
+}
+
+func (r *Rule) compile() error {
+	pattern, err := regexp.Compile(r.Match)
+	if err != nil {
+		return errors.Wrap(err, "parse match")
+	}
+	r.pattern = pattern
+	replies := r.Replies
+	if r.Reply != "" {
+		replies = append([]string{r.Reply}, replies...)
+	}
+	for _, reply := range replies {
+		tmpl, err := template.New("reply").Parse(reply)
+		if err != nil {
+			return errors.Wrap(err, "parse reply")
+		}
+		r.templates = append(r.templates, tmpl)
+	}
+	return nil
+}
+
+// Handler returns the HTTP handler serving the fake API
+func (s *Server) Handler() http.Handler {
+	return s.router
+}
+
+// Start serves the fake API on addr until the context is cancelled
+func (s *Server) Start(ctx context.Context, addr string) error {
+	server := &http.Server{Addr: addr, Handler: s.router}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	slog.Info("Fake backend started", slog.Any("addr", addr))
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+type chatRequest struct {
+	Model         string             `json:"model"`
+	Messages      []*llm.ChatMessage `json:"messages"`
+	Stream        bool               `json:"stream"`
+	StreamOptions *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
+}
+
+// reply is the planned answer to a request
+type reply struct {
+	text      string
+	status    int
+	malformed bool
+	latency   time.Duration
+}
+
+func (s *Server) chatCompletions(c *gin.Context) {
+	var req chatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errorBody(err.Error()))
+		return
+	}
+
+	r, err := s.plan(&req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(err.Error()))
+		return
+	}
+	select {
+	case <-time.After(r.latency):
+	case <-c.Request.Context().Done():
+		return
+	}
+	if r.status != 0 && r.status != http.StatusOK {
+		c.JSON(r.status, errorBody(fmt.Sprintf("fake error %d", r.status)))
+		return
+	}
+
+	completion := &llm.ChatCompletionResponse{
+		ID:      "chatcmpl-" + uuid.NewString(),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Choices: []llm.ChatChoice{{
+			Index:        0,
+			Message:      &llm.ChatMessage{Role: llm.RoleAssistant, Content: r.text},
+			FinishReason: "stop",
+		}},
+		Usage: usage(req.Messages, r.text),
+	}
+	if req.Stream {
+		s.stream(c, completion, r.malformed, req.StreamOptions != nil && req.StreamOptions.IncludeUsage)
+		return
+	}
+	data, _ := json.Marshal(completion)
+	if r.malformed {
+		data = data[:len(data)/2]
+	}
+	c.Data(http.StatusOK, "application/json", data)
+}
+
+// plan picks the reply, status and latency of a request
+func (s *Server) plan(req *chatRequest) (*reply, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.count++
+
+	data := &Data{Model: req.Model, Count: s.count}
+	var all []string
+	for _, message := range req.Messages {
+		text := messageText(message)
+		all = append(all, text)
+		switch message.Role {
+		case llm.RoleUser:
+			data.Prompt = text
+		case llm.RoleSystem:
+			data.System = text
+		}
+	}
+	conversation := strings.Join(all, "\n")
+
+	r := &reply{latency: s.config.Latency}
+	if s.config.Jitter > 0 {
+		r.latency += time.Duration(s.rand.Int63n(int64(s.config.Jitter)))
+	}
+	if s.config.ErrorRate > 0 && s.rand.Float64() < s.config.ErrorRate {
+		r.status = s.config.ErrorStatus
+		if r.status == 0 {
+			r.status = http.StatusInternalServerError
+		}
+	}
+	r.malformed = s.config.MalformedRate > 0 && s.rand.Float64() < s.config.MalformedRate
+
+	for _, rule := range s.config.Rules {
+		if rule.Model != "" && rule.Model != req.Model {
+			continue
+		}
+		if !rule.pattern.MatchString(conversation) {
+			continue
+		}
+		if rule.Status != 0 {
+			r.status = rule.Status
+		}
+		r.malformed = r.malformed || rule.Malformed
+		if rule.Latency > 0 {
+			r.latency = rule.Latency
+		}
+		if len(rule.templates) == 0 {
+			break
+		}
+		tmpl := rule.templates[rule.next%len(rule.templates)]
+		rule.next++
+		text, err := execute(tmpl, data)
+		r.text = text
+		return r, err
+	}
+
+	switch {
+	case s.fallback != nil:
+		text, err := execute(s.fallback, data)
+		r.text = text
+		return r, err
+	case s.config.Default == ReplyHash:
+		h := fnv.New64a()
+		h.Write([]byte(req.Model + "\n" + conversation))
+		r.text = fmt.Sprintf("%s 的回答 %016x", req.Model, h.Sum64())
+	default:
+		r.text = data.Prompt
+	}
+	return r, nil
+}
+
+func execute(tmpl *template.Template, data *Data) (string, error) {
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", errors.Wrap(err, "render reply")
+	}
+	return out.String(), nil
+}
+
+// stream writes the completion as SSE chunks of a few characters each
+func (s *Server) stream(c *gin.Context, completion *llm.ChatCompletionResponse, malformed, includeUsage bool) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+
+	write := func(choices []llm.ChatChoice, usage *llm.ChatUsage) {
+		data, _ := json.Marshal(&llm.ChatCompletionResponse{
+			ID:      completion.ID,
+			Object:  "chat.completion.chunk",
+			Created: completion.Created,
+			Model:   completion.Model,
+			Choices: choices,
+			Usage:   usage,
+		})
+		fmt.Fprintf(c.Writer, "data: %s\n\n", data)
+		c.Writer.Flush()
+	}
+
+	text := []rune(completion.Choices[0].Message.Content.(string))
+	write([]llm.ChatChoice{{Delta: &llm.ChatMessage{Role: llm.RoleAssistant}}}, nil)
+	for i := 0; i < len(text); i += 4 {
+		if s.config.ChunkDelay > 0 {
+			select {
+			case <-time.After(s.config.ChunkDelay):
+			case <-c.Request.Context().Done():
+				return
+			}
+		}
+		write([]llm.ChatChoice{{Delta: &llm.ChatMessage{Role: llm.RoleAssistant, Content: string(text[i:min(i+4, len(text))])}}}, nil)
+		if malformed && i >= len(text)/2 {
+			// Cut the stream off inside a chunk without the final [DONE]
+			fmt.Fprint(c.Writer, `data: {"id":"`+completion.ID+`","choices":[{"delta":`)
+			c.Writer.Flush()
+			return
+		}
+	}
+	write([]llm.ChatChoice{{Delta: &llm.ChatMessage{Role: llm.RoleAssistant}, FinishReason: "stop"}}, nil)
+	if includeUsage {
+		write([]llm.ChatChoice{}, completion.Usage)
+	}
+	fmt.Fprint(c.Writer, "data: [DONE]\n\n")
+	c.Writer.Flush()
+}
+
+func (s *Server) models(c *gin.Context) {
+	data := []gin.H{}
+	for _, model := range s.config.Models {
+		data = append(data, gin.H{"id": model, "object": "model", "owned_by": "fake"})
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": data})
+}
+
+// embeddings answers with vectors hashed from the input, so equal texts
+// embed equally
+func (s *Server) embeddings(c *gin.Context) {
+	var req struct {
+		Model string `json:"model"`
+		Input any    `json:"input"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errorBody(err.Error()))
+		return
+	}
+	var inputs []string
+	switch input := req.Input.(type) {
+	case string:
+		inputs = []string{input}
+	case []any:
+		for _, item := range input {
+			text, _ := item.(string)
+			inputs = append(inputs, text)
+		}
+	}
+
+	data := []gin.H{}
+	tokens := 0
+	for i, input := range inputs {
+		h := fnv.New64a()
+		h.Write([]byte(input))
+		r := rand.New(rand.NewSource(int64(h.Sum64())))
+		vector := make([]float64, 8)
+		for j := range vector {
+			vector[j] = r.Float64()*2 - 1
+		}
+		data = append(data, gin.H{"object": "embedding", "index": i, "embedding": vector})
+		tokens += countTokens(input)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"model":  req.Model,
+		"data":   data,
+		"usage":  gin.H{"prompt_tokens": tokens, "total_tokens": tokens},
+	})
+}
+
+func messageText(message *llm.ChatMessage) string {
+	switch content := message.Content.(type) {
+	case string:
+		return content
+	case []any:
+		var parts []string
+		for _, part := range content {
+			if m, ok := part.(map[string]any); ok {
+				if text, ok := m["text"].(string); ok {
+					parts = append(parts, text)
+				}
+			}
+		}
+		return strings.Join(parts, "\n")
+	}
+	return ""
+}
+
+// usage counts roughly a token per word or CJK character
+func usage(messages []*llm.ChatMessage, reply string) *llm.ChatUsage {
+	prompt := 0
+	for _, message := range messages {
+		prompt += countTokens(messageText(message))
+	}
+	completion := countTokens(reply)
+	return &llm.ChatUsage{
+		PromptTokens:     int32(prompt),
+		CompletionTokens: int32(completion),
+		TotalTokens:      int32(prompt + completion),
+	}
+}
+
+func countTokens(text string) int {
+	count := 0
+	inWord := false
+	for _, r := range text {
+		switch {
+		case r > 0x2e80:
+			count++
+			inWord = false
+		case r == ' ' || r == '\n' || r == '\t':
+			inWord = false
+		case !inWord:
+			count++
+			inWord = true
+		}
+	}
+	return count
+}
+
+func errorBody(message string) gin.H {
+	return gin.H{"error": gin.H{"message": message, "type": "fake_error"}}
+}
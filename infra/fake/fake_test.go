@@ -0,0 +1,112 @@
+package fake
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cv70/pkgo/llm"
+)
+
+// chat posts a chat completion request to the fake backend
+func chat(t *testing.T, s *Server, model, prompt string, stream bool) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(map[string]any{
+		"model":          model,
+		"messages":       []map[string]string{{"role": "user", "content": prompt}},
+		"stream":         stream,
+		"stream_options": map[string]bool{"include_usage": true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	return w
+}
+
+func replyText(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var completion llm.ChatCompletionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &completion); err != nil {
+		t.Fatalf("decode %s: %v", w.Body, err)
+	}
+	text, _ := completion.Choices[0].Message.Content.(string)
+	return text
+}
+
+func TestRules(t *testing.T) {
+	s, err := NewServer(&Config{
+		Default: ReplyEcho,
+		Rules: []*Rule{
+			{Match: "fail", Status: http.StatusServiceUnavailable},
+			{Match: "weather", Model: "b", Reply: "b says sunny"},
+			{Match: "weather", Replies: []string{"{{.Model}} one", "{{.Model}} two #{{.Count}}"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"a one", "a two #2", "a one"} {
+		if got := replyText(t, chat(t, s, "a", "weather?", false)); got != want {
+			t.Errorf("reply %q, want %q", got, want)
+		}
+	}
+	if got := replyText(t, chat(t, s, "b", "weather?", false)); got != "b says sunny" {
+		t.Errorf("model rule: reply %q", got)
+	}
+	if got := replyText(t, chat(t, s, "a", "hello", false)); got != "hello" {
+		t.Errorf("echo: reply %q", got)
+	}
+	if w := chat(t, s, "a", "fail now", false); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status rule: status %d", w.Code)
+	}
+}
+
+func TestStream(t *testing.T) {
+	s, err := NewServer(&Config{Default: "答案是四"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := chat(t, s, "a", "2+2?", true)
+
+	var text strings.Builder
+	var usage *llm.ChatUsage
+	done := false
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			done = true
+			break
+		}
+		var chunk llm.ChatCompletionResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("decode chunk %s: %v", data, err)
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			if content, ok := choice.Delta.Content.(string); ok {
+				text.WriteString(content)
+			}
+		}
+	}
+	if text.String() != "答案是四" || !done {
+		t.Errorf("streamed %q, done %v", text.String(), done)
+	}
+	if usage == nil || usage.CompletionTokens != 4 {
+		t.Errorf("usage %+v, want 4 completion tokens", usage)
+	}
+}
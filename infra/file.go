@@ -0,0 +1,24 @@
+package infra
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes data through a temp file in the same directory so
+// that readers never see a partial file
+func WriteFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+package infra
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// flushDelay is how long changes gather before they are written together
+const flushDelay = time.Second
+
+// Flusher writes state to a file in the background. The first change marks
+// the state dirty and schedules a write; changes made until then are written
+// with it, so frequent updates neither wait on disk I/O nor rewrite the file
+// every time.
+type Flusher struct {
+	path string
+	// snapshot encodes the state, taking the owner's lock
+	snapshot func() ([]byte, error)
+
+	mu    sync.Mutex
+	dirty bool
+	timer *time.Timer
+	// writeMu keeps writes in order
+	writeMu sync.Mutex
+}
+
+// NewFlusher creates a flusher writing the snapshots of a state to path
+func NewFlusher(path string, snapshot func() ([]byte, error)) *Flusher {
+	return &Flusher{path: path, snapshot: snapshot}
+}
+
+// Mark records that the state changed and schedules its write
+func (f *Flusher) Mark() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.dirty {
+		return
+	}
+	f.dirty = true
+	f.timer = time.AfterFunc(flushDelay, func() {
+		if err := f.Flush(); err != nil {
+			slog.Error("flush state", slog.Any("path", f.path), slog.Any("err", err))
+		}
+	})
+}
+
+// Flush writes the pending changes now, if there are any
+func (f *Flusher) Flush() error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	f.mu.Lock()
+	if !f.dirty {
+		f.mu.Unlock()
+		return nil
+	}
+	f.dirty = false
+	f.timer.Stop()
+	f.mu.Unlock()
+
+	data, err := f.snapshot()
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(f.path, data)
+}
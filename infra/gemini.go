@@ -0,0 +1,274 @@
+package infra
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"super-llm/config"
+
+	"github.com/cv70/pkgo/llm"
+	"github.com/pkg/errors"
+	"google.golang.org/genai"
+)
+
+// geminiTransport speaks the Gemini generateContent API
+type geminiTransport struct {
+	base    http.RoundTripper
+	config  *config.LLMConfig
+	baseURL string
+}
+
+type geminiRequest struct {
+	Contents          []*genai.Content  `json:"contents"`
+	SystemInstruction *genai.Content    `json:"systemInstruction,omitempty"`
+	Tools             []*geminiTool     `json:"tools,omitempty"`
+	GenerationConfig  *geminiGeneration `json:"generationConfig,omitempty"`
+}
+
+type geminiTool struct {
+	FunctionDeclarations []*genai.FunctionDeclaration `json:"functionDeclarations"`
+}
+
+type geminiGeneration struct {
+	Temperature      *float32 `json:"temperature,omitempty"`
+	TopP             *float32 `json:"topP,omitempty"`
+	MaxOutputTokens  *int32   `json:"maxOutputTokens,omitempty"`
+	PresencePenalty  *float32 `json:"presencePenalty,omitempty"`
+	FrequencyPenalty *float32 `json:"frequencyPenalty,omitempty"`
+	Seed             *int32   `json:"seed,omitempty"`
+	StopSequences    []string `json:"stopSequences,omitempty"`
+	ResponseMIMEType string   `json:"responseMimeType,omitempty"`
+}
+
+func (t *geminiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	chat, err := readChatRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := fmt.Sprintf("%s/models/%s:generateContent", strings.TrimSuffix(t.baseURL, "/"), chat.Model)
+	if chat.Stream {
+		endpoint = fmt.Sprintf("%s/models/%s:streamGenerateContent?alt=sse", strings.TrimSuffix(t.baseURL, "/"), chat.Model)
+	}
+	out, err := nativeRequest(req, endpoint, newGeminiRequest(chat))
+	if err != nil {
+		return nil, err
+	}
+	out.Header.Set("x-goog-api-key", t.config.APIKey)
+	setHeaders(out, t.config.Headers)
+
+	resp, err := t.base.RoundTrip(out)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	if chat.Stream {
+		return streamResponse(resp, chat.Model, func(body io.Reader, w *chunkWriter) error {
+			return translateGeminiStream(body, w, chat.includeUsage())
+		}), nil
+	}
+
+	defer resp.Body.Close()
+	var generated genai.GenerateContentResponse
+	if err := json.NewDecoder(resp.Body).Decode(&generated); err != nil {
+		return nil, errors.Wrap(err, "decode gemini response")
+	}
+	completion := newChatCompletion(generated.ResponseID, chat.Model)
+	reply := &llm.ChatMessage{Role: llm.RoleAssistant}
+	finishReason := "stop"
+	if len(generated.Candidates) > 0 {
+		candidate := generated.Candidates[0]
+		text, calls := geminiParts(candidate.Content, 0)
+		reply.Content = text
+		reply.ToolCalls = calls
+		finishReason = geminiFinishReason(candidate.FinishReason, len(calls) > 0)
+	}
+	completion.Choices = []llm.ChatChoice{{Message: reply, FinishReason: finishReason}}
+	completion.Usage = geminiUsage(generated.UsageMetadata)
+	return completionResponse(resp, completion), nil
+}
+
+func newGeminiRequest(chat *chatRequest) *geminiRequest {
+	out := &geminiRequest{GenerationConfig: &geminiGeneration{
+		Temperature:      chat.Temperature,
+		TopP:             chat.TopP,
+		MaxOutputTokens:  chat.MaxTokens,
+		PresencePenalty:  chat.PresencePenalty,
+		FrequencyPenalty: chat.FrequencyPenalty,
+		Seed:             chat.Seed,
+		StopSequences:    chat.Stop,
+	}}
+	if chat.ResponseFormat != nil && chat.ResponseFormat.Type == "json_object" {
+		out.GenerationConfig.ResponseMIMEType = "application/json"
+	}
+
+	// Tool results name the function, which OpenAI only keeps on the call
+	names := map[string]string{}
+	var system []string
+	for _, message := range chat.Messages {
+		var part *genai.Part
+		role := genai.RoleUser
+		switch message.Role {
+		case llm.RoleSystem:
+			system = append(system, messageText(message.Content))
+			continue
+		case "tool":
+			response := map[string]any{}
+			text := messageText(message.Content)
+			if json.Unmarshal([]byte(text), &response) != nil {
+				response = map[string]any{"content": text}
+			}
+			part = &genai.Part{FunctionResponse: &genai.FunctionResponse{
+				ID:       message.ToolCallID,
+				Name:     names[message.ToolCallID],
+				Response: response,
+			}}
+		case llm.RoleAssistant:
+			role = genai.RoleModel
+		}
+
+		var parts []*genai.Part
+		if part != nil {
+			parts = append(parts, part)
+		} else if text := messageText(message.Content); text != "" {
+			parts = append(parts, genai.NewPartFromText(text))
+		}
+		for i := range message.ToolCalls {
+			call := &message.ToolCalls[i]
+			names[call.ID] = call.Function.Name
+			parts = append(parts, &genai.Part{FunctionCall: &genai.FunctionCall{
+				Name: call.Function.Name,
+				Args: toolArguments(call),
+			}})
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		// Consecutive turns of one role are merged
+		if n := len(out.Contents); n > 0 && out.Contents[n-1].Role == role {
+			out.Contents[n-1].Parts = append(out.Contents[n-1].Parts, parts...)
+			continue
+		}
+		out.Contents = append(out.Contents, &genai.Content{Role: role, Parts: parts})
+	}
+	if len(system) > 0 {
+		out.SystemInstruction = genai.NewContentFromText(strings.Join(system, "\n\n"), genai.RoleUser)
+	}
+
+	if len(chat.Tools) > 0 {
+		tool := &geminiTool{}
+		for _, t := range chat.Tools {
+			tool.FunctionDeclarations = append(tool.FunctionDeclarations, &genai.FunctionDeclaration{
+				Name:                 t.Function.Name,
+				Description:          t.Function.Description,
+				ParametersJsonSchema: t.Function.Parameters,
+			})
+		}
+		out.Tools = []*geminiTool{tool}
+	}
+	return out
+}
+
+// geminiParts splits the parts of a candidate into text and tool calls,
+// numbering the calls from offset
+func geminiParts(content *genai.Content, offset int) (string, []llm.ChatToolCall) {
+	if content == nil {
+		return "", nil
+	}
+	var text strings.Builder
+	var calls []llm.ChatToolCall
+	for _, part := range content.Parts {
+		switch {
+		case part.Thought:
+		case part.FunctionCall != nil:
+			index := offset + len(calls)
+			id := part.FunctionCall.ID
+			if id == "" {
+				id = fmt.Sprintf("call_%d", index)
+			}
+			arguments, _ := json.Marshal(part.FunctionCall.Args)
+			calls = append(calls, llm.ChatToolCall{
+				ID:       id,
+				Index:    &index,
+				Type:     "function",
+				Function: llm.ChatFunctionCall{Name: part.FunctionCall.Name, Arguments: string(arguments)},
+			})
+		default:
+			text.WriteString(part.Text)
+		}
+	}
+	return text.String(), calls
+}
+
+func translateGeminiStream(body io.Reader, w *chunkWriter, includeUsage bool) error {
+	var usage *llm.ChatUsage
+	calls := 0
+	finishReason := ""
+	if err := w.delta(&llm.ChatMessage{}, ""); err != nil {
+		return err
+	}
+	err := readEvents(body, func(data []byte) error {
+		var generated genai.GenerateContentResponse
+		if err := json.Unmarshal(data, &generated); err != nil {
+			return errors.Wrap(err, "decode gemini chunk")
+		}
+		if generated.UsageMetadata != nil {
+			usage = geminiUsage(generated.UsageMetadata)
+		}
+		if len(generated.Candidates) == 0 {
+			return nil
+		}
+		candidate := generated.Candidates[0]
+		text, toolCalls := geminiParts(candidate.Content, calls)
+		calls += len(toolCalls)
+		if text != "" || len(toolCalls) > 0 {
+			if err := w.delta(&llm.ChatMessage{Content: text, ToolCalls: toolCalls}, ""); err != nil {
+				return err
+			}
+		}
+		if candidate.FinishReason != "" {
+			finishReason = geminiFinishReason(candidate.FinishReason, calls > 0)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if finishReason == "" {
+		finishReason = "stop"
+	}
+	if err := w.delta(&llm.ChatMessage{}, finishReason); err != nil {
+		return err
+	}
+	if includeUsage && usage != nil {
+		if err := w.usage(usage); err != nil {
+			return err
+		}
+	}
+	return w.done()
+}
+
+func geminiUsage(usage *genai.GenerateContentResponseUsageMetadata) *llm.ChatUsage {
+	if usage == nil {
+		return nil
+	}
+	return &llm.ChatUsage{
+		PromptTokens:     usage.PromptTokenCount,
+		CompletionTokens: usage.CandidatesTokenCount + usage.ThoughtsTokenCount,
+		TotalTokens:      usage.TotalTokenCount,
+	}
+}
+
+func geminiFinishReason(reason genai.FinishReason, toolCalls bool) string {
+	switch {
+	case toolCalls:
+		return "tool_calls"
+	case reason == genai.FinishReasonMaxTokens:
+		return "length"
+	case reason == genai.FinishReasonSafety || reason == genai.FinishReasonProhibitedContent:
+		return "content_filter"
+	default:
+		return "stop"
+	}
+}
@@ -0,0 +1,320 @@
+package infra
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"super-llm/config"
+
+	"github.com/pkg/errors"
+)
+
+// ErrBusy is matched by the BusyError of a limiter that turned a request away
+var ErrBusy = errors.New("busy")
+
+// BusyError is returned when a limiter's queue is full or a request waited
+// too long for its turn
+type BusyError struct {
+	Name string
+	// RetryAfter estimates when the limiter has room again
+	RetryAfter time.Duration
+}
+
+func (e *BusyError) Error() string {
+	return e.Name + " is busy"
+}
+
+func (e *BusyError) Is(target error) bool {
+	return target == ErrBusy
+}
+
+type flowKey struct{}
+
+// WithFlow tags the backend requests made with ctx as one flow. Limiters
+// serve the queued flows in turn, so a flow with many requests cannot starve
+// the others.
+func WithFlow(ctx context.Context, flow string) context.Context {
+	return context.WithValue(ctx, flowKey{}, flow)
+}
+
+func flowOf(ctx context.Context) string {
+	flow, _ := ctx.Value(flowKey{}).(string)
+	return flow
+}
+
+// Limiter bounds the concurrency, requests per minute and tokens per minute
+// of a backend or of committee runs. Requests over the limits wait in a queue
+// served round-robin across flows.
+type Limiter struct {
+	name string
+	cfg  *config.LimitConfig
+
+	mu     sync.Mutex
+	active int
+	// window holds the starts of the last minute
+	window []start
+	// queues holds the waiting requests of every flow, served in the order
+	// of flows
+	queues  map[string][]*waiter
+	flows   []string
+	waiting int
+	timer   *time.Timer
+}
+
+type start struct {
+	at     time.Time
+	tokens int
+}
+
+type waiter struct {
+	tokens int
+	ready  chan struct{}
+}
+
+// NewLimiter creates a limiter, nil when c is nil
+func NewLimiter(name string, c *config.LimitConfig) *Limiter {
+	if c == nil {
+		return nil
+	}
+	return &Limiter{name: name, cfg: c, queues: map[string][]*waiter{}}
+}
+
+// Acquire waits for room for a request of the given estimated tokens and
+// returns the function releasing it. It fails with a BusyError when the
+// queue is full or the wait exceeds the configured maximum.
+func (l *Limiter) Acquire(ctx context.Context, tokens int) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.expire(now)
+	if l.waiting == 0 && l.room(tokens) {
+		l.begin(now, tokens)
+		l.mu.Unlock()
+		return l.releaser(), nil
+	}
+	if l.cfg.MaxQueue > 0 && l.waiting >= l.cfg.MaxQueue {
+		err := l.busy(now)
+		l.mu.Unlock()
+		return nil, err
+	}
+	flow := flowOf(ctx)
+	w := &waiter{tokens: tokens, ready: make(chan struct{})}
+	if len(l.queues[flow]) == 0 {
+		l.flows = append(l.flows, flow)
+	}
+	l.queues[flow] = append(l.queues[flow], w)
+	l.waiting++
+	l.schedule(now)
+	l.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if l.cfg.MaxWait > 0 {
+		timer := time.NewTimer(l.cfg.MaxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-w.ready:
+		return l.releaser(), nil
+	case <-ctx.Done():
+		return l.abandon(flow, w, ctx.Err())
+	case <-timeout:
+		l.mu.Lock()
+		err := l.busy(time.Now())
+		l.mu.Unlock()
+		return l.abandon(flow, w, err)
+	}
+}
+
+// abandon takes a waiter out of the queue, or releases the room it was
+// granted meanwhile
+func (l *Limiter) abandon(flow string, w *waiter, err error) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-w.ready:
+		l.active--
+		l.dispatch(time.Now())
+		return nil, err
+	default:
+	}
+	l.queues[flow] = slices.DeleteFunc(l.queues[flow], func(o *waiter) bool { return o == w })
+	if len(l.queues[flow]) == 0 {
+		delete(l.queues, flow)
+		l.flows = slices.DeleteFunc(l.flows, func(f string) bool { return f == flow })
+	}
+	l.waiting--
+	return nil, err
+}
+
+func (l *Limiter) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.active--
+			l.dispatch(time.Now())
+		})
+	}
+}
+
+// room reports whether a request of the given tokens may start now
+func (l *Limiter) room(tokens int) bool {
+	if l.cfg.MaxConcurrent > 0 && l.active >= l.cfg.MaxConcurrent {
+		return false
+	}
+	if l.cfg.RPM > 0 && len(l.window) >= l.cfg.RPM {
+		return false
+	}
+	if l.cfg.TPM > 0 && len(l.window) > 0 {
+		used := 0
+		for _, s := range l.window {
+			used += s.tokens
+		}
+		// A request larger than the whole budget still runs alone
+		if used+tokens > l.cfg.TPM {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *Limiter) begin(now time.Time, tokens int) {
+	l.active++
+	if l.cfg.RPM > 0 || l.cfg.TPM > 0 {
+		l.window = append(l.window, start{at: now, tokens: tokens})
+	}
+}
+
+// expire drops the starts older than a minute
+func (l *Limiter) expire(now time.Time) {
+	l.window = slices.DeleteFunc(l.window, func(s start) bool {
+		return now.Sub(s.at) >= time.Minute
+	})
+}
+
+// dispatch starts queued requests, one flow after the other, while there is
+// room for the next one
+func (l *Limiter) dispatch(now time.Time) {
+	l.expire(now)
+	for len(l.flows) > 0 {
+		flow := l.flows[0]
+		w := l.queues[flow][0]
+		if !l.room(w.tokens) {
+			break
+		}
+		l.begin(now, w.tokens)
+		close(w.ready)
+		l.waiting--
+		l.queues[flow] = l.queues[flow][1:]
+		l.flows = l.flows[1:]
+		if len(l.queues[flow]) > 0 {
+			l.flows = append(l.flows, flow)
+		} else {
+			delete(l.queues, flow)
+		}
+	}
+	l.schedule(now)
+}
+
+// schedule wakes the queue when the oldest start leaves the window, the
+// only event besides a release that makes room
+func (l *Limiter) schedule(now time.Time) {
+	if l.waiting == 0 || len(l.window) == 0 || l.timer != nil {
+		return
+	}
+	l.timer = time.AfterFunc(l.window[0].at.Add(time.Minute).Sub(now), func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.timer = nil
+		l.dispatch(time.Now())
+	})
+}
+
+// busy builds the error for a turned away request
+func (l *Limiter) busy(now time.Time) error {
+	retry := time.Second
+	if l.cfg.MaxWait > 0 {
+		retry = l.cfg.MaxWait
+	}
+	if (l.cfg.RPM > 0 && len(l.window) >= l.cfg.RPM) || (l.cfg.TPM > 0 && len(l.window) > 0) {
+		retry = l.window[0].at.Add(time.Minute).Sub(now)
+	}
+	return &BusyError{Name: l.name, RetryAfter: max(retry, time.Second)}
+}
+
+// limitTransport holds every backend request until its limiter has room and
+// releases the room once the response body is closed
+type limitTransport struct {
+	base    http.RoundTripper
+	limiter *Limiter
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	release, err := t.limiter.Acquire(req.Context(), estimateRequestTokens(req))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// ReleaseOnClose returns body calling release once it is closed. Closing it
+// again does nothing, so that callers may defer a close as a safety net.
+func ReleaseOnClose(body io.ReadCloser, release func()) io.ReadCloser {
+	return &releaseBody{ReadCloser: body, release: release}
+}
+
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+	err     error
+}
+
+func (b *releaseBody) Close() error {
+	b.once.Do(func() {
+		b.err = b.ReadCloser.Close()
+		b.release()
+	})
+	return b.err
+}
+
+// estimateRequestTokens guesses the tokens of a chat request from the size
+// of its body plus the completion it may produce
+func estimateRequestTokens(req *http.Request) int {
+	if req.GetBody == nil {
+		return 0
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return 0
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return 0
+	}
+	tokens := len(bytes.Runes(data)) / 2
+	var chat struct {
+		MaxTokens int `json:"max_tokens"`
+	}
+	if json.Unmarshal(data, &chat) == nil {
+		tokens += chat.MaxTokens
+	}
+	return tokens
+}
@@ -0,0 +1,123 @@
+package infra
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"super-llm/config"
+
+	"github.com/pkg/errors"
+)
+
+// queued waits until n requests wait in the limiter's queue
+func queued(t *testing.T, l *Limiter, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		l.mu.Lock()
+		waiting := l.waiting
+		l.mu.Unlock()
+		if waiting == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests queued, want %d", waiting, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestLimiterFlows serves the queued flows in turn
+func TestLimiterFlows(t *testing.T) {
+	l := NewLimiter("backend", &config.LimitConfig{MaxConcurrent: 1})
+	release, err := l.Acquire(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan string, 4)
+	for i, flow := range []string{"a", "a", "a", "b"} {
+		go func() {
+			release, err := l.Acquire(WithFlow(context.Background(), flow), 0)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			order <- flow
+			release()
+		}()
+		queued(t, l, i+1)
+	}
+	release()
+
+	var got []string
+	for range 4 {
+		got = append(got, <-order)
+	}
+	if want := []string{"a", "b", "a", "a"}; !slices.Equal(got, want) {
+		t.Errorf("served %v, want %v", got, want)
+	}
+}
+
+func TestLimiterBusy(t *testing.T) {
+	l := NewLimiter("backend", &config.LimitConfig{MaxConcurrent: 1, MaxQueue: 1, MaxWait: 20 * time.Millisecond})
+	release, err := l.Acquire(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	waited := make(chan error, 1)
+	go func() {
+		_, err := l.Acquire(context.Background(), 0)
+		waited <- err
+	}()
+	queued(t, l, 1)
+
+	// The queue is full
+	_, err = l.Acquire(context.Background(), 0)
+	var busy *BusyError
+	if !errors.As(err, &busy) || !errors.Is(err, ErrBusy) || busy.RetryAfter < time.Second {
+		t.Errorf("full queue: err %v", err)
+	}
+	// The waiting request gives up after MaxWait
+	if err := <-waited; !errors.Is(err, ErrBusy) {
+		t.Errorf("wait over MaxWait: err %v", err)
+	}
+	queued(t, l, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.Acquire(ctx, 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled wait: err %v", err)
+	}
+	queued(t, l, 0)
+}
+
+func TestLimiterWindow(t *testing.T) {
+	l := NewLimiter("backend", &config.LimitConfig{RPM: 1, MaxWait: time.Millisecond})
+	if _, err := l.Acquire(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	_, err := l.Acquire(context.Background(), 0)
+	var busy *BusyError
+	if !errors.As(err, &busy) || busy.RetryAfter < 50*time.Second {
+		t.Errorf("over RPM: err %v, want a retry once the minute is over", err)
+	}
+
+	l = NewLimiter("backend", &config.LimitConfig{TPM: 100, MaxWait: time.Millisecond})
+	// A request larger than the budget still runs alone
+	if _, err := l.Acquire(context.Background(), 500); err != nil {
+		t.Errorf("request over TPM alone: err %v", err)
+	}
+	if _, err := l.Acquire(context.Background(), 10); !errors.Is(err, ErrBusy) {
+		t.Errorf("over TPM: err %v", err)
+	}
+
+	var unlimited *Limiter
+	if release, err := unlimited.Acquire(context.Background(), 0); err != nil || release == nil {
+		t.Errorf("nil limiter: err %v", err)
+	}
+}
@@ -2,15 +2,45 @@ package infra
 
 import (
 	"context"
+	"net/http"
 	"super-llm/config"
 
 	"github.com/cv70/pkgo/llm"
+	"google.golang.org/adk/model"
 )
 
-func NewLLM(ctx context.Context, c *config.LLMConfig) (*llm.OpenAIModel, error) {
+// LLM is the client of a chat backend. Whatever the provider speaks
+// natively, requests and responses use the OpenAI chat completion format.
+type LLM interface {
+	model.LLM
+	// SendRequest returns the raw response, streamed when req.Stream is set
+	SendRequest(ctx context.Context, req *llm.ChatCompletionRequest) (*http.Response, error)
+	DoRequest(ctx context.Context, req *llm.ChatCompletionRequest) (*llm.ChatCompletionResponse, error)
+}
+
+// NewLLM creates the client of a backend. With a cassette the client records
+// its traffic, or serves it from the cassette in replay mode. Clients of one
+// backend share its limiter, which may be nil.
+func NewLLM(ctx context.Context, c *config.LLMConfig, cassette *Cassette, limiter *Limiter) (LLM, error) {
+	transport, err := newTransport(c, cassette, limiter)
+	if err != nil {
+		return nil, err
+	}
+	baseURL := c.BaseURL
+	if baseURL == "" {
+		baseURL = defaultBaseURLs[c.Provider]
+	}
+	apiKey := c.APIKey
+	if apiKey == "" && c.Provider == ProviderOllama {
+		// Local Ollama needs no key, but the client insists on one
+		apiKey = ProviderOllama
+	}
 	model, err := llm.NewModel(ctx, c.Model, &llm.ClientConfig{
-		BaseURL: c.BaseURL,
-		APIKey:  c.APIKey,
+		BaseURL: baseURL,
+		APIKey:  apiKey,
+		HTTPClient: &http.Client{
+			Transport: transport,
+		},
 	})
 	return model, err
 }
@@ -0,0 +1,208 @@
+package infra
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"super-llm/config"
+
+	"github.com/cv70/pkgo/llm"
+	"github.com/pkg/errors"
+)
+
+// ollamaTransport speaks the native Ollama chat API, which streams NDJSON
+type ollamaTransport struct {
+	base    http.RoundTripper
+	config  *config.LLMConfig
+	baseURL string
+}
+
+type ollamaRequest struct {
+	Model    string           `json:"model"`
+	Messages []*ollamaMessage `json:"messages"`
+	Tools    []*llm.ChatTool  `json:"tools,omitempty"`
+	Stream   bool             `json:"stream"`
+	Format   string           `json:"format,omitempty"`
+	Options  map[string]any   `json:"options,omitempty"`
+}
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+}
+
+type ollamaToolCall struct {
+	Function struct {
+		Name      string         `json:"name"`
+		Arguments map[string]any `json:"arguments"`
+	} `json:"function"`
+}
+
+type ollamaResponse struct {
+	Model           string         `json:"model"`
+	Message         *ollamaMessage `json:"message"`
+	Done            bool           `json:"done"`
+	DoneReason      string         `json:"done_reason"`
+	PromptEvalCount int32          `json:"prompt_eval_count"`
+	EvalCount       int32          `json:"eval_count"`
+	Error           string         `json:"error"`
+}
+
+func (t *ollamaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	chat, err := readChatRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	out, err := nativeRequest(req, strings.TrimSuffix(t.baseURL, "/")+"/api/chat", newOllamaRequest(chat))
+	if err != nil {
+		return nil, err
+	}
+	if t.config.APIKey != "" {
+		out.Header.Set("Authorization", "Bearer "+t.config.APIKey)
+	}
+	setHeaders(out, t.config.Headers)
+
+	resp, err := t.base.RoundTrip(out)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	if chat.Stream {
+		return streamResponse(resp, chat.Model, func(body io.Reader, w *chunkWriter) error {
+			return translateOllamaStream(body, w, chat.includeUsage())
+		}), nil
+	}
+
+	defer resp.Body.Close()
+	var generated ollamaResponse
+	if err := json.NewDecoder(resp.Body).Decode(&generated); err != nil {
+		return nil, errors.Wrap(err, "decode ollama response")
+	}
+	completion := newChatCompletion("", chat.Model)
+	reply := &llm.ChatMessage{Role: llm.RoleAssistant}
+	if generated.Message != nil {
+		reply.Content = generated.Message.Content
+		reply.ToolCalls = ollamaToolCalls(generated.Message.ToolCalls, 0)
+	}
+	completion.Choices = []llm.ChatChoice{{Message: reply, FinishReason: ollamaFinishReason(generated.DoneReason, len(reply.ToolCalls) > 0)}}
+	completion.Usage = generated.usage()
+	return completionResponse(resp, completion), nil
+}
+
+func newOllamaRequest(chat *chatRequest) *ollamaRequest {
+	out := &ollamaRequest{Model: chat.Model, Tools: chat.Tools, Stream: chat.Stream, Options: map[string]any{}}
+	if chat.ResponseFormat != nil && chat.ResponseFormat.Type == "json_object" {
+		out.Format = "json"
+	}
+	if chat.Temperature != nil {
+		out.Options["temperature"] = *chat.Temperature
+	}
+	if chat.TopP != nil {
+		out.Options["top_p"] = *chat.TopP
+	}
+	if chat.MaxTokens != nil {
+		out.Options["num_predict"] = *chat.MaxTokens
+	}
+	if chat.PresencePenalty != nil {
+		out.Options["presence_penalty"] = *chat.PresencePenalty
+	}
+	if chat.FrequencyPenalty != nil {
+		out.Options["frequency_penalty"] = *chat.FrequencyPenalty
+	}
+	if chat.Seed != nil {
+		out.Options["seed"] = *chat.Seed
+	}
+	if len(chat.Stop) > 0 {
+		out.Options["stop"] = chat.Stop
+	}
+	for _, message := range chat.Messages {
+		converted := &ollamaMessage{Role: message.Role, Content: messageText(message.Content)}
+		for i := range message.ToolCalls {
+			var call ollamaToolCall
+			call.Function.Name = message.ToolCalls[i].Function.Name
+			call.Function.Arguments = toolArguments(&message.ToolCalls[i])
+			converted.ToolCalls = append(converted.ToolCalls, call)
+		}
+		out.Messages = append(out.Messages, converted)
+	}
+	return out
+}
+
+func ollamaToolCalls(calls []ollamaToolCall, offset int) []llm.ChatToolCall {
+	var out []llm.ChatToolCall
+	for _, call := range calls {
+		index := offset + len(out)
+		arguments, _ := json.Marshal(call.Function.Arguments)
+		out = append(out, llm.ChatToolCall{
+			ID:       fmt.Sprintf("call_%d", index),
+			Index:    &index,
+			Type:     "function",
+			Function: llm.ChatFunctionCall{Name: call.Function.Name, Arguments: string(arguments)},
+		})
+	}
+	return out
+}
+
+func translateOllamaStream(body io.Reader, w *chunkWriter, includeUsage bool) error {
+	if err := w.delta(&llm.ChatMessage{}, ""); err != nil {
+		return err
+	}
+	calls := 0
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var generated ollamaResponse
+		if err := json.Unmarshal(scanner.Bytes(), &generated); err != nil {
+			return errors.Wrap(err, "decode ollama chunk")
+		}
+		if generated.Error != "" {
+			return errors.Errorf("ollama stream error: %s", generated.Error)
+		}
+		if message := generated.Message; message != nil && (message.Content != "" || len(message.ToolCalls) > 0) {
+			toolCalls := ollamaToolCalls(message.ToolCalls, calls)
+			calls += len(toolCalls)
+			if err := w.delta(&llm.ChatMessage{Content: message.Content, ToolCalls: toolCalls}, ""); err != nil {
+				return err
+			}
+		}
+		if !generated.Done {
+			continue
+		}
+		if err := w.delta(&llm.ChatMessage{}, ollamaFinishReason(generated.DoneReason, calls > 0)); err != nil {
+			return err
+		}
+		if includeUsage {
+			if err := w.usage(generated.usage()); err != nil {
+				return err
+			}
+		}
+		return w.done()
+	}
+	return scanner.Err()
+}
+
+func (r *ollamaResponse) usage() *llm.ChatUsage {
+	return &llm.ChatUsage{
+		PromptTokens:     r.PromptEvalCount,
+		CompletionTokens: r.EvalCount,
+		TotalTokens:      r.PromptEvalCount + r.EvalCount,
+	}
+}
+
+func ollamaFinishReason(reason string, toolCalls bool) string {
+	switch {
+	case toolCalls:
+		return "tool_calls"
+	case reason == "length":
+		return "length"
+	default:
+		return "stop"
+	}
+}
@@ -0,0 +1,335 @@
+package infra
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"super-llm/config"
+
+	"github.com/cv70/pkgo/llm"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// LLM providers. Every provider is spoken to through the OpenAI chat
+// completion format; the others are translated by a transport.
+const (
+	ProviderOpenAI    = "openai"
+	ProviderAnthropic = "anthropic"
+	ProviderGemini    = "gemini"
+	ProviderOllama    = "ollama"
+	ProviderAzure     = "azure"
+)
+
+// defaultBaseURLs are used when a provider is configured without base URL
+var defaultBaseURLs = map[string]string{
+	ProviderAnthropic: "https://api.anthropic.com/v1",
+	ProviderGemini:    "https://generativelanguage.googleapis.com/v1beta",
+	ProviderOllama:    "http://localhost:11434",
+}
+
+// newProviderTransport translates OpenAI chat completion requests into the
+// native API of the configured provider
+func newProviderTransport(base http.RoundTripper, c *config.LLMConfig) (http.RoundTripper, error) {
+	baseURL := c.BaseURL
+	if baseURL == "" {
+		baseURL = defaultBaseURLs[c.Provider]
+	}
+	switch c.Provider {
+	case "", ProviderOpenAI:
+		if len(c.Headers) == 0 {
+			return base, nil
+		}
+		return &headerTransport{base: base, headers: c.Headers}, nil
+	case ProviderAzure:
+		return newAzureTransport(base, c)
+	case ProviderAnthropic:
+		return &anthropicTransport{base: base, config: c, baseURL: baseURL}, nil
+	case ProviderGemini:
+		return &geminiTransport{base: base, config: c, baseURL: baseURL}, nil
+	case ProviderOllama:
+		return &ollamaTransport{base: base, config: c, baseURL: baseURL}, nil
+	default:
+		return nil, errors.Errorf("unknown provider %s", c.Provider)
+	}
+}
+
+// headerTransport adds the configured headers to every request
+type headerTransport struct {
+	base    http.RoundTripper
+	headers map[string]string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	setHeaders(out, t.headers)
+	return t.base.RoundTrip(out)
+}
+
+func setHeaders(req *http.Request, headers map[string]string) {
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+}
+
+// azureTransport sends OpenAI requests to an Azure OpenAI deployment, which
+// carries the model in the URL and authenticates with an api-key header
+type azureTransport struct {
+	base     http.RoundTripper
+	endpoint string
+	apiKey   string
+	headers  map[string]string
+}
+
+func newAzureTransport(base http.RoundTripper, c *config.LLMConfig) (http.RoundTripper, error) {
+	if c.BaseURL == "" {
+		return nil, errors.New("azure provider needs the resource base_url")
+	}
+	deployment := c.Deployment
+	if deployment == "" {
+		deployment = c.Model
+	}
+	version := c.APIVersion
+	if version == "" {
+		version = "2024-10-21"
+	}
+	endpoint, err := url.JoinPath(c.BaseURL, "openai/deployments", deployment, "chat/completions")
+	if err != nil {
+		return nil, errors.Wrap(err, "azure endpoint")
+	}
+	return &azureTransport{
+		base:     base,
+		endpoint: endpoint + "?api-version=" + url.QueryEscape(version),
+		apiKey:   c.APIKey,
+		headers:  c.Headers,
+	}, nil
+}
+
+func (t *azureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	out, err := nativeRequest(req, t.endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	out.Header.Set("api-key", t.apiKey)
+	setHeaders(out, t.headers)
+	return t.base.RoundTrip(out)
+}
+
+// chatRequest is the OpenAI chat completion request after the sampling and
+// usage transports filled it in
+type chatRequest struct {
+	Model            string                  `json:"model"`
+	Messages         []*llm.ChatMessage      `json:"messages"`
+	Tools            []*llm.ChatTool         `json:"tools,omitempty"`
+	Temperature      *float32                `json:"temperature,omitempty"`
+	TopP             *float32                `json:"top_p,omitempty"`
+	MaxTokens        *int32                  `json:"max_tokens,omitempty"`
+	PresencePenalty  *float32                `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float32                `json:"frequency_penalty,omitempty"`
+	Seed             *int32                  `json:"seed,omitempty"`
+	Stop             []string                `json:"stop,omitempty"`
+	Stream           bool                    `json:"stream,omitempty"`
+	StreamOptions    *streamOptions          `json:"stream_options,omitempty"`
+	ResponseFormat   *llm.ChatResponseFormat `json:"response_format,omitempty"`
+}
+
+type streamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+func (r *chatRequest) includeUsage() bool {
+	return r.StreamOptions != nil && r.StreamOptions.IncludeUsage
+}
+
+// readChatRequest decodes the OpenAI request carried by req
+func readChatRequest(req *http.Request) (*chatRequest, error) {
+	if req.Body == nil {
+		return nil, errors.New("empty request body")
+	}
+	data, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var chat chatRequest
+	if err := json.Unmarshal(data, &chat); err != nil {
+		return nil, errors.Wrap(err, "decode chat request")
+	}
+	return &chat, nil
+}
+
+// nativeRequest clones req towards endpoint with body encoded as JSON. A nil
+// body keeps the original one.
+func nativeRequest(req *http.Request, endpoint string, body any) (*http.Request, error) {
+	target, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	out := req.Clone(req.Context())
+	out.URL = target
+	out.Host = target.Host
+	out.Header.Del("Authorization")
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, errors.Wrap(err, "encode native request")
+		}
+		out.Body = io.NopCloser(bytes.NewReader(data))
+		out.ContentLength = int64(len(data))
+	}
+	return out, nil
+}
+
+// messageText returns the text of a message whose content is a string or
+// an array of content parts
+func messageText(content any) string {
+	switch content := content.(type) {
+	case string:
+		return content
+	case []any:
+		var parts []string
+		for _, part := range content {
+			if m, ok := part.(map[string]any); ok && m["type"] == "text" {
+				if text, ok := m["text"].(string); ok {
+					parts = append(parts, text)
+				}
+			}
+		}
+		return strings.Join(parts, "\n")
+	}
+	return ""
+}
+
+// toolArguments decodes the JSON arguments of a tool call
+func toolArguments(call *llm.ChatToolCall) map[string]any {
+	args := map[string]any{}
+	json.Unmarshal([]byte(call.Function.Arguments), &args)
+	return args
+}
+
+// completionResponse wraps a translated completion as an HTTP response
+func completionResponse(resp *http.Response, completion *llm.ChatCompletionResponse) *http.Response {
+	data, _ := json.Marshal(completion)
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Status:        resp.Status,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       resp.Request,
+	}
+}
+
+func newChatCompletion(id, model string) *llm.ChatCompletionResponse {
+	if id == "" {
+		id = "chatcmpl-" + uuid.NewString()
+	}
+	return &llm.ChatCompletionResponse{
+		ID:      id,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+	}
+}
+
+// chunkWriter writes OpenAI chat completion chunks as server-sent events
+type chunkWriter struct {
+	w       io.Writer
+	id      string
+	model   string
+	created int64
+}
+
+func (w *chunkWriter) delta(delta *llm.ChatMessage, finishReason string) error {
+	if delta.Role == "" {
+		delta.Role = llm.RoleAssistant
+	}
+	return w.write([]llm.ChatChoice{{Delta: delta, FinishReason: finishReason}}, nil)
+}
+
+func (w *chunkWriter) usage(usage *llm.ChatUsage) error {
+	return w.write([]llm.ChatChoice{}, usage)
+}
+
+func (w *chunkWriter) write(choices []llm.ChatChoice, usage *llm.ChatUsage) error {
+	data, err := json.Marshal(&llm.ChatCompletionResponse{
+		ID:      w.id,
+		Object:  "chat.completion.chunk",
+		Created: w.created,
+		Model:   w.model,
+		Choices: choices,
+		Usage:   usage,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w.w, "data: %s\n\n", data)
+	return err
+}
+
+func (w *chunkWriter) done() error {
+	_, err := io.WriteString(w.w, "data: [DONE]\n\n")
+	return err
+}
+
+// streamResponse translates a native stream into OpenAI chunks as the
+// client reads them
+func streamResponse(resp *http.Response, model string, translate func(body io.Reader, w *chunkWriter) error) *http.Response {
+	reader, writer := io.Pipe()
+	go func() {
+		w := &chunkWriter{w: writer, id: "chatcmpl-" + uuid.NewString(), model: model, created: time.Now().Unix()}
+		err := translate(resp.Body, w)
+		resp.Body.Close()
+		writer.CloseWithError(err)
+	}()
+
+	header := http.Header{}
+	header.Set("Content-Type", "text/event-stream")
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     resp.Status,
+		Header:     header,
+		Body:       &streamBody{PipeReader: reader, native: resp.Body},
+		Request:    resp.Request,
+	}
+}
+
+// streamBody stops the native stream when the client closes early
+type streamBody struct {
+	*io.PipeReader
+	native io.Closer
+}
+
+func (b *streamBody) Close() error {
+	b.native.Close()
+	return b.PipeReader.Close()
+}
+
+// readEvents calls fn with the data of every server-sent event
+func readEvents(r io.Reader, fn func(data []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if !bytes.HasPrefix(line, []byte("data:")) {
+			continue
+		}
+		data := bytes.TrimSpace(line[len("data:"):])
+		if len(data) == 0 || string(data) == "[DONE]" {
+			continue
+		}
+		if err := fn(data); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,339 @@
+package infra
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"super-llm/config"
+
+	"github.com/cv70/pkgo/llm"
+)
+
+// nativeExchange is a request a provider transport sent and the canned
+// response it got
+type nativeExchange struct {
+	req  *http.Request
+	body map[string]any
+}
+
+// roundTrip sends an OpenAI chat request through the transport of c, whose
+// backend answers with reply, and returns what reached the backend and the
+// translated response
+func roundTrip(t *testing.T, c *config.LLMConfig, chat map[string]any, reply string) (*nativeExchange, *http.Response) {
+	t.Helper()
+	exchange := &nativeExchange{}
+	backend := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		exchange.req = req
+		if err := json.NewDecoder(req.Body).Decode(&exchange.body); err != nil {
+			t.Errorf("decode native request: %v", err)
+		}
+		w := httptest.NewRecorder()
+		w.WriteString(reply)
+		return w.Result(), nil
+	})
+	transport, err := newProviderTransport(backend, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "https://api.openai.com/v1/chat/completions", strings.NewReader(string(data)))
+	req.Header.Set("Authorization", "Bearer sk-openai")
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return exchange, resp
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// chatWithTool is a conversation with a system prompt and a finished tool
+// call, offering the tool again
+func chatWithTool(stream bool) map[string]any {
+	return map[string]any{
+		"model":          "m",
+		"stream":         stream,
+		"stream_options": map[string]bool{"include_usage": true},
+		"max_tokens":     100,
+		"messages": []map[string]any{
+			{"role": "system", "content": "be brief"},
+			{"role": "user", "content": "weather in Paris?"},
+			{"role": "assistant", "tool_calls": []map[string]any{{
+				"id": "call_1", "type": "function",
+				"function": map[string]any{"name": "weather", "arguments": `{"city":"Paris"}`},
+			}}},
+			{"role": "tool", "tool_call_id": "call_1", "content": `{"sky":"clear"}`},
+		},
+		"tools": []map[string]any{{
+			"type":     "function",
+			"function": map[string]any{"name": "weather", "parameters": map[string]any{"type": "object"}},
+		}},
+	}
+}
+
+func decodeCompletion(t *testing.T, resp *http.Response) *llm.ChatCompletionResponse {
+	t.Helper()
+	var completion llm.ChatCompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		t.Fatal(err)
+	}
+	return &completion
+}
+
+// readStream joins the content of the chunks of a translated stream and
+// returns it with the finish reason and usage
+func readStream(t *testing.T, resp *http.Response) (string, string, *llm.ChatUsage) {
+	t.Helper()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(data), "data: [DONE]\n\n") {
+		t.Errorf("stream does not end with [DONE]: %s", data)
+	}
+	var text strings.Builder
+	var finishReason string
+	var usage *llm.ChatUsage
+	err = readEvents(strings.NewReader(string(data)), func(data []byte) error {
+		var chunk llm.ChatCompletionResponse
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return err
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			content, _ := choice.Delta.Content.(string)
+			text.WriteString(content)
+			if choice.FinishReason != "" {
+				finishReason = choice.FinishReason
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return text.String(), finishReason, usage
+}
+
+func TestAnthropic(t *testing.T) {
+	c := &config.LLMConfig{Provider: ProviderAnthropic, BaseURL: "https://anthropic.test/v1", APIKey: "sk-ant"}
+	exchange, resp := roundTrip(t, c, chatWithTool(false), `{
+		"id": "msg_1",
+		"content": [{"type": "text", "text": "Checking."}, {"type": "tool_use", "id": "tu_1", "name": "weather", "input": {"city": "Lyon"}}],
+		"stop_reason": "tool_use",
+		"usage": {"input_tokens": 10, "output_tokens": 5}
+	}`)
+
+	if exchange.req.URL.String() != "https://anthropic.test/v1/messages" {
+		t.Errorf("endpoint %s", exchange.req.URL)
+	}
+	if exchange.req.Header.Get("x-api-key") != "sk-ant" || exchange.req.Header.Get("Authorization") != "" {
+		t.Errorf("auth headers %v", exchange.req.Header)
+	}
+	if exchange.req.Header.Get("anthropic-version") != anthropicVersion {
+		t.Errorf("anthropic-version %q", exchange.req.Header.Get("anthropic-version"))
+	}
+	if exchange.body["system"] != "be brief" || exchange.body["max_tokens"] != 100.0 {
+		t.Errorf("system %v max_tokens %v", exchange.body["system"], exchange.body["max_tokens"])
+	}
+	// user, assistant tool_use, user tool_result
+	messages, _ := exchange.body["messages"].([]any)
+	if len(messages) != 3 {
+		t.Fatalf("messages %v, want alternating turns", messages)
+	}
+	result := messages[2].(map[string]any)["content"].([]any)[0].(map[string]any)
+	if result["type"] != "tool_result" || result["tool_use_id"] != "call_1" {
+		t.Errorf("tool result %v", result)
+	}
+
+	completion := decodeCompletion(t, resp)
+	choice := completion.Choices[0]
+	if choice.Message.Content != "Checking." || choice.FinishReason != "tool_calls" {
+		t.Errorf("reply %v finish %s", choice.Message.Content, choice.FinishReason)
+	}
+	if len(choice.Message.ToolCalls) != 1 || choice.Message.ToolCalls[0].Function.Arguments != `{"city":"Lyon"}` {
+		t.Errorf("tool calls %+v", choice.Message.ToolCalls)
+	}
+	if completion.Usage == nil || completion.Usage.TotalTokens != 15 {
+		t.Errorf("usage %+v", completion.Usage)
+	}
+}
+
+func TestAnthropicStream(t *testing.T) {
+	c := &config.LLMConfig{Provider: ProviderAnthropic, APIKey: "sk-ant"}
+	exchange, resp := roundTrip(t, c, chatWithTool(true), strings.Join([]string{
+		`event: message_start`,
+		`data: {"type":"message_start","message":{"id":"msg_1","usage":{"input_tokens":10}}}`,
+		`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Sunny "}}`,
+		`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"today."}}`,
+		`data: {"type":"message_delta","delta":{"stop_reason":"max_tokens"},"usage":{"output_tokens":3}}`,
+		`data: {"type":"message_stop"}`,
+	}, "\n\n"))
+	if exchange.req.URL.String() != defaultBaseURLs[ProviderAnthropic]+"/messages" {
+		t.Errorf("endpoint %s", exchange.req.URL)
+	}
+	text, finishReason, usage := readStream(t, resp)
+	if text != "Sunny today." || finishReason != "length" {
+		t.Errorf("streamed %q finish %s", text, finishReason)
+	}
+	if usage == nil || usage.PromptTokens != 10 || usage.CompletionTokens != 3 {
+		t.Errorf("usage %+v", usage)
+	}
+}
+
+func TestGemini(t *testing.T) {
+	c := &config.LLMConfig{Provider: ProviderGemini, APIKey: "g-key"}
+	exchange, resp := roundTrip(t, c, chatWithTool(false), `{
+		"responseId": "r1",
+		"candidates": [{"content": {"role": "model", "parts": [{"text": "Clear skies."}]}, "finishReason": "STOP"}],
+		"usageMetadata": {"promptTokenCount": 8, "candidatesTokenCount": 3, "totalTokenCount": 11}
+	}`)
+
+	if exchange.req.URL.String() != defaultBaseURLs[ProviderGemini]+"/models/m:generateContent" {
+		t.Errorf("endpoint %s", exchange.req.URL)
+	}
+	if exchange.req.Header.Get("x-goog-api-key") != "g-key" || exchange.req.Header.Get("Authorization") != "" {
+		t.Errorf("auth headers %v", exchange.req.Header)
+	}
+	if _, ok := exchange.body["systemInstruction"]; !ok {
+		t.Errorf("no system instruction: %v", exchange.body)
+	}
+	// user, model function call, user function response
+	contents, _ := exchange.body["contents"].([]any)
+	if len(contents) != 3 {
+		t.Fatalf("contents %v", contents)
+	}
+	part := contents[2].(map[string]any)["parts"].([]any)[0].(map[string]any)
+	response, _ := part["functionResponse"].(map[string]any)
+	if response["name"] != "weather" {
+		t.Errorf("function response %v, want it named after the call", part)
+	}
+
+	completion := decodeCompletion(t, resp)
+	if completion.ID != "r1" || completion.Choices[0].Message.Content != "Clear skies." || completion.Choices[0].FinishReason != "stop" {
+		t.Errorf("completion %+v", completion)
+	}
+	if completion.Usage == nil || completion.Usage.TotalTokens != 11 {
+		t.Errorf("usage %+v", completion.Usage)
+	}
+}
+
+func TestGeminiStream(t *testing.T) {
+	c := &config.LLMConfig{Provider: ProviderGemini, BaseURL: "https://gemini.test/v1beta/", APIKey: "g-key"}
+	exchange, resp := roundTrip(t, c, chatWithTool(true), strings.Join([]string{
+		`data: {"candidates":[{"content":{"role":"model","parts":[{"text":"Clear "}]}}]}`,
+		`data: {"candidates":[{"content":{"role":"model","parts":[{"text":"skies."}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":8,"candidatesTokenCount":3,"totalTokenCount":11}}`,
+	}, "\n\n"))
+	if exchange.req.URL.String() != "https://gemini.test/v1beta/models/m:streamGenerateContent?alt=sse" {
+		t.Errorf("endpoint %s", exchange.req.URL)
+	}
+	text, finishReason, usage := readStream(t, resp)
+	if text != "Clear skies." || finishReason != "stop" {
+		t.Errorf("streamed %q finish %s", text, finishReason)
+	}
+	if usage == nil || usage.TotalTokens != 11 {
+		t.Errorf("usage %+v", usage)
+	}
+}
+
+func TestOllama(t *testing.T) {
+	c := &config.LLMConfig{Provider: ProviderOllama}
+	exchange, resp := roundTrip(t, c, chatWithTool(false), `{
+		"model": "m",
+		"message": {"role": "assistant", "content": "", "tool_calls": [{"function": {"name": "weather", "arguments": {"city": "Nice"}}}]},
+		"done": true,
+		"prompt_eval_count": 6,
+		"eval_count": 2
+	}`)
+
+	if exchange.req.URL.String() != "http://localhost:11434/api/chat" {
+		t.Errorf("endpoint %s", exchange.req.URL)
+	}
+	if exchange.req.Header.Get("Authorization") != "" {
+		t.Errorf("OpenAI key forwarded to ollama")
+	}
+	if options, _ := exchange.body["options"].(map[string]any); options["num_predict"] != 100.0 {
+		t.Errorf("options %v", exchange.body["options"])
+	}
+	messages, _ := exchange.body["messages"].([]any)
+	if len(messages) != 4 {
+		t.Fatalf("messages %v", messages)
+	}
+	call := messages[2].(map[string]any)["tool_calls"].([]any)[0].(map[string]any)["function"].(map[string]any)
+	if arguments, _ := call["arguments"].(map[string]any); arguments["city"] != "Paris" {
+		t.Errorf("tool call %v, want decoded arguments", call)
+	}
+
+	completion := decodeCompletion(t, resp)
+	choice := completion.Choices[0]
+	if choice.FinishReason != "tool_calls" || len(choice.Message.ToolCalls) != 1 || choice.Message.ToolCalls[0].Function.Name != "weather" {
+		t.Errorf("choice %+v", choice)
+	}
+	if completion.Usage == nil || completion.Usage.TotalTokens != 8 {
+		t.Errorf("usage %+v", completion.Usage)
+	}
+}
+
+func TestOllamaStream(t *testing.T) {
+	c := &config.LLMConfig{Provider: ProviderOllama, BaseURL: "http://gpu:11434", APIKey: "proxy-key"}
+	exchange, resp := roundTrip(t, c, chatWithTool(true), strings.Join([]string{
+		`{"message":{"role":"assistant","content":"Mild"},"done":false}`,
+		`{"message":{"role":"assistant","content":" weather."},"done":false}`,
+		`{"message":{"role":"assistant","content":""},"done":true,"done_reason":"length","prompt_eval_count":6,"eval_count":2}`,
+	}, "\n"))
+	if exchange.req.Header.Get("Authorization") != "Bearer proxy-key" {
+		t.Errorf("authorization %q", exchange.req.Header.Get("Authorization"))
+	}
+	text, finishReason, usage := readStream(t, resp)
+	if text != "Mild weather." || finishReason != "length" {
+		t.Errorf("streamed %q finish %s", text, finishReason)
+	}
+	if usage == nil || usage.TotalTokens != 8 {
+		t.Errorf("usage %+v", usage)
+	}
+}
+
+func TestAzure(t *testing.T) {
+	c := &config.LLMConfig{
+		Provider:   ProviderAzure,
+		BaseURL:    "https://res.openai.azure.com",
+		Model:      "gpt-4o",
+		Deployment: "prod-4o",
+		APIKey:     "az-key",
+		Headers:    map[string]string{"X-Tenant": "t1"},
+	}
+	exchange, resp := roundTrip(t, c, chatWithTool(false), `{"id":"c1","choices":[{"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}]}`)
+	if exchange.req.URL.String() != "https://res.openai.azure.com/openai/deployments/prod-4o/chat/completions?api-version=2024-10-21" {
+		t.Errorf("endpoint %s", exchange.req.URL)
+	}
+	if exchange.req.Header.Get("api-key") != "az-key" || exchange.req.Header.Get("Authorization") != "" || exchange.req.Header.Get("X-Tenant") != "t1" {
+		t.Errorf("headers %v", exchange.req.Header)
+	}
+	if exchange.body["model"] != "m" {
+		t.Errorf("body changed: %v", exchange.body)
+	}
+	if completion := decodeCompletion(t, resp); completion.Choices[0].Message.Content != "ok" {
+		t.Errorf("completion %+v", completion)
+	}
+
+	if _, err := newProviderTransport(http.DefaultTransport, &config.LLMConfig{Provider: ProviderAzure}); err == nil {
+		t.Errorf("azure without base URL accepted")
+	}
+	if _, err := newProviderTransport(http.DefaultTransport, &config.LLMConfig{Provider: "bedrock"}); err == nil {
+		t.Errorf("unknown provider accepted")
+	}
+}
@@ -0,0 +1,186 @@
+package infra
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	// Pure Go driver, so that CGO_ENABLED=0 builds keep the default store
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS records (
+	id         TEXT PRIMARY KEY,
+	created_at INTEGER NOT NULL,
+	ref        TEXT NOT NULL DEFAULT '',
+	owner      TEXT NOT NULL DEFAULT '',
+	model      TEXT NOT NULL DEFAULT '',
+	text       TEXT NOT NULL DEFAULT '',
+	data       BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS records_created_at ON records (created_at);
+`
+
+// sqliteIndexes are created after migrating databases without the columns
+// they cover
+const sqliteIndexes = `
+CREATE INDEX IF NOT EXISTS records_ref ON records (ref);
+CREATE INDEX IF NOT EXISTS records_owner ON records (owner);
+`
+
+// sqliteColumns are the columns added after the first schema, with their
+// definitions
+var sqliteColumns = [][2]string{
+	{"ref", "TEXT NOT NULL DEFAULT ''"},
+	{"owner", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// SQLiteStore keeps records in a SQLite database
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, errors.Wrap(err, "create storage dir")
+		}
+	}
+	db, err := sql.Open("sqlite", path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, errors.Wrap(err, "open sqlite store")
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "create sqlite schema")
+	}
+	if err := migrateColumns(db); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "migrate sqlite schema")
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Put(ctx context.Context, record *Record) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT OR REPLACE INTO records (id, created_at, ref, owner, model, text, data) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		record.ID, record.CreatedAt.UnixNano(), record.Ref, record.Owner, record.Model, record.Text, []byte(record.Data))
+	return errors.Wrap(err, "insert record")
+}
+
+func (s *SQLiteStore) Get(ctx context.Context, id string) (*Record, error) {
+	row := s.db.QueryRowContext(ctx,
+		`SELECT id, created_at, ref, owner, model, text, data FROM records WHERE id = ?`, id)
+	record, err := scanRecord(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return record, errors.Wrap(err, "query record")
+}
+
+func (s *SQLiteStore) List(ctx context.Context, query *RecordQuery) ([]*Record, error) {
+	var where []string
+	var args []any
+	if query.Ref != "" {
+		where = append(where, "ref = ?")
+		args = append(args, query.Ref)
+	}
+	if query.Owner != "" {
+		where = append(where, "owner = ?")
+		args = append(args, query.Owner)
+	}
+	if query.Model != "" {
+		where = append(where, "model = ?")
+		args = append(args, query.Model)
+	}
+	if !query.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, query.Since.UnixNano())
+	}
+	if !query.Until.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, query.Until.UnixNano())
+	}
+	if query.Query != "" {
+		where = append(where, "instr(lower(text), lower(?)) > 0")
+		args = append(args, query.Query)
+	}
+	if query.After != nil {
+		after := query.After.CreatedAt.UnixNano()
+		where = append(where, "(created_at < ? OR (created_at = ? AND id < ?))")
+		args = append(args, after, after, query.After.ID)
+	}
+
+	stmt := "SELECT id, created_at, ref, owner, model, text, data FROM records"
+	if len(where) > 0 {
+		stmt += " WHERE " + strings.Join(where, " AND ")
+	}
+	stmt += " ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?"
+	args = append(args, query.limit(), query.Offset)
+
+	rows, err := s.db.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "query records")
+	}
+	defer rows.Close()
+	var records []*Record
+	for rows.Next() {
+		record, err := scanRecord(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "scan record")
+		}
+		records = append(records, record)
+	}
+	return records, errors.Wrap(rows.Err(), "query records")
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func scanRecord(row interface{ Scan(...any) error }) (*Record, error) {
+	var record Record
+	var createdAt int64
+	var data []byte
+	if err := row.Scan(&record.ID, &createdAt, &record.Ref, &record.Owner, &record.Model, &record.Text, &data); err != nil {
+		return nil, err
+	}
+	record.CreatedAt = time.Unix(0, createdAt)
+	record.Data = data
+	return &record, nil
+}
+
+// migrateColumns adds the columns missing from databases created before
+// they existed
+func migrateColumns(db *sql.DB) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info('records')`)
+	if err != nil {
+		return err
+	}
+	found := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		found[name] = true
+	}
+	rows.Close()
+	for _, column := range sqliteColumns {
+		if found[column[0]] {
+			continue
+		}
+		if _, err := db.Exec(`ALTER TABLE records ADD COLUMN ` + column[0] + ` ` + column[1]); err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec(sqliteIndexes)
+	return err
+}
@@ -0,0 +1,216 @@
+package infra
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"super-llm/config"
+
+	"github.com/pkg/errors"
+)
+
+// Storage types
+const (
+	StorageSQLite = "sqlite"
+	StorageJSONL  = "jsonl"
+)
+
+const defaultListLimit = 20
+
+// ErrNotFound is returned when a record does not exist
+var ErrNotFound = errors.New("record not found")
+
+// Record is a stored document. Data is opaque to the store; Ref, Owner,
+// Model and Text are kept alongside for lookup, filtering and search.
+type Record struct {
+	ID        string          `json:"id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Ref       string          `json:"ref,omitempty"`
+	Owner     string          `json:"owner,omitempty"`
+	Model     string          `json:"model,omitempty"`
+	Text      string          `json:"text,omitempty"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// RecordQuery filters and pages records, newest first
+type RecordQuery struct {
+	// Ref matches the secondary key of records
+	Ref string
+	// Owner matches the API key records were made for
+	Owner  string
+	Model  string
+	Query  string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+	Offset int
+	// After continues a listing past the last record of the previous page.
+	// Unlike Offset it is not shifted by records written meanwhile.
+	After *Cursor
+}
+
+// Cursor is the position of a record in a listing, ordered by creation time
+// and then by ID, both descending
+type Cursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+// follows reports whether r comes after the cursor in a listing
+func (c *Cursor) follows(r *Record) bool {
+	if cmp := r.CreatedAt.Compare(c.CreatedAt); cmp != 0 {
+		return cmp < 0
+	}
+	return r.ID < c.ID
+}
+
+func (q *RecordQuery) match(r *Record) bool {
+	if q.After != nil && !q.After.follows(r) {
+		return false
+	}
+	if q.Ref != "" && r.Ref != q.Ref {
+		return false
+	}
+	if q.Owner != "" && r.Owner != q.Owner {
+		return false
+	}
+	if q.Model != "" && r.Model != q.Model {
+		return false
+	}
+	if !q.Since.IsZero() && r.CreatedAt.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !r.CreatedAt.Before(q.Until) {
+		return false
+	}
+	return q.Query == "" || strings.Contains(strings.ToLower(r.Text), strings.ToLower(q.Query))
+}
+
+func (q *RecordQuery) limit() int {
+	if q.Limit <= 0 {
+		return defaultListLimit
+	}
+	return q.Limit
+}
+
+// Store persists records by ID. Put replaces an existing record.
+type Store interface {
+	Put(ctx context.Context, record *Record) error
+	Get(ctx context.Context, id string) (*Record, error)
+	List(ctx context.Context, query *RecordQuery) ([]*Record, error)
+	Close() error
+}
+
+// NewStore opens the store selected by the configuration
+func NewStore(c *config.StorageConfig) (Store, error) {
+	switch c.Type {
+	case "", StorageSQLite:
+		path := c.Path
+		if path == "" {
+			path = "deliberations.db"
+		}
+		return NewSQLiteStore(path)
+	case StorageJSONL:
+		path := c.Path
+		if path == "" {
+			path = "deliberations.jsonl"
+		}
+		return NewJSONLStore(path)
+	default:
+		return nil, errors.Errorf("unknown storage type %s", c.Type)
+	}
+}
+
+// JSONLStore appends records to a JSON Lines file and keeps an index in
+// memory. A record written again supersedes the earlier line.
+type JSONLStore struct {
+	mu      sync.RWMutex
+	file    *os.File
+	records map[string]*Record
+}
+
+func NewJSONLStore(path string) (*JSONLStore, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, errors.Wrap(err, "create storage dir")
+		}
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, errors.Wrap(err, "open jsonl store")
+	}
+
+	records := map[string]*Record{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var record Record
+		if json.Unmarshal(scanner.Bytes(), &record) != nil || record.ID == "" {
+			continue
+		}
+		records[record.ID] = &record
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "read jsonl store")
+	}
+	return &JSONLStore{file: file, records: records}, nil
+}
+
+func (s *JSONLStore) Put(ctx context.Context, record *Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "encode record")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return errors.Wrap(err, "append record")
+	}
+	s.records[record.ID] = record
+	return nil
+}
+
+func (s *JSONLStore) Get(ctx context.Context, id string) (*Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	record, ok := s.records[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return record, nil
+}
+
+func (s *JSONLStore) List(ctx context.Context, query *RecordQuery) ([]*Record, error) {
+	s.mu.RLock()
+	var records []*Record
+	for _, record := range s.records {
+		if query.match(record) {
+			records = append(records, record)
+		}
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(records, func(a, b *Record) int {
+		if cmp := b.CreatedAt.Compare(a.CreatedAt); cmp != 0 {
+			return cmp
+		}
+		return strings.Compare(b.ID, a.ID)
+	})
+	if query.Offset >= len(records) {
+		return nil, nil
+	}
+	records = records[query.Offset:]
+	return records[:min(len(records), query.limit())], nil
+}
+
+func (s *JSONLStore) Close() error {
+	return s.file.Close()
+}
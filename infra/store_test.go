@@ -0,0 +1,68 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestStoreCursorPaging pages through a store that keeps being written to
+// and expects every earlier record exactly once
+func TestStoreCursorPaging(t *testing.T) {
+	stores := map[string]func(dir string) (Store, error){
+		"jsonl":  func(dir string) (Store, error) { return NewJSONLStore(filepath.Join(dir, "d.jsonl")) },
+		"sqlite": func(dir string) (Store, error) { return NewSQLiteStore(filepath.Join(dir, "d.db")) },
+	}
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store, err := open(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			// Records share creation times so that the ID breaks ties
+			start := time.Unix(1700000000, 0)
+			for i := range 10 {
+				record := &Record{ID: fmt.Sprintf("r%02d", i), CreatedAt: start.Add(time.Duration(i/2) * time.Second), Data: []byte("{}")}
+				if err := store.Put(ctx, record); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			seen := map[string]int{}
+			query := &RecordQuery{Limit: 3}
+			for page := 0; ; page++ {
+				records, err := store.List(ctx, query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, record := range records {
+					seen[record.ID]++
+				}
+				// A newer record arrives between pages
+				newer := &Record{ID: fmt.Sprintf("new%d", page), CreatedAt: start.Add(time.Hour), Data: []byte("{}")}
+				if err := store.Put(ctx, newer); err != nil {
+					t.Fatal(err)
+				}
+				if len(records) < query.Limit {
+					break
+				}
+				last := records[len(records)-1]
+				query.After = &Cursor{CreatedAt: last.CreatedAt, ID: last.ID}
+			}
+
+			for i := range 10 {
+				if id := fmt.Sprintf("r%02d", i); seen[id] != 1 {
+					t.Errorf("record %s listed %d times", id, seen[id])
+				}
+			}
+			if seen["new0"] != 0 {
+				t.Errorf("record written after the first page was listed")
+			}
+		})
+	}
+}
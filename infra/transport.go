@@ -0,0 +1,161 @@
+package infra
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"super-llm/config"
+)
+
+// StatusError is returned for a backend response with an error status. The
+// LLM client drops such responses without an error, so the transport
+// reports them instead.
+type StatusError struct {
+	StatusCode int
+	// Body is the start of the response body
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("backend responded with status %d: %s", e.StatusCode, e.Body)
+}
+
+// newTransport chains the request rewriting transports used by every LLM
+// client, holding requests back while the limiter has no room
+func newTransport(c *config.LLMConfig, cassette *Cassette, limiter *Limiter) (http.RoundTripper, error) {
+	var transport http.RoundTripper = http.DefaultTransport
+	if cassette != nil {
+		transport = cassette.Transport(transport)
+	}
+	transport, err := newProviderTransport(transport, c)
+	if err != nil {
+		return nil, err
+	}
+	transport = &usageTransport{base: transport}
+	transport = newSamplingTransport(transport, c)
+	if limiter != nil {
+		transport = &limitTransport{base: transport, limiter: limiter}
+	}
+	return &statusTransport{base: transport}, nil
+}
+
+// statusTransport turns responses with an error status into a StatusError
+type statusTransport struct {
+	base http.RoundTripper
+}
+
+func (t *statusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode == http.StatusOK {
+		return resp, err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, &StatusError{StatusCode: resp.StatusCode, Body: string(bytes.TrimSpace(data))}
+}
+
+// rewriteBody applies fn to the JSON object body of a POST request and
+// returns a clone carrying the rewritten body. Non-JSON bodies pass through.
+func rewriteBody(req *http.Request, fn func(body map[string]json.RawMessage) error) (*http.Request, error) {
+	if req.Body == nil || req.Method != http.MethodPost {
+		return req, nil
+	}
+	data, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var body map[string]json.RawMessage
+	if json.Unmarshal(data, &body) == nil {
+		if err := fn(body); err != nil {
+			return nil, err
+		}
+		if merged, err := json.Marshal(body); err == nil {
+			data = merged
+		}
+	}
+
+	out := req.Clone(req.Context())
+	out.Body = io.NopCloser(bytes.NewReader(data))
+	out.ContentLength = int64(len(data))
+	return out, nil
+}
+
+// samplingTransport fills the sampling parameters configured for an LLM into
+// outgoing request bodies. Parameters already set by the caller are kept, so
+// client supplied values still win over configured defaults.
+type samplingTransport struct {
+	base   http.RoundTripper
+	params map[string]any
+}
+
+func newSamplingTransport(base http.RoundTripper, c *config.LLMConfig) http.RoundTripper {
+	params := map[string]any{}
+	if c.MaxTokens != nil {
+		params["max_tokens"] = *c.MaxTokens
+	}
+	if c.Temperature != nil {
+		params["temperature"] = *c.Temperature
+	}
+	if c.TopP != nil {
+		params["top_p"] = *c.TopP
+	}
+	if c.PresencePenalty != nil {
+		params["presence_penalty"] = *c.PresencePenalty
+	}
+	if c.FrequencyPenalty != nil {
+		params["frequency_penalty"] = *c.FrequencyPenalty
+	}
+	if c.Seed != nil {
+		params["seed"] = *c.Seed
+	}
+	if len(params) == 0 {
+		return base
+	}
+	return &samplingTransport{base: base, params: params}
+}
+
+func (t *samplingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	out, err := rewriteBody(req, func(body map[string]json.RawMessage) error {
+		for key, value := range t.params {
+			if _, ok := body[key]; ok {
+				continue
+			}
+			raw, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			body[key] = raw
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(out)
+}
+
+// usageTransport asks backends to report token usage at the end of streamed
+// responses, so that streaming calls can be accounted like blocking ones.
+type usageTransport struct {
+	base http.RoundTripper
+}
+
+func (t *usageTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	out, err := rewriteBody(req, func(body map[string]json.RawMessage) error {
+		if string(body["stream"]) != "true" {
+			return nil
+		}
+		if _, ok := body["stream_options"]; !ok {
+			body["stream_options"] = json.RawMessage(`{"include_usage":true}`)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(out)
+}
@@ -7,7 +7,9 @@ import (
 	"os"
 	"os/signal"
 	"super-llm/api"
+	"super-llm/cmd"
 	"super-llm/config"
+	"super-llm/domain/auth"
 	"super-llm/domain/committee"
 	"syscall"
 
@@ -15,19 +17,35 @@ import (
 )
 
 func main() {
+	ctx := context.Background()
+
+	// Subcommands run instead of the server
+	if len(os.Args) > 1 {
+		if err := cmd.Run(ctx, os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Load configuration
 	cfg := config.GetConfig()
 	if cfg == nil {
 		log.Fatal("Failed to load configuration")
 	}
-	ctx := context.Background()
 
 	// Create committee domaincommittee
 	committee, err := committee.BuildCommitteeDomain(ctx, cfg)
 	mistake.Unwrap(err)
 
+	// Load API keys when auth is enabled
+	var keys *auth.Auth
+	if cfg.Auth != nil {
+		keys, err = auth.New(cfg.Auth)
+		mistake.Unwrap(err)
+	}
+
 	// Create API server
-	server := api.NewServer(committee)
+	server := api.NewServer(committee, keys, cfg.CORS)
 
 	// Get port from environment or use default
 	port := os.Getenv("PORT")
@@ -48,6 +66,23 @@ func main() {
 		cancel()
 	}()
 
+	// Reload the configuration on SIGHUP and whenever the file changes.
+	// Requests in flight finish with the committee they started on.
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	changes := config.Watch(ctx)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hupChan:
+			case <-changes:
+			}
+			reloadConfig(ctx, server)
+		}
+	}()
+
 	// Start server
 	if err := server.Start(ctx, port); err != nil {
 		slog.Error("Server error", slog.Any("err", err))
@@ -56,3 +91,21 @@ func main() {
 
 	slog.Info("Server stopped")
 }
+
+// reloadConfig loads and validates the configuration file and switches the
+// server to it, keeping the current configuration when anything fails
+func reloadConfig(ctx context.Context, server *api.Server) {
+	cfg, err := config.LoadConfig()
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err == nil {
+		err = server.Reload(ctx, cfg)
+	}
+	if err != nil {
+		slog.Error("Failed to reload configuration, keeping the current one", slog.Any("err", err))
+		return
+	}
+	config.SetConfig(cfg)
+	slog.Info("Configuration reloaded", slog.Any("path", config.Path()))
+}